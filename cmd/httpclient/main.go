@@ -1,69 +1,262 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"httpfromtcp/internal"
-
+	"httpfromtcp/internal/client"
+	"io"
 	"log"
-	"net"
+	"os"
+	"sort"
 	"strings"
+	"time"
 )
 
-func Must[T any](x T, err error) T {
-	if err != nil {
-		log.Fatal(err)
+// Exit codes, the HTTP status classes map to their first digit.
+const (
+	exitOK        = 0
+	exitTransport = 1
+	exitUsage     = 2
+	exitRedirect  = 3
+	exitClientErr = 4
+	exitServerErr = 5
+)
+
+// headerFlags collects repeated -H flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	name, _, found := strings.Cut(v, ":")
+	if !found || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header %q is not in the form \"Name: value\"", v)
 	}
-	return x
+	*h = append(*h, v)
+	return nil
 }
 
-func main() {
-	addr := flag.String("addr", ":8000", "server address")
-	proto := flag.String("proto", "tcp", "protocol to use")
+type config struct {
+	method       string
+	target       string
+	headers      headerFlags
+	data         string
+	verbose      bool
+	include      bool
+	output       string
+	timeout      time.Duration
+	follow       bool
+	maxRedirects int
+	insecure     bool
+	proto        string
+	addr         string
+	addrSet      bool
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage: httpclient [flags] URL
+
+URL is either absolute, e.g. http://localhost:42069/path, or a path sent
+to -addr over -proto, e.g. /yourproblem.
+
+Exit codes: 0 for 1xx/2xx, 3 for 3xx, 4 for 4xx, 5 for 5xx responses,
+1 if no response was received and 2 for usage errors.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func parseFlags() (*config, error) {
+	cfg := &config{}
+	flag.StringVar(&cfg.method, "X", "", "request method (default GET, or POST with -d)")
+	flag.Var(&cfg.headers, "H", "request header \"Name: value\", may be repeated")
+	flag.StringVar(&cfg.data, "d", "", "request body, @file reads it from a file and @- from stdin")
+	flag.BoolVar(&cfg.verbose, "v", false, "dump the raw request and response to stderr")
+	flag.BoolVar(&cfg.include, "i", false, "include the status-line and headers in the output")
+	flag.BoolVar(&cfg.include, "include", false, "same as -i")
+	flag.StringVar(&cfg.output, "o", "", "write the body to a file instead of stdout")
+	flag.DurationVar(&cfg.timeout, "timeout", 30*time.Second, "timeout of the whole exchange")
+	flag.BoolVar(&cfg.follow, "L", false, "follow redirects")
+	flag.IntVar(&cfg.maxRedirects, "max-redirs", 10, "maximum number of redirects followed with -L")
+	flag.BoolVar(&cfg.insecure, "k", false, "skip verification of the server certificate")
+	flag.StringVar(&cfg.proto, "proto", "tcp", "protocol to use: tcp, udp or unix")
+	flag.StringVar(&cfg.addr, "addr", ":8000", "server address, or socket path for unix")
+	flag.Usage = usage
 	flag.Parse()
 
-	var connection net.Conn
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "addr" {
+			cfg.addrSet = true
+		}
+	})
+	cfg.proto = strings.ToLower(cfg.proto)
+	switch cfg.proto {
+	case "tcp", "udp", "unix":
+	default:
+		return nil, fmt.Errorf("invalid protocol %q", cfg.proto)
+	}
 
-	switch strings.ToLower(*proto) {
+	switch flag.NArg() {
+	case 0:
+		cfg.target = "/"
+	case 1:
+		cfg.target = flag.Arg(0)
+	default:
+		return nil, errors.New("expected a single URL")
+	}
+	if cfg.method == "" {
+		cfg.method = "GET"
+		if cfg.data != "" {
+			cfg.method = "POST"
+		}
+	}
+	return cfg, nil
+}
 
-	case "tcp":
-		connection = Must(net.Dial("tcp", *addr))
-	case "udp":
-		raddr := Must(net.ResolveUDPAddr("udp", *addr))
-		fmt.Println("UDP address:", raddr)
-		connection = Must(net.DialUDP("udp", nil, raddr))
+// readBody returns the request body given with -d.
+func readBody(data string) ([]byte, error) {
+	switch {
+	case data == "@-":
+		return io.ReadAll(os.Stdin)
+	case strings.HasPrefix(data, "@"):
+		return os.ReadFile(strings.TrimPrefix(data, "@"))
 	default:
-		log.Fatal("Invalid protocol used. see help")
+		return []byte(data), nil
 	}
-	defer func() {
-		if err := connection.Close(); err != nil {
-			log.Printf("error closing UDP connection: %v", err)
+}
+
+func buildRequest(cfg *config) (*internal.Request, error) {
+	r := internal.NewRequest(strings.ToUpper(cfg.method), cfg.target)
+	// repeated headers are combined as curl does, cookies with "; ".
+	for _, h := range cfg.headers {
+		name, val, _ := strings.Cut(h, ":")
+		r.Headers.Add(strings.TrimSpace(name), strings.TrimSpace(val))
+	}
+	if !strings.Contains(cfg.target, "://") && r.GetHeader("Host") == "" && cfg.proto != "unix" {
+		r.Headers.Set("Host", cfg.addr)
+	}
+	if r.GetHeader("User-Agent") == "" {
+		r.Headers.Set("User-Agent", "httpclient")
+	}
+	if cfg.data != "" {
+		body, err := readBody(cfg.data)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		r.Body = body
+	}
+	return r, nil
+}
+
+func newClient(cfg *config) *client.Client {
+	opts := []client.ClientOption{client.WithTimeout(cfg.timeout)}
+	// an absolute URL is dialed directly unless the transport is overridden.
+	if !strings.Contains(cfg.target, "://") || cfg.proto != "tcp" || cfg.addrSet {
+		opts = append(opts, client.WithNetwork(cfg.proto, cfg.addr))
+	}
+	if cfg.follow {
+		opts = append(opts, client.WithFollowRedirects(cfg.maxRedirects), client.WithCookieJar(client.NewJar()))
+	}
+	if cfg.insecure {
+		opts = append(opts, client.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}))
+	}
+	if cfg.verbose {
+		opts = append(opts, client.WithWireTap(os.Stderr))
+	}
+	return client.NewClient(opts...)
+}
 
-	r := internal.NewRequest("GET", "/yourproblem")
-	r.SetBody([]byte("Welcome"), "plain/text")
-	n, err := connection.Write([]byte(r.String()))
+// writeHead writes the status-line and the headers of resp to w.
+func writeHead(w io.Writer, resp *internal.Response) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HTTP/%s %d %s\r\n", resp.ResponseLine.HTTPVersion, resp.ResponseLine.StatusCode, resp.ResponseLine.ReasonPhrase)
+	keys := make([]string, 0, len(resp.Headers.HeadersMap))
+	for k := range resp.Headers.HeadersMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range resp.Headers.Values(k) {
+			fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+		}
+	}
+	b.WriteString("\r\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func exitCode(code internal.HTTPStatusCode) int {
+	switch {
+	case code >= 500:
+		return exitServerErr
+	case code >= 400:
+		return exitClientErr
+	case code >= 300:
+		return exitRedirect
+	default:
+		return exitOK
+	}
+}
+
+func run() int {
+	cfg, err := parseFlags()
+	if err != nil {
+		log.Print(err)
+		usage()
+		return exitUsage
+	}
+	r, err := buildRequest(cfg)
 	if err != nil {
-		log.Fatal(err)
+		log.Print(err)
+		return exitUsage
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.output != "" {
+		f, err := os.Create(cfg.output)
+		if err != nil {
+			log.Print(err)
+			return exitUsage
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				log.Printf("error closing the output file: %v", err)
+			}
+		}()
+		out = f
 	}
-	log.Printf("Written %d to %s\n", n, connection.RemoteAddr().String())
-	msg, err := internal.MessageFromReader(connection)
+
+	resp, body, err := newClient(cfg).Stream(context.Background(), r)
 	if err != nil {
-		log.Printf("error parsing response: %v", err)
-		return
+		log.Printf("error sending request: %v", err)
+		return exitTransport
 	}
-	resp, ok := msg.(*internal.Response)
-	if !ok {
-		log.Println("error converting http message to response")
-		return
+	defer func() {
+		_ = body.Close()
+	}()
+
+	if cfg.include {
+		if err := writeHead(out, resp); err != nil {
+			log.Printf("error writing the headers: %v", err)
+			return exitTransport
+		}
 	}
-	fmt.Println("Server returned response")
-	fmt.Printf("- Status Code: %d\n", resp.ResponseLine.StatusCode)
-	fmt.Printf("- Reason: %s\n", resp.ResponseLine.ReasonPhrase)
-	for k, v := range resp.Headers.HeadersMap {
-		fmt.Printf("- %s: %s\n", k, v)
+	if _, err := io.Copy(out, body); err != nil {
+		log.Printf("error reading the body: %v", err)
+		return exitTransport
 	}
-	fmt.Printf("- Body: %s\n", string(resp.GetBody()))
+	return exitCode(resp.ResponseLine.StatusCode)
+}
 
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("httpclient: ")
+	os.Exit(run())
 }
@@ -4,121 +4,417 @@ import (
 	"fmt"
 	"httpfromtcp/internal"
 	"httpfromtcp/internal/server"
+	"io"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
-func response400() []byte {
-	return []byte(`<html>
-  <head>
-    <title>400 Bad Request</title>
-  </head>
-  <body>
-    <h1>Bad Request</h1>
-    <p>Your request honestly kinda sucked.</p>
-  </body>
-</html>`)
+// page is a response of the server rendered as HTML or JSON, error
+// pages being RFC 9457 problem details in JSON.
+type page struct {
+	code    internal.HTTPStatusCode
+	title   string
+	heading string
+	message string
 }
 
-func response500() []byte {
-	return []byte(`<html>
-  <head>
-    <title>500 Internal Server Error</title>
-  </head>
-  <body>
-    <h1>Internal Server Error</h1>
-    <p>Okay, you know what? This one is on me.</p>
-  </body>
-</html>`)
+func response400() page {
+	return page{
+		code:    internal.StatusBadRequest,
+		title:   "400 Bad Request",
+		heading: "Bad Request",
+		message: "Your request honestly kinda sucked.",
+	}
+}
+
+func response500() page {
+	return page{
+		code:    internal.StatusInternalServerError,
+		title:   "500 Internal Server Error",
+		heading: "Internal Server Error",
+		message: "Okay, you know what? This one is on me.",
+	}
+}
+
+func response200() page {
+	return page{
+		code:    internal.StatusOK,
+		title:   "200 OK",
+		heading: "Success!",
+		message: "Your request was an absolute banger.",
+	}
 }
 
-func response200() []byte {
+// pageTypes are the media types a page is rendered as, by preference.
+var pageTypes = []string{"text/html", "application/json"}
+
+// html returns the page as an HTML document.
+func (p page) html() []byte {
 	return []byte(`<html>
   <head>
-    <title>200 OK</title>
+    <title>` + p.title + `</title>
   </head>
   <body>
-    <h1>Success!</h1>
-    <p>Your request was an absolute banger.</p>
+    <h1>` + p.heading + `</h1>
+    <p>` + p.message + `</p>
   </body>
 </html>`)
 }
 
-func Handler(w *internal.ResponseWriter, r *internal.Request) {
+// newHandler returns the handler of the server, requests whose target
+// starts with proxyPrefix are passed to proxy, the ones starting with
+// staticPrefix to static and forward proxy requests are handled by
+// forward when they are set.
+func newHandler(proxy server.Handler, proxyPrefix string, static server.Handler, staticPrefix string, forward *server.ForwardProxy) server.Handler {
+	return func(w *internal.ResponseWriter, r *internal.Request) {
+
+		if forward != nil && server.IsProxyRequest(r) {
+			forward.Handle(w, r)
+			return
+		}
 
-	switch r.RequestLine.RequestTarget {
+		switch r.RequestLine.RequestTarget {
+
+		case "/yourproblem":
+			writePage(w, r, response400())
+		case "/myproblem":
+			writePage(w, r, response500())
+		case "/ws":
+			echoWebSocket(w, r)
+		case "/events":
+			streamTime(w, r)
+		default:
+			if proxy != nil && strings.HasPrefix(r.RequestLine.RequestTarget, proxyPrefix+"/") {
+				proxy(w, r)
+			} else if static != nil && (r.RequestLine.RequestTarget == staticPrefix ||
+				strings.HasPrefix(r.RequestLine.RequestTarget, staticPrefix+"/") ||
+				strings.HasPrefix(r.RequestLine.RequestTarget, staticPrefix+"?")) {
+				static(w, r)
+			} else {
+				writePage(w, r, response200())
+			}
 
-	case "/yourproblem":
-		writeResponse(w, internal.StatusBadRequest, response400())
-	case "/myproblem":
-		writeResponse(w, internal.StatusInternalServerError, response500())
-	default:
-		if strings.HasPrefix(r.RequestLine.RequestTarget, "/httpbin/") {
-			path := strings.TrimPrefix(r.RequestLine.RequestTarget, "/httpbin/")
-			proxyHandler(w, path)
-		} else {
-			writeResponse(w, internal.StatusOK, response200())
 		}
 
 	}
-
 }
 
-func writeResponse(w *internal.ResponseWriter, code internal.HTTPStatusCode, body []byte) {
-	if err := w.WriteStatusLine(code); err != nil {
-		log.Printf("error writing the status-line to the connection: %v\n", err)
+// writePage writes p in the media type r prefers. Error pages fall back
+// to HTML when neither type is acceptable, other pages are answered with
+// 406 Not Acceptable.
+func writePage(w *internal.ResponseWriter, r *internal.Request, p page) {
+	mediaType := r.Negotiate(pageTypes...)
+	if mediaType == "" {
+		if p.code < 400 {
+			server.WriteNotAcceptable(w, pageTypes...)
+			return
+		}
+		mediaType = pageTypes[0]
+	}
+	if mediaType == "application/json" {
+		server.Vary("Accept")(func(w *internal.ResponseWriter, r *internal.Request) {
+			var err error
+			if p.code >= 400 {
+				err = server.WriteProblem(w, server.NewProblem(p.code, p.message))
+			} else {
+				err = server.WriteJSON(w, p.code, map[string]string{"title": p.heading, "message": p.message})
+			}
+			if err != nil {
+				slog.Error("error writing the response to the connection", "err", err)
+			}
+		})(w, r)
+		return
+	}
+
+	body := p.html()
+	h := internal.GetDefaultHeaders(len(body))
+	h.Set("Vary", "Accept")
+
+	if err := w.WriteStatusLine(p.code); err != nil {
+		slog.Error("error writing the status-line to the connection", "err", err)
 	}
-	if err := w.WriteHeaders(internal.GetDefaultHeaders(len(body))); err != nil {
-		log.Printf("error writing the headers to the connection: %v\n", err)
+	if err := w.WriteHeaders(h); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
 	}
 	if _, err := w.Write(body); err != nil {
-		log.Printf("error writing the body to the connection: %v\n", err)
+		slog.Error("error writing the body to the connection", "err", err)
 	}
 
 }
 
-func proxyHandler(w *internal.ResponseWriter, path string) {
-
-	hdr := internal.NewHeaders()
+// echoWebSocket upgrades the connection to a WebSocket and sends back
+// every message it receives.
+func echoWebSocket(w *internal.ResponseWriter, r *internal.Request) {
+	ws, err := server.Upgrade(w, r)
+	if err != nil {
+		slog.Error("error upgrading to websocket", "err", err)
+		return
+	}
+	defer func() {
+		if err := ws.Close(server.CloseNormal, ""); err != nil {
+			slog.Error("error closing the websocket", "err", err)
+		}
+	}()
+	for {
+		typ, msg, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := ws.WriteMessage(typ, msg); err != nil {
+			slog.Error("error writing the websocket message", "err", err)
+			return
+		}
+	}
+}
 
-	res, err := http.Get("https://httpbin.org/" + path)
+// streamTime sends the time every second as server-sent events, whose
+// IDs count up from the Last-Event-ID of a reconnecting client.
+func streamTime(w *internal.ResponseWriter, r *internal.Request) {
+	s, err := server.NewSSEWriter(w, r)
 	if err != nil {
-		writeResponse(w, internal.StatusInternalServerError, response500())
-	} else {
-		if err := w.WriteStatusLine(internal.StatusOK); err != nil {
-			log.Printf("error writing the status-line to the connection: %v\n", err)
+		slog.Error("error starting the event stream", "err", err)
+		return
+	}
+	defer func() {
+		if err := s.Close(); err != nil {
+			slog.Error("error closing the event stream", "err", err)
 		}
+	}()
 
-		if err := w.WriteHeaders(internal.GetDefaultHeaders(0)); err != nil {
-			log.Printf("error writing the headers to the connection: %v\n", err)
+	id, _ := strconv.Atoi(s.LastEventID())
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.Done():
+			return
+		case t := <-ticker.C:
+			id++
+			if err := s.Send(server.Event{ID: strconv.Itoa(id), Event: "time", Data: t.Format(time.RFC3339)}); err != nil {
+				return
+			}
 		}
+	}
+}
 
-		hdr.Delete("Content-Length")
-		hdr.Set("Transfer-Encoding", "chunked")
-		hdr.Replace("Content-Type", "text/plain")
+// newProxy creates the reverse proxy configured under "proxy", or
+// returns nil if no upstream is configured.
+func newProxy() (*server.ReverseProxy, string) {
+	upstreams := viper.GetStringSlice("proxy.upstreams")
+	if upstream := viper.GetString("proxy.upstream"); upstream != "" {
+		upstreams = append(upstreams, upstream)
+	}
+	if len(upstreams) == 0 {
+		return nil, ""
+	}
+	prefix := strings.TrimSuffix(viper.GetString("proxy.prefix"), "/")
+	opts := []server.ProxyOption{server.WithStripPrefix(prefix)}
 
-		for {
-			data := make([]byte, 30)
-			n, err := res.Body.Read(data)
-			if err != nil {
-				break
-			}
-			if _, err := w.WriteChunkedBody(data[:n]); err != nil {
-				log.Printf("error writing the chunked body to the connection: %v\n", err)
-			}
+	switch strategy := viper.GetString("proxy.strategy"); strategy {
+	case "", "round-robin":
+	case "least-conn":
+		opts = append(opts, server.WithBalancer(server.LeastConnections()))
+	case "hash":
+		opts = append(opts, server.WithBalancer(server.ConsistentHash(viper.GetString("proxy.hash_header"))))
+	default:
+		log.Fatalf("invalid proxy strategy %q", strategy)
+	}
+	if path := viper.GetString("proxy.health_check.path"); path != "" {
+		viper.SetDefault("proxy.health_check.interval", "10s")
+		viper.SetDefault("proxy.health_check.timeout", "5s")
+		opts = append(opts, server.WithHealthCheck(path,
+			viper.GetDuration("proxy.health_check.interval"),
+			viper.GetDuration("proxy.health_check.timeout")))
+	}
+	if viper.IsSet("proxy.max_fails") {
+		viper.SetDefault("proxy.fail_timeout", "30s")
+		opts = append(opts, server.WithPassiveEjection(viper.GetInt("proxy.max_fails"), viper.GetDuration("proxy.fail_timeout")))
+	}
+
+	proxy, err := server.NewBalancedProxy(upstreams, opts...)
+	if err != nil {
+		log.Fatalf("invalid proxy configuration: %v", err)
+	}
+	return proxy, prefix
+}
+
+// withCache puts the cache configured under "proxy.cache" in front of h,
+// or returns h if the cache is not enabled.
+func withCache(h server.Handler) server.Handler {
+	if !viper.GetBool("proxy.cache.enabled") {
+		return h
+	}
+	var opts []server.CacheOption
+	if dir := viper.GetString("proxy.cache.dir"); dir != "" {
+		store, err := server.NewDiskStore(dir)
+		if err != nil {
+			log.Fatalf("invalid cache configuration: %v", err)
 		}
-		if _, err := w.WriteChunkedBodyDone(); err != nil {
-			log.Printf("error writing the end of chunked body to the connection: %v\n", err)
+		opts = append(opts, server.WithCacheStore(store))
+	} else if viper.IsSet("proxy.cache.max_size") {
+		opts = append(opts, server.WithCacheStore(server.NewMemoryStore(viper.GetInt64("proxy.cache.max_size"))))
+	}
+	if viper.IsSet("proxy.cache.max_entry_size") {
+		opts = append(opts, server.WithMaxEntrySize(viper.GetInt64("proxy.cache.max_entry_size")))
+	}
+	return server.NewCache(opts...).Middleware(h)
+}
+
+// newFileServer creates the file server configured under "static", or
+// returns nil if no directory is configured.
+func newFileServer() (server.Handler, string) {
+	dir := viper.GetString("static.dir")
+	if dir == "" {
+		return nil, ""
+	}
+	prefix := strings.TrimSuffix(viper.GetString("static.prefix"), "/")
+	opts := []server.FileServerOption{server.WithFileStripPrefix(prefix)}
+	if viper.IsSet("static.index") {
+		opts = append(opts, server.WithIndexFiles(viper.GetStringSlice("static.index")...))
+	}
+	if viper.GetBool("static.list") {
+		opts = append(opts, server.WithDirectoryListing())
+	}
+	fsrv, err := server.NewDirFileServer(dir, opts...)
+	if err != nil {
+		log.Fatalf("invalid static configuration: %v", err)
+	}
+	return fsrv.Handle, prefix
+}
+
+// withCompression puts the compressor configured under "compression" in
+// front of h, or returns h if compression is not enabled.
+func withCompression(h server.Handler) server.Handler {
+	if !viper.GetBool("compression.enabled") {
+		return h
+	}
+	var opts []server.CompressOption
+	if viper.IsSet("compression.level") {
+		opts = append(opts, server.WithCompressionLevel(viper.GetInt("compression.level")))
+	}
+	if viper.IsSet("compression.min_size") {
+		opts = append(opts, server.WithMinSize(viper.GetInt("compression.min_size")))
+	}
+	if types := viper.GetStringSlice("compression.types"); len(types) > 0 {
+		opts = append(opts, server.WithCompressibleTypes(types...))
+	}
+	return server.NewCompressor(opts...).Middleware(h)
+}
+
+// newForwardProxy creates the forward proxy configured under
+// "forward_proxy", or returns nil if it is not enabled.
+func newForwardProxy() *server.ForwardProxy {
+	if !viper.GetBool("forward_proxy.enabled") {
+		return nil
+	}
+	var opts []server.ForwardProxyOption
+	if hosts := viper.GetStringSlice("forward_proxy.allowed_hosts"); len(hosts) > 0 {
+		opts = append(opts, server.WithAllowedHosts(hosts...))
+	}
+	if viper.IsSet("forward_proxy.allowed_ports") {
+		opts = append(opts, server.WithAllowedPorts(viper.GetIntSlice("forward_proxy.allowed_ports")...))
+	}
+	return server.NewForwardProxy(opts...)
+}
+
+// newMetrics creates the metrics configured under "metrics", or returns
+// nil if they are not enabled. The routes are the ones of newHandler so
+// that every path does not make series of its own.
+func newMetrics() *server.Metrics {
+	if !viper.GetBool("metrics.enabled") {
+		return nil
+	}
+	proxied := viper.GetString("proxy.upstream") != "" || len(viper.GetStringSlice("proxy.upstreams")) > 0
+	proxyPrefix := strings.TrimSuffix(viper.GetString("proxy.prefix"), "/")
+	static := viper.GetString("static.dir") != ""
+	staticPrefix := strings.TrimSuffix(viper.GetString("static.prefix"), "/")
+	opts := []server.MetricsOption{server.WithRoute(func(r *internal.Request) string {
+		if server.IsProxyRequest(r) {
+			return "forward"
+		}
+		path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+		switch {
+		case path == "/yourproblem", path == "/myproblem", path == "/ws", path == "/events":
+			return path
+		case proxied && strings.HasPrefix(path, proxyPrefix+"/"):
+			return proxyPrefix + "/*"
+		case static && (path == staticPrefix || strings.HasPrefix(path, staticPrefix+"/")):
+			return staticPrefix + "/*"
 		}
+		return "/"
+	})}
+	if viper.IsSet("metrics.path") {
+		opts = append(opts, server.WithMetricsPath(viper.GetString("metrics.path")))
+	}
+	return server.NewMetrics(opts...)
+}
 
-		return
+// withRequestID gives the requests of h an ID as configured under
+// "request_id", or returns h if request IDs are not enabled.
+func withRequestID(h server.Handler) server.Handler {
+	if !viper.GetBool("request_id.enabled") {
+		return h
+	}
+	var opts []server.RequestIDOption
+	if viper.IsSet("request_id.header") {
+		opts = append(opts, server.WithRequestIDHeader(viper.GetString("request_id.header")))
 	}
+	return server.RequestID(opts...)(h)
+}
+
+// setupLogging makes the logger configured under "log" the default
+// one, which the server and the log package write to.
+func setupLogging() {
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.format", "text")
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(viper.GetString("log.level"))); err != nil {
+		log.Fatalf("invalid log level: %v", err)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch format := viper.GetString("log.format"); format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		log.Fatalf("invalid log format %q", format)
+	}
+}
+
+// withAccessLog logs the requests of h as configured under
+// "access_log", or returns h if access logging is not enabled.
+func withAccessLog(h server.Handler) server.Handler {
+	if !viper.GetBool("access_log.enabled") {
+		return h
+	}
+	viper.SetDefault("access_log.format", string(server.CombinedLogFormat))
+	var out io.Writer
+	switch output := viper.GetString("access_log.output"); output {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatalf("invalid access log output: %v", err)
+		}
+		out = f
+	}
+	logger, err := server.NewAccessLogger(out, server.AccessLogFormat(viper.GetString("access_log.format")))
+	if err != nil {
+		log.Fatalf("invalid access log configuration: %v", err)
+	}
+	return server.AccessLog(server.WithAccessLogger(logger))(h)
 }
 
 // readConfig reads the config and loads the data
@@ -135,36 +431,73 @@ func readConfig() {
 
 func main() {
 	readConfig()
+	setupLogging()
 	proto := viper.GetString("protocol")
 	addr := viper.GetString("address")
 
+	var opts []server.ServerOption
+	if viper.IsSet("write_buffer_size") {
+		opts = append(opts, server.WithWriteBufferSize(viper.GetInt("write_buffer_size")))
+	}
+	if viper.IsSet("max_body_size") {
+		opts = append(opts, server.WithMaxRequestBodySize(viper.GetInt64("max_body_size")))
+	}
+	if m := newMetrics(); m != nil {
+		opts = append(opts, server.WithMetrics(m))
+	}
 	var srv *server.Server
 	switch strings.ToLower(proto) {
 	case "udp":
-		srv = server.NewServer(server.WithUDP(), server.WithAddr(addr))
+		srv = server.NewServer(append(opts, server.WithUDP(), server.WithAddr(addr))...)
 	case "tcp":
-		srv = server.NewServer(server.WithAddr(addr))
+		srv = server.NewServer(append(opts, server.WithAddr(addr))...)
+	case "unix":
+		opts = append(opts, server.WithUnix(addr))
+		if viper.IsSet("socket_perm") {
+			perm, err := strconv.ParseUint(viper.GetString("socket_perm"), 8, 32)
+			if err != nil {
+				log.Fatalf("invalid socket_perm: %v", err)
+			}
+			opts = append(opts, server.WithSocketPerm(os.FileMode(perm)))
+		}
+		srv = server.NewServer(opts...)
 	default:
 		log.Fatal("You must provid a valid transport protocol. see --help")
 
 	}
 
-	if err := srv.Serve(Handler); err != nil {
-		log.Printf("error starting the server: %v\n", err)
+	proxy, proxyPrefix := newProxy()
+	var proxyHandler server.Handler
+	if proxy != nil {
+		defer func() {
+			if err := proxy.Close(); err != nil {
+				slog.Error("error closing the proxy", "err", err)
+			}
+		}()
+		proxyHandler = withCache(proxy.Handle)
+		if d := viper.GetDuration("proxy.timeout"); d > 0 {
+			proxyHandler = server.Timeout(d)(proxyHandler)
+		}
+	}
+
+	static, staticPrefix := newFileServer()
+	handler := withRequestID(withAccessLog(withCompression(newHandler(proxyHandler, proxyPrefix, static, staticPrefix, newForwardProxy()))))
+	if err := srv.Serve(handler); err != nil {
+		slog.Error("error starting the server", "err", err)
 	}
 
 	defer func() {
 		if err := srv.Close(); err != nil {
-			log.Printf("error closing the server: %v\n", err)
+			slog.Error("error closing the server", "err", err)
 		}
 	}()
 
-	log.Println("server started on", srv.Address())
+	slog.Info("server started", "addr", srv.Address())
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 	// server.Done()
-	log.Println("server gracefully stopped")
+	slog.Info("server gracefully stopped")
 
 }
@@ -44,8 +44,10 @@ func main() {
 		fmt.Printf("- Target: %s\n", r.RequestLine.RequestTarget)
 		fmt.Printf("- Version: %s\n", r.RequestLine.HttpVersion)
 		fmt.Printf("Headers:\n")
-		for key, val := range r.Headers.HeadersMap {
-			fmt.Println("-", key, ":", val)
+		for key := range r.Headers.HeadersMap {
+			for _, val := range r.Headers.Values(key) {
+				fmt.Println("-", key, ":", val)
+			}
 		}
 		fmt.Printf("- Body: %s\n", string(r.Body))
 		fmt.Println("Connection to ", conn.RemoteAddr(), "closed")
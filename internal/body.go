@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxLineSize is the maximum size of a single start-line, field-line
+// or chunk-size line read by [readLine].
+const maxLineSize int = 1 << 16
+
+// readLine reads a single line terminated by CRLF from br and returns it
+// including the CRLF, error if any.
+func readLine(br *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		frag, err := br.ReadSlice('\n')
+		line = append(line, frag...)
+		if len(line) > maxLineSize {
+			return "", errors.New("line exceeds the maximum line size")
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+	if !bytes.HasSuffix(line, []byte(CRLFDELIMETER)) {
+		return "", errors.New("line is not terminated by CRLF")
+	}
+	return string(line), nil
+}
+
+// readHeaders reads field lines from br into h until the empty line
+// terminating the header section, returns error if any.
+func readHeaders(br *bufio.Reader, h HTTPHeaders) error {
+	for {
+		line, err := readLine(br)
+		if err != nil {
+			return err
+		}
+		_, done, err := h.Parse([]byte(line))
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// parseContentLength returns the value of the [Content-Length] header,
+// bool indicating whether the header is present and error if any.
+//
+// Repeated Content-Length headers folded into a list are accepted as long
+// as every member has the same value, see [RFC 9110 Section 8.6].
+//
+// [RFC 9110 Section 8.6]: https://www.rfc-editor.org/rfc/rfc9110#name-content-length
+func parseContentLength(h HTTPHeaders) (int64, bool, error) {
+	v := h.Get("Content-Length")
+	if v == "" {
+		return 0, false, nil
+	}
+	var cl int64 = -1
+	for _, part := range strings.Split(v, ",") {
+		n, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || n < 0 {
+			return 0, false, errors.New("invalid content-length received")
+		}
+		if cl != -1 && cl != n {
+			return 0, false, errors.New("conflicting content-length received")
+		}
+		cl = n
+	}
+	return cl, true, nil
+}
+
+// isChunked reports whether chunked is the final transfer coding
+// in the [Transfer-Encoding] header.
+func isChunked(h HTTPHeaders) bool {
+	te := h.Get("Transfer-Encoding")
+	if te == "" {
+		return false
+	}
+	codings := strings.Split(te, ",")
+	return strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked")
+}
+
+// limitedBodyReader reads a body of a known length, reporting
+// [io.ErrUnexpectedEOF] if the connection ends before it is complete.
+type limitedBodyReader struct {
+	r io.Reader
+	n int64
+}
+
+func newLimitedBodyReader(r io.Reader, n int64) io.Reader {
+	return &limitedBodyReader{r: r, n: n}
+}
+
+func (lr *limitedBodyReader) Read(p []byte) (int, error) {
+	if lr.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > lr.n {
+		p = p[:lr.n]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if err == io.EOF && lr.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// chunkedReader decodes the chunked transfer coding.
+type chunkedReader struct {
+	br      *bufio.Reader
+	n       int64 // bytes left in the current chunk
+	started bool  // at least one chunk-size line has been read
+	err     error
+}
+
+// NewChunkedReader returns an [io.Reader] that decodes a message body
+// sent with the chunked transfer coding according to [RFC 9112 Section 7.1].
+// The reader returns [io.EOF] after the last chunk and the trailer section
+// have been consumed, leaving br positioned at the next message.
+//
+//	chunked-body   = *chunk
+//	                 last-chunk
+//	                 trailer-section
+//	                 CRLF
+//	chunk          = chunk-size [ chunk-ext ] CRLF
+//	                 chunk-data CRLF
+//	last-chunk     = 1*("0") [ chunk-ext ] CRLF
+//
+// [RFC 9112 Section 7.1]: https://datatracker.ietf.org/doc/html/rfc9112#name-chunked-transfer-coding
+func NewChunkedReader(br *bufio.Reader) io.Reader {
+	return &chunkedReader{br: br}
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.n == 0 {
+		if cr.started {
+			if cr.err = cr.readCRLF(); cr.err != nil {
+				return 0, cr.err
+			}
+		}
+		cr.started = true
+		cr.n, cr.err = cr.readChunkSize()
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.n == 0 {
+			// last-chunk, the trailer fields are read and discarded.
+			if cr.err = readHeaders(cr.br, NewHeaders()); cr.err == nil {
+				cr.err = io.EOF
+			}
+			return 0, cr.err
+		}
+	}
+	if int64(len(p)) > cr.n {
+		p = p[:cr.n]
+	}
+	n, err := cr.br.Read(p)
+	cr.n -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	cr.err = err
+	return n, err
+}
+
+// readChunkSize reads a chunk-size line, ignoring any chunk extensions.
+func (cr *chunkedReader) readChunkSize() (int64, error) {
+	line, err := readLine(cr.br)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	size, _, _ := strings.Cut(strings.TrimSuffix(line, CRLFDELIMETER), ";")
+	n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid chunk size received")
+	}
+	return n, nil
+}
+
+// readCRLF consumes the CRLF terminating the chunk-data.
+func (cr *chunkedReader) readCRLF() error {
+	buf := make([]byte, len(CRLFDELIMETER))
+	if _, err := io.ReadFull(cr.br, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if string(buf) != CRLFDELIMETER {
+		return errors.New("chunk data is not terminated by CRLF")
+	}
+	return nil
+}
+
+// chunkedWriter encodes the chunked transfer coding.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+// NewChunkedWriter returns an [io.WriteCloser] that writes every call to
+// Write as a single chunk to w. Close writes the last-chunk and the empty
+// trailer section without closing w.
+//
+// see also [NewChunkedReader]
+func NewChunkedWriter(w io.Writer) io.WriteCloser {
+	return &chunkedWriter{w: w}
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	// an empty chunk would be read as the last-chunk.
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(cw.w, CRLFDELIMETER)
+	return n, err
+}
+
+func (cw *chunkedWriter) Close() error {
+	_, err := io.WriteString(cw.w, "0\r\n\r\n")
+	return err
+}
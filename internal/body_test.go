@@ -0,0 +1,250 @@
+package internal
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkedReader(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+		rest     string
+	}{
+		{
+			name:     "single chunk",
+			input:    "7\r\nWelcome\r\n0\r\n\r\n",
+			expected: "Welcome",
+		},
+		{
+			name:     "multiple chunks with extension",
+			input:    "7;ext=1\r\nWelcome\r\n1c\r\n to Mozilla Developer Networ\r\n1\r\nk\r\n0\r\n\r\n",
+			expected: "Welcome to Mozilla Developer Network",
+		},
+		{
+			name:     "trailer section",
+			input:    "5\r\nhello\r\n0\r\nExpires: never\r\n\r\n",
+			expected: "hello",
+		},
+		{
+			name:     "next message is left unread",
+			input:    "5\r\nhello\r\n0\r\n\r\nHTTP/1.1 200 OK\r\n",
+			expected: "hello",
+			rest:     "HTTP/1.1 200 OK\r\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReader(&chunkReader{data: tc.input, numBytesPerRead: 3})
+			got, err := io.ReadAll(NewChunkedReader(br))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, string(got))
+			rest, err := io.ReadAll(br)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.rest, string(rest))
+		})
+	}
+}
+
+func TestChunkedReaderReturnsError(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+	}{
+		{name: "invalid chunk size", input: "zz\r\nhello\r\n0\r\n\r\n"},
+		{name: "missing CRLF after data", input: "5\r\nhelloX\r\n0\r\n\r\n"},
+		{name: "truncated chunk", input: "a\r\nhello"},
+		{name: "missing last chunk", input: "5\r\nhello\r\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReader(strings.NewReader(tc.input))
+			_, err := io.ReadAll(NewChunkedReader(br))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReadResponse(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		method   string
+		status   HTTPStatusCode
+		expected string
+	}{
+		{
+			name:     "content-length body",
+			input:    "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhelloHTTP/1.1",
+			method:   "GET",
+			status:   StatusOK,
+			expected: "hello",
+		},
+		{
+			name:     "chunked body",
+			input:    "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+			method:   "GET",
+			status:   StatusOK,
+			expected: "hello world",
+		},
+		{
+			name:     "body delimited by close",
+			input:    "HTTP/1.1 500 Internal Server Error\r\nConnection: close\r\n\r\nuntil the end",
+			method:   "GET",
+			status:   StatusInternalServerError,
+			expected: "until the end",
+		},
+		{
+			name:     "response to HEAD has no body",
+			input:    "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\n",
+			method:   "HEAD",
+			status:   StatusOK,
+			expected: "",
+		},
+		{
+			name:     "repeated equal content-length",
+			input:    "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+			method:   "GET",
+			status:   StatusOK,
+			expected: "hello",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			br := bufio.NewReader(&chunkReader{data: tc.input, numBytesPerRead: 4})
+			resp, err := ReadResponse(br, tc.method)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, resp.ResponseLine.StatusCode)
+			assert.Equal(t, tc.expected, string(resp.Body))
+		})
+	}
+}
+
+func TestReadResponseReturnsError(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+	}{
+		{name: "short body", input: "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\nhello"},
+		{name: "invalid content-length", input: "HTTP/1.1 200 OK\r\nContent-Length: ten\r\n\r\nhello"},
+		{name: "conflicting content-length", input: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello"},
+		{name: "incomplete head", input: "HTTP/1.1 200 OK\r\nHost: localhost"},
+		{name: "bare LF", input: "HTTP/1.1 200 OK\nContent-Length: 0\n\n"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := ReadResponse(bufio.NewReader(strings.NewReader(tc.input)), "GET")
+			assert.Error(t, err)
+			assert.Nil(t, resp)
+		})
+	}
+}
+
+func TestReadRequest(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		target   string
+		expected string
+	}{
+		{
+			name:     "content-length body",
+			input:    "POST /coffee HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello",
+			target:   "/coffee",
+			expected: "hello",
+		},
+		{
+			name:     "chunked body",
+			input:    "POST /tea HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			target:   "/tea",
+			expected: "hello",
+		},
+		{
+			name:     "no body",
+			input:    "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+			target:   "/",
+			expected: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// a second request on the same connection must stay unread.
+			next := "GET /next HTTP/1.1\r\nHost: localhost\r\n\r\n"
+			br := bufio.NewReader(&chunkReader{data: tc.input + next, numBytesPerRead: 5})
+			r, err := ReadRequest(br)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.target, r.RequestLine.RequestTarget)
+			assert.Equal(t, tc.expected, string(r.Body))
+			assert.Equal(t, len(tc.expected), r.ContentLength)
+
+			r, err = ReadRequest(br)
+			assert.NoError(t, err)
+			assert.Equal(t, "/next", r.RequestLine.RequestTarget)
+		})
+	}
+}
+
+func TestReadRequestLimit(t *testing.T) {
+	testCases := []struct {
+		name    string
+		input   string
+		wantErr error
+	}{
+		{
+			name:  "content-length at the limit",
+			input: "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		},
+		{
+			name:  "chunked at the limit",
+			input: "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n2\r\nhe\r\n3\r\nllo\r\n0\r\n\r\n",
+		},
+		{
+			// the body is not sent, the request is rejected on its head.
+			name:    "content-length over the limit",
+			input:   "POST / HTTP/1.1\r\nContent-Length: 10000000000\r\n\r\n",
+			wantErr: ErrBodyTooLarge,
+		},
+		{
+			name:    "chunked over the limit",
+			input:   "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n1\r\n!\r\n0\r\n\r\n",
+			wantErr: ErrBodyTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := ReadRequestLimit(bufio.NewReader(strings.NewReader(tc.input)), 5)
+			if tc.wantErr != nil {
+				assert.ErrorIs(t, err, tc.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "hello", string(r.Body))
+		})
+	}
+}
+
+func TestChunkedWriter(t *testing.T) {
+	var buf strings.Builder
+	cw := NewChunkedWriter(&buf)
+	for _, chunk := range []string{"Welcome\n", "", "to Mozilla Developer Network"} {
+		_, err := cw.Write([]byte(chunk))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, cw.Close())
+	assert.Equal(t, "8\r\nWelcome\n\r\n1c\r\nto Mozilla Developer Network\r\n0\r\n\r\n", buf.String())
+
+	got, err := io.ReadAll(NewChunkedReader(bufio.NewReader(strings.NewReader(buf.String()))))
+	assert.NoError(t, err)
+	assert.Equal(t, "Welcome\nto Mozilla Developer Network", string(got))
+}
@@ -0,0 +1,625 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ClientOptions struct {
+	network             string
+	addr                string
+	tlsConfig           *tls.Config
+	timeout             time.Duration
+	dialTimeout         time.Duration
+	disableKeepAlives   bool
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	maxConnsPerHost     int
+	idleConnTimeout     time.Duration
+	maxRedirects        int
+	jar                 *Jar
+	wireTap             io.Writer
+}
+
+// Client sends [internal.Request] values and reads the
+// [internal.Response] using the internal parser.
+//
+// Connections are kept alive and reused for later requests to the same
+// host. A Client is safe for concurrent use.
+type Client struct {
+	opts   *ClientOptions
+	dialer *net.Dialer
+	pool   *pool
+}
+
+func DefaultClientOptions() *ClientOptions {
+	return &ClientOptions{
+		timeout:             30 * time.Second,
+		dialTimeout:         10 * time.Second,
+		maxIdleConns:        100,
+		maxIdleConnsPerHost: 8,
+		idleConnTimeout:     90 * time.Second,
+	}
+}
+
+type ClientOption func(*ClientOptions)
+
+// WithTimeout limits the time of a whole exchange, including reading
+// the response body. A zero duration disables the limit.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.timeout = d
+	}
+}
+
+// WithDialTimeout limits the time spent establishing a connection.
+func WithDialTimeout(d time.Duration) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.dialTimeout = d
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for https targets.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.tlsConfig = cfg
+	}
+}
+
+// WithNetwork dials addr over network for every request instead of
+// the address derived from the request, e.g. ("udp", ":42069").
+func WithNetwork(network, addr string) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.network = network
+		opts.addr = addr
+	}
+}
+
+// WithUnixSocket dials the unix domain socket at path for every request.
+func WithUnixSocket(path string) ClientOption {
+	return WithNetwork("unix", path)
+}
+
+// WithDisableKeepAlives sends every request on a new connection
+// and closes it afterwards.
+func WithDisableKeepAlives() ClientOption {
+	return func(opts *ClientOptions) {
+		opts.disableKeepAlives = true
+	}
+}
+
+// WithMaxIdleConns limits the idle connections kept across all hosts.
+// Zero means no limit.
+func WithMaxIdleConns(n int) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.maxIdleConns = n
+	}
+}
+
+// WithMaxIdleConnsPerHost limits the idle connections kept per host.
+func WithMaxIdleConnsPerHost(n int) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.maxIdleConnsPerHost = n
+	}
+}
+
+// WithMaxConnsPerHost limits the open connections per host, idle ones
+// included. Requests beyond the limit wait for a connection to become
+// available. Zero means no limit.
+func WithMaxConnsPerHost(n int) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.maxConnsPerHost = n
+	}
+}
+
+// WithIdleConnTimeout closes connections that stayed idle for longer than d.
+// Zero means no limit.
+func WithIdleConnTimeout(d time.Duration) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.idleConnTimeout = d
+	}
+}
+
+// WithFollowRedirects follows up to max redirects, see [Client.Stream].
+// Zero, the default, returns redirect responses to the caller.
+func WithFollowRedirects(max int) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.maxRedirects = max
+	}
+}
+
+// WithCookieJar stores cookies received in responses in jar and sends
+// the matching cookies with every request.
+func WithCookieJar(jar *Jar) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.jar = jar
+	}
+}
+
+// WithWireTap copies every byte written to and read from a connection
+// to w, after TLS decryption, e.g. to dump the raw exchange.
+func WithWireTap(w io.Writer) ClientOption {
+	return func(opts *ClientOptions) {
+		opts.wireTap = &lockedWriter{w: w}
+	}
+}
+
+// NewClient creates a new Client with options provided.
+// If no options are provided the address is derived from each request,
+// with a 30s timeout per exchange and up to 8 idle connections per host.
+func NewClient(opts ...ClientOption) *Client {
+	o := DefaultClientOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return &Client{
+		opts:   o,
+		dialer: &net.Dialer{Timeout: o.dialTimeout},
+		pool:   newPool(o),
+	}
+}
+
+// CloseIdleConnections closes the connections kept for reuse.
+func (c *Client) CloseIdleConnections() {
+	c.pool.closeIdle()
+}
+
+// Do sends the request and returns the response with its body
+// fully read, error if any.
+//
+// The request-target of r is either in absolute-form, e.g.
+// "https://httpbin.org/get", or in origin-form with a Host header.
+func (c *Client) Do(r *internal.Request) (*internal.Response, error) {
+	return c.DoContext(context.Background(), r)
+}
+
+// DoContext is like [Client.Do], the exchange is aborted once ctx is done.
+func (c *Client) DoContext(ctx context.Context, r *internal.Request) (*internal.Response, error) {
+	resp, body, err := c.Stream(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = b
+	if method(r) != "HEAD" {
+		resp.ContentLength = len(b)
+	}
+	return resp, nil
+}
+
+// ErrTooManyRedirects is returned once more redirects than allowed by
+// [WithFollowRedirects] were received.
+var ErrTooManyRedirects = errors.New("stopped after too many redirects")
+
+// Stream sends the request and returns the response head together with
+// a reader for its body, error if any. The caller must close the body,
+// which returns the connection for reuse once the body was read to the end.
+//
+// An idempotent request that fails on a reused connection before any
+// response byte arrived, typically because the server closed the idle
+// connection, is retried once on a new connection.
+//
+// With [WithFollowRedirects] the Location of 301, 302, 303, 307 and 308
+// responses is requested next, see [redirectRequest].
+func (c *Client) Stream(ctx context.Context, r *internal.Request) (*internal.Response, io.ReadCloser, error) {
+	cancel := context.CancelFunc(func() {})
+	if c.opts.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.opts.timeout)
+	}
+	fail := func(err error) (*internal.Response, io.ReadCloser, error) {
+		err = ctxErr(ctx, err)
+		cancel()
+		return nil, nil, err
+	}
+
+	for redirects := 0; ; redirects++ {
+		t, err := c.resolveTarget(r)
+		if err != nil {
+			return fail(err)
+		}
+		u, err := t.url()
+		if err != nil {
+			return fail(err)
+		}
+		// the cookies of the jar are added for every hop, r only keeps
+		// the ones set by the caller.
+		out := r
+		if c.opts.jar != nil {
+			if cookies := c.opts.jar.CookieHeader(u); cookies != "" {
+				out = withCookies(r, cookies)
+			}
+		}
+
+		resp, body, err := c.send(ctx, out, t)
+		if err != nil {
+			return fail(err)
+		}
+		if c.opts.jar != nil {
+			if sc := resp.Headers.Values("Set-Cookie"); len(sc) > 0 {
+				c.opts.jar.SetCookies(u, sc)
+			}
+		}
+
+		if c.opts.maxRedirects <= 0 || !resp.ResponseLine.StatusCode.IsRedirect() || resp.GetHeader("Location") == "" {
+			return resp, &cancelOnClose{ReadCloser: body, cancel: cancel}, nil
+		}
+		// drain a short body so the connection can be reused.
+		_, _ = io.Copy(io.Discard, io.LimitReader(body, 1<<16))
+		_ = body.Close()
+		if redirects == c.opts.maxRedirects {
+			return fail(ErrTooManyRedirects)
+		}
+		if r, err = redirectRequest(r, resp, u); err != nil {
+			return fail(err)
+		}
+	}
+}
+
+// send writes r to t and reads the response head, retrying once on a
+// stale connection.
+func (c *Client) send(ctx context.Context, r *internal.Request, t *target) (*internal.Response, io.ReadCloser, error) {
+	for retried := false; ; retried = true {
+		pc, err := c.getConn(ctx, t)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, body, err := c.roundTrip(ctx, pc, r, t)
+		if err == nil {
+			return resp, body, nil
+		}
+		if !retried && pc.reused && pc.nread == 0 && isIdempotent(method(r)) && ctx.Err() == nil {
+			continue
+		}
+		return nil, nil, err
+	}
+}
+
+// getConn returns an idle connection to t that is still alive,
+// or dials a new one.
+func (c *Client) getConn(ctx context.Context, t *target) (*persistConn, error) {
+	key := c.connKey(t)
+	for {
+		pc, ok, wait := c.pool.take(key)
+		switch {
+		case pc != nil:
+			if pc.isAlive() {
+				return pc, nil
+			}
+			c.pool.discard(pc)
+		case ok:
+			conn, err := c.dial(ctx, t)
+			if err != nil {
+				c.pool.release(key)
+				return nil, err
+			}
+			return newPersistConn(conn, key), nil
+		default:
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+}
+
+func (c *Client) connKey(t *target) connKey {
+	if c.opts.network != "" {
+		return connKey{network: c.opts.network, addr: c.opts.addr, tls: t.scheme == "https"}
+	}
+	return connKey{network: "tcp", addr: t.addr, tls: t.scheme == "https"}
+}
+
+// roundTrip writes r on pc and reads the response head. On success the
+// returned body puts pc back into the pool or discards it when closed.
+func (c *Client) roundTrip(ctx context.Context, pc *persistConn, r *internal.Request, t *target) (*internal.Response, io.ReadCloser, error) {
+	// unblock any pending read or write once ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = pc.conn.SetDeadline(time.Unix(1, 0))
+	})
+	pc.nread = 0
+
+	fail := func(err error) (*internal.Response, io.ReadCloser, error) {
+		stop()
+		c.pool.discard(pc)
+		return nil, nil, err
+	}
+
+	if err := writeRequest(pc.conn, r, t, c.keepAlive()); err != nil {
+		return fail(err)
+	}
+	resp, err := readResponseHead(pc.br)
+	if err != nil {
+		return fail(err)
+	}
+	m := method(r)
+	body, err := internal.ResponseBodyReader(pc.br, resp, m)
+	if err != nil {
+		return fail(err)
+	}
+
+	reusable := c.keepAlive() && c.opts.network != "udp" &&
+		!resp.IsCloseDelimited(m) &&
+		resp.ResponseLine.StatusCode != 101 &&
+		!hasToken(resp.GetHeader("Connection"), "close") &&
+		!hasToken(r.GetHeader("Connection"), "close")
+
+	return resp, &bodyReader{
+		ctx: ctx,
+		r:   body,
+		close: func(eof bool) {
+			// stop reports false once the deadline was set by ctx.
+			stopped := stop()
+			if eof && reusable && stopped {
+				c.pool.put(pc)
+				return
+			}
+			c.pool.discard(pc)
+		},
+	}, nil
+}
+
+func (c *Client) keepAlive() bool {
+	return !c.opts.disableKeepAlives
+}
+
+// isIdempotent reports whether a request with the given method
+// can safely be sent again, see [RFC 9110 Section 9.2.2].
+//
+// [RFC 9110 Section 9.2.2]: https://www.rfc-editor.org/rfc/rfc9110#name-idempotent-methods
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// hasToken reports whether the comma separated list v contains token,
+// compared case-insensitively.
+func hasToken(v, token string) bool {
+	for _, part := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// readResponseHead reads the next final response head, skipping
+// interim 1xx responses such as 100 Continue.
+func readResponseHead(br *bufio.Reader) (*internal.Response, error) {
+	for {
+		resp, err := internal.ReadResponseHead(br)
+		if err != nil {
+			return nil, err
+		}
+		sc := resp.ResponseLine.StatusCode
+		if sc < 100 || sc >= 200 || sc == 101 {
+			return resp, nil
+		}
+	}
+}
+
+// target describes where a request is sent and how it appears on the wire.
+type target struct {
+	scheme string // http or https
+	host   string // value of the Host header
+	addr   string // host:port to dial
+	uri    string // request-target written in the request-line
+}
+
+// url returns the absolute URL of the request sent to t.
+func (t *target) url() (*url.URL, error) {
+	return url.Parse(t.scheme + "://" + t.host + t.uri)
+}
+
+// resolveTarget derives the [target] of r from its request-target
+// and Host header.
+func (c *Client) resolveTarget(r *internal.Request) (*target, error) {
+	rt := r.RequestLine.RequestTarget
+	if strings.Contains(rt, "://") {
+		u, err := url.Parse(rt)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+		}
+		if u.Host == "" {
+			return nil, errors.New("missing host in request-target")
+		}
+		return &target{
+			scheme: u.Scheme,
+			host:   u.Host,
+			addr:   hostPort(u.Host, u.Scheme),
+			uri:    u.RequestURI(),
+		}, nil
+	}
+
+	if rt == "" {
+		rt = "/"
+	}
+	host := r.GetHeader("Host")
+	if host == "" {
+		if c.opts.network == "" {
+			return nil, errors.New("missing Host header for origin-form request-target")
+		}
+		host = "localhost"
+	}
+	scheme := "http"
+	if c.opts.tlsConfig != nil {
+		scheme = "https"
+	}
+	return &target{
+		scheme: scheme,
+		host:   host,
+		addr:   hostPort(host, scheme),
+		uri:    rt,
+	}, nil
+}
+
+// hostPort adds the default port of scheme to host if it has none.
+func hostPort(host, scheme string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if scheme == "https" {
+		return net.JoinHostPort(strings.Trim(host, "[]"), "443")
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), "80")
+}
+
+func (c *Client) dial(ctx context.Context, t *target) (net.Conn, error) {
+	conn, err := c.dialTLS(ctx, t)
+	if err != nil || c.opts.wireTap == nil {
+		return conn, err
+	}
+	return &tapConn{Conn: conn, tap: c.opts.wireTap}, nil
+}
+
+func (c *Client) dialTLS(ctx context.Context, t *target) (net.Conn, error) {
+	network, addr := "tcp", t.addr
+	if c.opts.network != "" {
+		network, addr = c.opts.network, c.opts.addr
+	}
+	conn, err := c.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.scheme != "https" {
+		return conn, nil
+	}
+
+	cfg := &tls.Config{}
+	if c.opts.tlsConfig != nil {
+		cfg = c.opts.tlsConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(t.addr)
+		if err != nil {
+			host = t.addr
+		}
+		cfg.ServerName = host
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// writeRequest writes r to w in the HTTP/1.1 wire format, returns error if any.
+//
+// The Host header and the request-target are taken from t, and the
+// Content-Length is always computed from the body. Unless keepAlive is
+// set the request asks the server to close the connection.
+func writeRequest(w io.Writer, r *internal.Request, t *target, keepAlive bool) error {
+	bw := bufio.NewWriter(w)
+	m := method(r)
+	fmt.Fprintf(bw, "%s %s HTTP/%s%s", m, t.uri, internal.HTTP_VERSION, internal.CRLFDELIMETER)
+	fmt.Fprintf(bw, "Host: %s%s", t.host, internal.CRLFDELIMETER)
+
+	keys := make([]string, 0, len(r.Headers.HeadersMap))
+	for k := range r.Headers.HeadersMap {
+		switch k {
+		case "Host", "Content-Length", "Transfer-Encoding":
+			continue
+		case "Connection":
+			if !keepAlive {
+				continue
+			}
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range r.Headers.Values(k) {
+			fmt.Fprintf(bw, "%s: %s%s", k, v, internal.CRLFDELIMETER)
+		}
+	}
+	if len(r.Body) != 0 || m == "POST" || m == "PUT" || m == "PATCH" {
+		fmt.Fprintf(bw, "Content-Length: %d%s", len(r.Body), internal.CRLFDELIMETER)
+	}
+	if !keepAlive {
+		fmt.Fprintf(bw, "Connection: close%s", internal.CRLFDELIMETER)
+	}
+	bw.WriteString(internal.CRLFDELIMETER)
+	bw.Write(r.Body)
+	return bw.Flush()
+}
+
+func method(r *internal.Request) string {
+	if r.RequestLine.Method == "" {
+		return "GET"
+	}
+	return r.RequestLine.Method
+}
+
+// ctxErr prefers the error of a done ctx over the network error it caused.
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// bodyReader is the response body returned by [Client.Stream],
+// closing it releases the connection.
+type bodyReader struct {
+	ctx    context.Context
+	r      io.Reader
+	close  func(eof bool)
+	eof    bool
+	closed bool
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.closed {
+		return 0, errors.New("read on closed response body")
+	}
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	} else if err != nil {
+		err = ctxErr(b.ctx, err)
+	}
+	return n, err
+}
+
+func (b *bodyReader) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.close(b.eof)
+	}
+	return nil
+}
+
+// cancelOnClose releases the context of an exchange once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
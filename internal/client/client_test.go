@@ -0,0 +1,202 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer accepts a single connection on ln, hands the received request
+// to check and replies with the raw response.
+func fakeServer(t *testing.T, ln net.Listener, response string, check func(r *internal.Request)) {
+	t.Helper()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		msg, err := internal.MessageFromReader(io.LimitReader(conn, 1<<16))
+		if err == nil && check != nil {
+			if r, ok := msg.(*internal.Request); ok {
+				check(r)
+			}
+		}
+		_, _ = conn.Write([]byte(response))
+	}()
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	return ln
+}
+
+func TestClientDo(t *testing.T) {
+	testCases := []struct {
+		name     string
+		response string
+		status   internal.HTTPStatusCode
+		expected string
+	}{
+		{
+			name:     "content-length body",
+			response: "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello",
+			status:   internal.StatusOK,
+			expected: "hello",
+		},
+		{
+			name:     "chunked body",
+			response: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+			status:   internal.StatusOK,
+			expected: "hello world",
+		},
+		{
+			name:     "interim response is skipped",
+			response: "HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 400 Bad Request\r\nContent-Length: 3\r\n\r\nbad",
+			status:   internal.StatusBadRequest,
+			expected: "bad",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ln := listen(t)
+			fakeServer(t, ln, tc.response, nil)
+
+			c := NewClient()
+			resp, err := c.Do(internal.NewRequest("GET", "http://"+ln.Addr().String()+"/"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.status, resp.ResponseLine.StatusCode)
+			assert.Equal(t, tc.expected, string(resp.Body))
+			assert.Equal(t, len(tc.expected), resp.ContentLength)
+		})
+	}
+}
+
+func TestClientWritesRequest(t *testing.T) {
+	ln := listen(t)
+	got := make(chan *internal.Request, 1)
+	fakeServer(t, ln, "HTTP/1.1 204 No Content\r\n\r\n", func(r *internal.Request) {
+		got <- r
+	})
+
+	r := internal.NewRequest("POST", "http://"+ln.Addr().String()+"/coffee?size=large")
+	// SetBody declares one byte more than the body, the client must not.
+	r.SetBody([]byte("espresso"), "text/plain")
+	r.Headers.Set("X-Auth-Token", "secret")
+
+	resp, err := NewClient().Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, internal.HTTPStatusCode(204), resp.ResponseLine.StatusCode)
+
+	req := <-got
+	assert.Equal(t, "POST", req.RequestLine.Method)
+	assert.Equal(t, "/coffee?size=large", req.RequestLine.RequestTarget)
+	assert.Equal(t, ln.Addr().String(), req.GetHeader("Host"))
+	assert.Equal(t, "8", req.GetHeader("Content-Length"))
+	assert.Equal(t, "text/plain", req.GetHeader("Content-Type"))
+	assert.Equal(t, "secret", req.GetHeader("X-Auth-Token"))
+	assert.Equal(t, []byte("espresso"), req.Body)
+}
+
+func TestWriteRequestFieldLines(t *testing.T) {
+	r := internal.NewRequest("GET", "/")
+	r.Headers.Add("Set-Cookie", "a=1")
+	r.Headers.Add("Set-Cookie", "b=2")
+
+	var b strings.Builder
+	assert.NoError(t, writeRequest(&b, r, &target{host: "localhost", uri: "/"}, true))
+	assert.Contains(t, b.String(), "Set-Cookie: a=1\r\nSet-Cookie: b=2\r\n")
+	assert.NotContains(t, b.String(), "a=1\nb=2")
+}
+
+func TestClientUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	ln, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	fakeServer(t, ln, "HTTP/1.1 200 OK\r\nContent-Length: 4\r\n\r\nunix", nil)
+
+	resp, err := NewClient(WithUnixSocket(path)).Do(internal.NewRequest("GET", "/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "unix", string(resp.Body))
+}
+
+func TestClientTimeout(t *testing.T) {
+	ln := listen(t)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// never answer.
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	c := NewClient(WithTimeout(50 * time.Millisecond))
+	_, err := c.Do(internal.NewRequest("GET", "http://"+ln.Addr().String()+"/"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewClient().DoContext(ctx, internal.NewRequest("GET", "http://"+ln.Addr().String()+"/"))
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestClientStream(t *testing.T) {
+	ln := listen(t)
+	fakeServer(t, ln, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Type: text/plain\r\n\r\n3\r\none\r\n3\r\ntwo\r\n0\r\n\r\n", nil)
+
+	resp, body, err := NewClient().Stream(context.Background(), internal.NewRequest("GET", "http://"+ln.Addr().String()+"/"))
+	assert.NoError(t, err)
+	defer body.Close()
+	assert.Equal(t, "text/plain", resp.GetHeader("Content-Type"))
+
+	br := bufio.NewReader(body)
+	b, err := io.ReadAll(br)
+	assert.NoError(t, err)
+	assert.Equal(t, "onetwo", string(b))
+}
+
+func TestResolveTargetReturnsError(t *testing.T) {
+	testCases := []struct {
+		name   string
+		target string
+	}{
+		{name: "unsupported scheme", target: "ftp://localhost/"},
+		{name: "missing host", target: "http:///path"},
+		{name: "origin-form without Host", target: "/path"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewClient().Do(internal.NewRequest("GET", tc.target))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestClientWireTap(t *testing.T) {
+	ln := listen(t)
+	response := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	fakeServer(t, ln, response, nil)
+
+	var wire strings.Builder
+	r := internal.NewRequest("GET", "http://"+ln.Addr().String()+"/tap")
+	_, err := NewClient(WithWireTap(&wire)).Do(r)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(wire.String(), "GET /tap HTTP/1.1\r\nHost: "+ln.Addr().String()+"\r\n"))
+	assert.True(t, strings.HasSuffix(wire.String(), "\r\n\r\n"+response))
+}
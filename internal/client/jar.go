@@ -0,0 +1,194 @@
+package client
+
+import (
+	"httpfromtcp/internal"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Jar is an in-memory cookie jar following the storage model of
+// [RFC 6265 Section 5.3] and the retrieval rules of [RFC 6265 Section 5.4].
+//
+// [RFC 6265 Section 5.3]: https://datatracker.ietf.org/doc/html/rfc6265#section-5.3
+// [RFC 6265 Section 5.4]: https://datatracker.ietf.org/doc/html/rfc6265#section-5.4
+type Jar struct {
+	mu      sync.Mutex
+	entries map[string]*jarEntry // keyed by domain;path;name
+	now     func() time.Time
+	seq     uint64 // last assigned creation order
+}
+
+type jarEntry struct {
+	name     string
+	value    string
+	domain   string
+	path     string
+	hostOnly bool
+	secure   bool
+	expires  time.Time // zero for session cookies
+	seq      uint64    // creation order
+}
+
+func NewJar() *Jar {
+	return &Jar{
+		entries: make(map[string]*jarEntry),
+		now:     time.Now,
+	}
+}
+
+// SetCookies stores the cookies of the Set-Cookie header values
+// received in a response from u.
+func (j *Jar) SetCookies(u *url.URL, setCookies []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := j.now()
+	host := canonicalHost(u.Host)
+	for _, line := range setCookies {
+		e, ok := j.parse(line, u, host, now)
+		if !ok {
+			continue
+		}
+		key := e.domain + ";" + e.path + ";" + e.name
+		old, exists := j.entries[key]
+		if !e.expires.IsZero() && !e.expires.After(now) {
+			delete(j.entries, key)
+			continue
+		}
+		if exists {
+			e.seq = old.seq
+		}
+		j.entries[key] = e
+	}
+}
+
+// CookieHeader returns the value of the Cookie header to send with a
+// request to u, or an empty string if no cookie matches.
+func (j *Jar) CookieHeader(u *url.URL) string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := j.now()
+	host := canonicalHost(u.Host)
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+	var matched []*jarEntry
+	for key, e := range j.entries {
+		if !e.expires.IsZero() && !e.expires.After(now) {
+			delete(j.entries, key)
+			continue
+		}
+		if (e.hostOnly && host != e.domain) || (!e.hostOnly && !domainMatch(host, e.domain)) {
+			continue
+		}
+		if !pathMatch(path, e.path) || e.secure && u.Scheme != "https" {
+			continue
+		}
+		matched = append(matched, e)
+	}
+
+	// longer paths first, then earlier creation, see RFC 6265 Section 5.4.
+	sort.Slice(matched, func(a, b int) bool {
+		if len(matched[a].path) != len(matched[b].path) {
+			return len(matched[a].path) > len(matched[b].path)
+		}
+		return matched[a].seq < matched[b].seq
+	})
+	pairs := make([]string, 0, len(matched))
+	for _, e := range matched {
+		pairs = append(pairs, e.name+"="+e.value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// parse parses a single Set-Cookie value received from u according to
+// [RFC 6265 Section 5.2], reports false if the cookie must be ignored.
+//
+// [RFC 6265 Section 5.2]: https://datatracker.ietf.org/doc/html/rfc6265#section-5.2
+func (j *Jar) parse(line string, u *url.URL, host string, now time.Time) (*jarEntry, bool) {
+	c, err := internal.ParseSetCookie(line)
+	if err != nil {
+		return nil, false
+	}
+
+	j.seq++
+	e := &jarEntry{name: c.Name, value: c.Value, path: c.Path, secure: c.Secure, expires: c.Expires, seq: j.seq}
+	// Max-Age takes precedence over Expires.
+	switch {
+	case c.MaxAge < 0:
+		e.expires = time.Unix(0, 0)
+	case c.MaxAge > 0:
+		e.expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+	}
+
+	// any Domain attribute makes a domain cookie but a public suffix,
+	// here a domain without an embedded dot, which is only accepted as
+	// the request host, see RFC 6265 Section 5.3 steps 5 and 6.
+	switch {
+	case c.Domain == "", c.Domain == host && !strings.Contains(c.Domain, "."):
+		e.domain, e.hostOnly = host, true
+	case domainMatch(host, c.Domain) && strings.Contains(c.Domain, "."):
+		e.domain = c.Domain
+	default:
+		return nil, false
+	}
+	if e.path == "" {
+		e.path = defaultPath(u.Path)
+	}
+	if e.secure && u.Scheme != "https" {
+		return nil, false
+	}
+	return e, true
+}
+
+// canonicalHost returns the lower-case host of hostport without the port.
+func canonicalHost(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return strings.ToLower(strings.Trim(host, "[]"))
+}
+
+// domainMatch implements the domain-match of [RFC 6265 Section 5.1.3].
+//
+// [RFC 6265 Section 5.1.3]: https://datatracker.ietf.org/doc/html/rfc6265#section-5.1.3
+func domainMatch(host, domain string) bool {
+	if host == domain {
+		return true
+	}
+	return strings.HasSuffix(host, "."+domain) && net.ParseIP(host) == nil
+}
+
+// pathMatch implements the path-match of [RFC 6265 Section 5.1.4].
+//
+// [RFC 6265 Section 5.1.4]: https://datatracker.ietf.org/doc/html/rfc6265#section-5.1.4
+func pathMatch(reqPath, cookiePath string) bool {
+	if reqPath == cookiePath {
+		return true
+	}
+	if !strings.HasPrefix(reqPath, cookiePath) {
+		return false
+	}
+	return strings.HasSuffix(cookiePath, "/") || reqPath[len(cookiePath)] == '/'
+}
+
+// defaultPath implements the default-path of [RFC 6265 Section 5.1.4].
+//
+// [RFC 6265 Section 5.1.4]: https://datatracker.ietf.org/doc/html/rfc6265#section-5.1.4
+func defaultPath(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return "/"
+	}
+	i := strings.LastIndex(p, "/")
+	if i == 0 {
+		return "/"
+	}
+	return p[:i]
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustURL(t *testing.T, s string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(s)
+	assert.NoError(t, err)
+	return u
+}
+
+func TestJar(t *testing.T) {
+	testCases := []struct {
+		name       string
+		from       string
+		setCookies []string
+		to         string
+		expected   string
+	}{
+		{
+			name:       "host-only cookie",
+			from:       "http://example.com/",
+			setCookies: []string{"id=1"},
+			to:         "http://example.com/anything",
+			expected:   "id=1",
+		},
+		{
+			name:       "host-only cookie is not sent to subdomains",
+			from:       "http://example.com/",
+			setCookies: []string{"id=1"},
+			to:         "http://www.example.com/",
+			expected:   "",
+		},
+		{
+			name:       "domain cookie is sent to subdomains",
+			from:       "http://www.example.com/",
+			setCookies: []string{"id=1; Domain=.example.com"},
+			to:         "http://api.example.com/",
+			expected:   "id=1",
+		},
+		{
+			name:       "domain equal to the host is sent to subdomains",
+			from:       "http://example.com/",
+			setCookies: []string{"id=1; Domain=example.com"},
+			to:         "http://sub.example.com/",
+			expected:   "id=1",
+		},
+		{
+			name:       "public suffix equal to the host is host-only",
+			from:       "http://localhost/",
+			setCookies: []string{"id=1; Domain=localhost"},
+			to:         "http://localhost/",
+			expected:   "id=1",
+		},
+		{
+			name:       "foreign domain is rejected",
+			from:       "http://example.com/",
+			setCookies: []string{"id=1; Domain=other.com"},
+			to:         "http://other.com/",
+			expected:   "",
+		},
+		{
+			name:       "public suffix domain is rejected",
+			from:       "http://example.com/",
+			setCookies: []string{"id=1; Domain=com"},
+			to:         "http://example.com/",
+			expected:   "",
+		},
+		{
+			name:       "path match",
+			from:       "http://example.com/",
+			setCookies: []string{"a=1; Path=/docs", "b=2; Path=/"},
+			to:         "http://example.com/docs/web",
+			expected:   "a=1; b=2",
+		},
+		{
+			name:       "path mismatch",
+			from:       "http://example.com/",
+			setCookies: []string{"a=1; Path=/docs"},
+			to:         "http://example.com/docsearch",
+			expected:   "",
+		},
+		{
+			name:       "default path",
+			from:       "http://example.com/docs/index.html",
+			setCookies: []string{"a=1"},
+			to:         "http://example.com/",
+			expected:   "",
+		},
+		{
+			name:       "secure cookie only over https",
+			from:       "https://example.com/",
+			setCookies: []string{"a=1; Secure"},
+			to:         "http://example.com/",
+			expected:   "",
+		},
+		{
+			name:       "secure cookie from http is rejected",
+			from:       "http://example.com/",
+			setCookies: []string{"a=1; Secure"},
+			to:         "https://example.com/",
+			expected:   "",
+		},
+		{
+			name:       "max-age zero deletes the cookie",
+			from:       "http://example.com/",
+			setCookies: []string{"a=1", "b=2", "a=; Max-Age=0"},
+			to:         "http://example.com/",
+			expected:   "b=2",
+		},
+		{
+			name:       "expires in the past deletes the cookie",
+			from:       "http://example.com/",
+			setCookies: []string{"a=1", "a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT"},
+			to:         "http://example.com/",
+			expected:   "",
+		},
+		{
+			name:       "update keeps the creation order",
+			from:       "http://example.com/",
+			setCookies: []string{"a=1", "b=2", "a=3"},
+			to:         "http://example.com/",
+			expected:   "a=3; b=2",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			jar := NewJar()
+			jar.SetCookies(mustURL(t, tc.from), tc.setCookies)
+			assert.Equal(t, tc.expected, jar.CookieHeader(mustURL(t, tc.to)))
+		})
+	}
+}
+
+func TestJarMaxAge(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	jar := NewJar()
+	jar.now = func() time.Time { return now }
+	u := mustURL(t, "http://example.com/")
+
+	// Max-Age takes precedence over Expires.
+	jar.SetCookies(u, []string{"a=1; Max-Age=60; Expires=Wed, 21 Oct 2015 07:28:00 GMT"})
+	assert.Equal(t, "a=1", jar.CookieHeader(u))
+
+	now = now.Add(2 * time.Minute)
+	assert.Equal(t, "", jar.CookieHeader(u))
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// connKey identifies the connections that are interchangeable
+// for a request.
+type connKey struct {
+	network string
+	addr    string
+	tls     bool
+}
+
+// persistConn is a connection that may serve several requests.
+type persistConn struct {
+	conn      net.Conn
+	br        *bufio.Reader
+	key       connKey
+	reused    bool        // the connection served a previous request
+	nread     int64       // bytes read from conn in the current exchange
+	idleAt    time.Time   // when the connection was put back
+	idleTimer *time.Timer // closes the connection once it idled too long, if limited
+}
+
+func newPersistConn(conn net.Conn, key connKey) *persistConn {
+	pc := &persistConn{conn: conn, key: key}
+	pc.br = bufio.NewReader(&countingReader{r: conn, n: &pc.nread})
+	return pc
+}
+
+// stopIdleTimer stops the timer closing pc once it idled too long.
+func (pc *persistConn) stopIdleTimer() {
+	if pc.idleTimer != nil {
+		pc.idleTimer.Stop()
+		pc.idleTimer = nil
+	}
+}
+
+// isAlive reports whether an idle connection can be reused, i.e.
+// the server neither closed it nor sent unsolicited bytes meanwhile.
+func (pc *persistConn) isAlive() bool {
+	if pc.br.Buffered() > 0 {
+		return false
+	}
+	_ = pc.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := pc.br.Peek(1)
+	_ = pc.conn.SetReadDeadline(time.Time{})
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	*cr.n += int64(n)
+	return n, err
+}
+
+// pool keeps idle connections per [connKey] and limits the number of
+// connections per key.
+type pool struct {
+	mu      sync.Mutex
+	opts    *ClientOptions
+	idle    map[connKey][]*persistConn // most recently used last
+	nidle   int
+	conns   map[connKey]int           // open connections, idle ones included
+	changed map[connKey]chan struct{} // closed when a connection is put or released
+}
+
+func newPool(opts *ClientOptions) *pool {
+	return &pool{
+		opts:    opts,
+		idle:    make(map[connKey][]*persistConn),
+		conns:   make(map[connKey]int),
+		changed: make(map[connKey]chan struct{}),
+	}
+}
+
+// take returns the most recently used idle connection for key. Without
+// one it reserves a slot for a new connection and reports ok, or returns
+// a channel that is closed once a connection is put or released.
+func (p *pool) take(key connKey) (pc *persistConn, ok bool, wait <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if conns := p.idle[key]; len(conns) > 0 {
+		pc = conns[len(conns)-1]
+		p.idle[key] = conns[:len(conns)-1]
+		p.nidle--
+		pc.stopIdleTimer()
+		return pc, false, nil
+	}
+	if max := p.opts.maxConnsPerHost; max <= 0 || p.conns[key] < max {
+		p.conns[key]++
+		return nil, true, nil
+	}
+	ch, exists := p.changed[key]
+	if !exists {
+		ch = make(chan struct{})
+		p.changed[key] = ch
+	}
+	return nil, false, ch
+}
+
+// put returns pc to the idle connections, or closes it if the
+// idle limits are reached.
+func (p *pool) put(pc *persistConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.opts.disableKeepAlives || len(p.idle[pc.key]) >= p.opts.maxIdleConnsPerHost {
+		p.closeLocked(pc)
+		return
+	}
+	if p.opts.maxIdleConns > 0 && p.nidle >= p.opts.maxIdleConns {
+		p.evictOldestLocked()
+	}
+	pc.reused = true
+	pc.idleAt = time.Now()
+	if p.opts.idleConnTimeout > 0 {
+		pc.idleTimer = time.AfterFunc(p.opts.idleConnTimeout, func() {
+			p.removeIdle(pc)
+		})
+	}
+	p.idle[pc.key] = append(p.idle[pc.key], pc)
+	p.nidle++
+	p.notifyLocked(pc.key)
+}
+
+// discard closes pc and releases its slot.
+func (p *pool) discard(pc *persistConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeLocked(pc)
+}
+
+// release frees a slot reserved by take whose dial failed.
+func (p *pool) release(key connKey) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.conns[key]--
+	p.notifyLocked(key)
+}
+
+// removeIdle closes pc if it is still idle.
+func (p *pool) removeIdle(pc *persistConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conns := p.idle[pc.key]
+	for i, c := range conns {
+		if c == pc {
+			p.idle[pc.key] = append(conns[:i:i], conns[i+1:]...)
+			p.nidle--
+			p.closeLocked(pc)
+			return
+		}
+	}
+}
+
+// closeIdle closes every idle connection.
+func (p *pool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, conns := range p.idle {
+		for _, pc := range conns {
+			pc.stopIdleTimer()
+			p.closeLocked(pc)
+		}
+		delete(p.idle, key)
+	}
+	p.nidle = 0
+}
+
+// evictOldestLocked closes the idle connection that idled the longest,
+// the first of each key being the oldest of that key.
+func (p *pool) evictOldestLocked() {
+	var oldest *persistConn
+	for _, conns := range p.idle {
+		if len(conns) > 0 && (oldest == nil || conns[0].idleAt.Before(oldest.idleAt)) {
+			oldest = conns[0]
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	oldest.stopIdleTimer()
+	p.idle[oldest.key] = p.idle[oldest.key][1:]
+	p.nidle--
+	p.closeLocked(oldest)
+}
+
+func (p *pool) closeLocked(pc *persistConn) {
+	_ = pc.conn.Close()
+	p.conns[pc.key]--
+	p.notifyLocked(pc.key)
+}
+
+func (p *pool) notifyLocked(key connKey) {
+	if ch, exists := p.changed[key]; exists {
+		close(ch)
+		delete(p.changed, key)
+	}
+}
+
+// tapConn copies the bytes written to and read from the connection to tap.
+type tapConn struct {
+	net.Conn
+	tap io.Writer
+}
+
+func (c *tapConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		_, _ = c.tap.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *tapConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		_, _ = c.tap.Write(p[:n])
+	}
+	return n, err
+}
+
+// lockedWriter serializes writes of concurrent connections.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	return lw.w.Write(p)
+}
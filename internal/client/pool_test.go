@@ -0,0 +1,223 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"httpfromtcp/internal"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keepAliveServer answers every request with the request-target as body
+// and keeps connections open.
+type keepAliveServer struct {
+	ln      net.Listener
+	accepts atomic.Int32
+	// serve is called for the n-th request on a connection and reports
+	// whether to answer it and whether to keep the connection open
+	// afterwards.
+	serve func(n int, r *internal.Request) (answer, keepOpen bool)
+	// respond returns the raw response to r, by default the
+	// request-target is echoed.
+	respond func(r *internal.Request) string
+}
+
+func newKeepAliveServer(t *testing.T, serve func(n int, r *internal.Request) (bool, bool)) *keepAliveServer {
+	t.Helper()
+	s := &keepAliveServer{ln: listen(t), serve: serve}
+	go func() {
+		for {
+			conn, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			s.accepts.Add(1)
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *keepAliveServer) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for n := 0; ; n++ {
+		r, err := internal.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		answer, keepOpen := true, true
+		if s.serve != nil {
+			answer, keepOpen = s.serve(n, r)
+		}
+		if answer && s.respond != nil {
+			_, _ = conn.Write([]byte(s.respond(r)))
+		} else if answer {
+			body := r.RequestLine.RequestTarget
+			fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+		if !keepOpen {
+			return
+		}
+	}
+}
+
+func (s *keepAliveServer) url(path string) string {
+	return "http://" + s.ln.Addr().String() + path
+}
+
+func TestPoolReusesConnection(t *testing.T) {
+	s := newKeepAliveServer(t, nil)
+	c := NewClient()
+
+	for _, path := range []string{"/one", "/two", "/three"} {
+		resp, err := c.Do(internal.NewRequest("GET", s.url(path)))
+		assert.NoError(t, err)
+		assert.Equal(t, path, string(resp.Body))
+	}
+	assert.Equal(t, int32(1), s.accepts.Load())
+}
+
+func TestPoolDisableKeepAlives(t *testing.T) {
+	s := newKeepAliveServer(t, func(n int, r *internal.Request) (bool, bool) {
+		return r.GetHeader("Connection") == "close", true
+	})
+	c := NewClient(WithDisableKeepAlives())
+
+	for range 3 {
+		_, err := c.Do(internal.NewRequest("GET", s.url("/")))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int32(3), s.accepts.Load())
+}
+
+func TestPoolDetectsClosedConnection(t *testing.T) {
+	// the server closes every connection after the first response,
+	// like an idle timeout on its side.
+	s := newKeepAliveServer(t, func(n int, r *internal.Request) (bool, bool) {
+		return true, false
+	})
+	c := NewClient()
+
+	_, err := c.Do(internal.NewRequest("GET", s.url("/one")))
+	assert.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	resp, err := c.Do(internal.NewRequest("POST", s.url("/two")))
+	assert.NoError(t, err)
+	assert.Equal(t, "/two", string(resp.Body))
+	assert.Equal(t, int32(2), s.accepts.Load())
+}
+
+func TestPoolRetriesStaleConnection(t *testing.T) {
+	testCases := []struct {
+		name    string
+		method  string
+		wantErr bool
+	}{
+		{name: "idempotent request is retried", method: "GET"},
+		{name: "non-idempotent request fails", method: "POST", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the server reads the second request on a connection but
+			// closes it without answering, a race the alive check
+			// cannot detect.
+			s := newKeepAliveServer(t, func(n int, r *internal.Request) (bool, bool) {
+				return n == 0, n == 0
+			})
+			c := NewClient()
+
+			_, err := c.Do(internal.NewRequest("GET", s.url("/one")))
+			assert.NoError(t, err)
+			_, err = c.Do(internal.NewRequest(tc.method, s.url("/two")))
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, int32(2), s.accepts.Load())
+		})
+	}
+}
+
+func TestPoolIdleConnTimeout(t *testing.T) {
+	s := newKeepAliveServer(t, nil)
+	c := NewClient(WithIdleConnTimeout(10 * time.Millisecond))
+
+	_, err := c.Do(internal.NewRequest("GET", s.url("/")))
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	_, err = c.Do(internal.NewRequest("GET", s.url("/")))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), s.accepts.Load())
+}
+
+func TestPoolNoIdleConnTimeout(t *testing.T) {
+	s := newKeepAliveServer(t, nil)
+	c := NewClient(WithIdleConnTimeout(0))
+
+	for range 3 {
+		_, err := c.Do(internal.NewRequest("GET", s.url("/")))
+		assert.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(1), s.accepts.Load())
+}
+
+func TestPoolMaxConnsPerHost(t *testing.T) {
+	var inflight, peak atomic.Int32
+	s := newKeepAliveServer(t, func(n int, r *internal.Request) (bool, bool) {
+		cur := inflight.Add(1)
+		for {
+			p := peak.Load()
+			if cur <= p || peak.CompareAndSwap(p, cur) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		inflight.Add(-1)
+		return true, true
+	})
+	c := NewClient(WithMaxConnsPerHost(2))
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Do(internal.NewRequest("GET", s.url("/")))
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, peak.Load(), int32(2))
+	assert.LessOrEqual(t, s.accepts.Load(), int32(2))
+}
+
+func TestPoolMaxIdleConnsPerHost(t *testing.T) {
+	s := newKeepAliveServer(t, nil)
+	c := NewClient(WithMaxIdleConnsPerHost(1))
+
+	bodies := make([]func() error, 0, 3)
+	for range 3 {
+		_, body, err := c.Stream(t.Context(), internal.NewRequest("GET", s.url("/")))
+		assert.NoError(t, err)
+		_, err = body.Read(make([]byte, 16))
+		assert.NoError(t, err)
+		_, err = body.Read(make([]byte, 16))
+		assert.Error(t, err)
+		bodies = append(bodies, body.Close)
+	}
+	for _, closeBody := range bodies {
+		assert.NoError(t, closeBody())
+	}
+	c.pool.mu.Lock()
+	assert.Equal(t, 1, c.pool.nidle)
+	c.pool.mu.Unlock()
+}
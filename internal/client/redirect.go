@@ -0,0 +1,78 @@
+package client
+
+import (
+	"fmt"
+	"httpfromtcp/internal"
+	"net/url"
+)
+
+// redirectRequest builds the request that follows the redirect resp
+// received for r sent to u, following [RFC 9110 Section 15.4]:
+//
+//   - 301 and 302 turn a POST into a GET without body, as user agents
+//     historically do, other methods are kept.
+//   - 303 turns every method but HEAD into a GET without body.
+//   - 307 and 308 keep the method and the body.
+//
+// Credentials, including the Cookie header set by the caller, are not
+// sent to a different host.
+//
+// [RFC 9110 Section 15.4]: https://www.rfc-editor.org/rfc/rfc9110#name-redirection-3xx
+func redirectRequest(r *internal.Request, resp *internal.Response, u *url.URL) (*internal.Request, error) {
+	loc, err := u.Parse(resp.GetHeader("Location"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirect location: %w", err)
+	}
+	if loc.Scheme != "http" && loc.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported redirect scheme %q", loc.Scheme)
+	}
+
+	m, body := method(r), r.Body
+	switch resp.ResponseLine.StatusCode {
+	case internal.StatusMovedPermanently, internal.StatusFound:
+		if m == "POST" {
+			m, body = "GET", nil
+		}
+	case internal.StatusSeeOther:
+		if m != "HEAD" {
+			m = "GET"
+		}
+		body = nil
+	}
+
+	sameHost := canonicalHost(loc.Host) == canonicalHost(u.Host)
+	next := internal.NewRequest(m, loc.String())
+	for k, v := range r.Headers.HeadersMap {
+		switch k {
+		case "Host":
+			// the Host follows the location.
+			continue
+		case "Authorization", "Proxy-Authorization", "Cookie":
+			if !sameHost {
+				continue
+			}
+		case "Content-Type", "Content-Length", "Content-Encoding", "Content-Language":
+			if body == nil {
+				continue
+			}
+		}
+		next.Headers.Set(k, v)
+	}
+	next.Body = body
+	return next, nil
+}
+
+// withCookies returns a copy of r carrying the cookies in its Cookie
+// header, after any cookies set by the caller.
+func withCookies(r *internal.Request, cookies string) *internal.Request {
+	c := *r
+	c.Headers = internal.NewHeaders()
+	for k, v := range r.Headers.HeadersMap {
+		c.Headers.Set(k, v)
+	}
+	if v := c.Headers.Get("Cookie"); v != "" {
+		cookies = v + "; " + cookies
+	}
+	c.Headers.Set("Cookie", cookies)
+	return &c
+}
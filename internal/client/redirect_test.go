@@ -0,0 +1,122 @@
+package client
+
+import (
+	"fmt"
+	"httpfromtcp/internal"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectRequest(t *testing.T) {
+	testCases := []struct {
+		name     string
+		method   string
+		status   internal.HTTPStatusCode
+		location string
+		target   string
+		expected string
+		withBody bool
+	}{
+		{name: "301 POST becomes GET", method: "POST", status: 301, location: "/new", expected: "GET", target: "http://example.com/new"},
+		{name: "302 PUT is kept", method: "PUT", status: 302, location: "/new", expected: "PUT", target: "http://example.com/new", withBody: true},
+		{name: "303 POST becomes GET", method: "POST", status: 303, location: "new", expected: "GET", target: "http://example.com/a/new"},
+		{name: "303 HEAD is kept", method: "HEAD", status: 303, location: "/new", expected: "HEAD", target: "http://example.com/new"},
+		{name: "307 keeps method and body", method: "POST", status: 307, location: "https://other.com/x", expected: "POST", target: "https://other.com/x", withBody: true},
+		{name: "308 keeps method and body", method: "PATCH", status: 308, location: "/new?q=1", expected: "PATCH", target: "http://example.com/new?q=1", withBody: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := internal.NewRequest(tc.method, "http://example.com/a/b")
+			r.Body = []byte("payload")
+			r.Headers.Set("Content-Type", "text/plain")
+			resp := internal.NewResponse(tc.status, "")
+			resp.Headers = internal.NewHeaders()
+			resp.Headers.Set("Location", tc.location)
+
+			next, err := redirectRequest(r, resp, mustURL(t, "http://example.com/a/b"))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, next.RequestLine.Method)
+			assert.Equal(t, tc.target, next.RequestLine.RequestTarget)
+			if tc.withBody {
+				assert.Equal(t, []byte("payload"), next.Body)
+				assert.Equal(t, "text/plain", next.GetHeader("Content-Type"))
+			} else {
+				assert.Empty(t, next.Body)
+				assert.Equal(t, "", next.GetHeader("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestRedirectDropsCredentials(t *testing.T) {
+	r := internal.NewRequest("GET", "http://example.com/")
+	r.Headers.Set("Authorization", "Bearer secret")
+	r.Headers.Set("Cookie", "session=abc")
+	resp := internal.NewResponse(internal.StatusFound, "")
+	resp.Headers = internal.NewHeaders()
+
+	resp.Headers.Set("Location", "/same")
+	next, err := redirectRequest(r, resp, mustURL(t, "http://example.com/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer secret", next.GetHeader("Authorization"))
+	assert.Equal(t, "session=abc", next.GetHeader("Cookie"))
+
+	resp.Headers.Set("Location", "http://evil.com/")
+	next, err = redirectRequest(r, resp, mustURL(t, "http://example.com/"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", next.GetHeader("Authorization"))
+	assert.Equal(t, "", next.GetHeader("Cookie"))
+}
+
+func TestClientFollowsRedirects(t *testing.T) {
+	s := newKeepAliveServer(t, nil)
+	var hops int
+	s.respond = func(r *internal.Request) string {
+		hops++
+		switch r.RequestLine.RequestTarget {
+		case "/login":
+			return "HTTP/1.1 303 See Other\r\nLocation: /home\r\nSet-Cookie: session=abc; Path=/\r\nSet-Cookie: theme=dark; Expires=Wed, 21 Oct 2099 07:28:00 GMT\r\nContent-Length: 0\r\n\r\n"
+		case "/home":
+			body := "cookie=" + r.GetHeader("Cookie") + " method=" + r.RequestLine.Method
+			return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		default:
+			return "HTTP/1.1 302 Found\r\nLocation: " + r.RequestLine.RequestTarget + "\r\nContent-Length: 0\r\n\r\n"
+		}
+	}
+
+	c := NewClient(WithFollowRedirects(5), WithCookieJar(NewJar()))
+	r := internal.NewRequest("POST", s.url("/login"))
+	r.Body = []byte("user=gopher")
+	resp, err := c.Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "cookie=session=abc; theme=dark method=GET", string(resp.Body))
+	assert.Equal(t, int32(1), s.accepts.Load())
+
+	hops = 0
+	_, err = c.Do(internal.NewRequest("GET", s.url("/loop")))
+	assert.ErrorIs(t, err, ErrTooManyRedirects)
+	assert.Equal(t, 6, hops)
+
+	// without following, the redirect is returned as is.
+	resp, err = NewClient().Do(internal.NewRequest("GET", s.url("/loop")))
+	assert.NoError(t, err)
+	assert.Equal(t, internal.StatusFound, resp.ResponseLine.StatusCode)
+
+	// a Cookie set by the caller follows redirects to the same host,
+	// without a jar too.
+	r = internal.NewRequest("GET", s.url("/start"))
+	r.Headers.Set("Cookie", "token=xyz")
+	s.respond = func(r *internal.Request) string {
+		if r.RequestLine.RequestTarget == "/start" {
+			return "HTTP/1.1 302 Found\r\nLocation: /home\r\nContent-Length: 0\r\n\r\n"
+		}
+		body := "cookie=" + r.GetHeader("Cookie")
+		return fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	resp, err = NewClient(WithFollowRedirects(5)).Do(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "cookie=token=xyz", string(resp.Body))
+}
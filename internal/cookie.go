@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SameSite is the SameSite attribute of a cookie.
+type SameSite int
+
+const (
+	// SameSiteDefault leaves the attribute out.
+	SameSiteDefault SameSite = iota
+	SameSiteLax
+	SameSiteStrict
+	SameSiteNone
+)
+
+func (s SameSite) String() string {
+	switch s {
+	case SameSiteLax:
+		return "Lax"
+	case SameSiteStrict:
+		return "Strict"
+	case SameSiteNone:
+		return "None"
+	}
+	return ""
+}
+
+// Cookie is a cookie sent in a Set-Cookie header, see
+// [RFC 6265 Section 4.1]. Partitioned follows the CHIPS draft.
+//
+// [RFC 6265 Section 4.1]: https://datatracker.ietf.org/doc/html/rfc6265#section-4.1
+type Cookie struct {
+	Name   string
+	Value  string
+	Domain string
+	Path   string
+	// Expires is left out when zero.
+	Expires time.Time
+	// MaxAge is left out when 0, a negative MaxAge deletes the cookie
+	// and is written as "Max-Age=0".
+	MaxAge      int
+	Secure      bool
+	HttpOnly    bool
+	SameSite    SameSite
+	Partitioned bool
+}
+
+// String returns the cookie as the value of a Set-Cookie header.
+func (c *Cookie) String() string {
+	var b strings.Builder
+	b.WriteString(c.Name + "=" + quoteCookieValue(c.Value))
+	if c.Domain != "" {
+		b.WriteString("; Domain=" + strings.TrimPrefix(c.Domain, "."))
+	}
+	if c.Path != "" {
+		b.WriteString("; Path=" + c.Path)
+	}
+	if !c.Expires.IsZero() {
+		b.WriteString("; Expires=" + FormatHTTPDate(c.Expires))
+	}
+	switch {
+	case c.MaxAge > 0:
+		b.WriteString("; Max-Age=" + strconv.Itoa(c.MaxAge))
+	case c.MaxAge < 0:
+		b.WriteString("; Max-Age=0")
+	}
+	if c.Secure {
+		b.WriteString("; Secure")
+	}
+	if c.HttpOnly {
+		b.WriteString("; HttpOnly")
+	}
+	if c.SameSite != SameSiteDefault {
+		b.WriteString("; SameSite=" + c.SameSite.String())
+	}
+	if c.Partitioned {
+		b.WriteString("; Partitioned")
+	}
+	return b.String()
+}
+
+// Valid reports why the cookie cannot be sent, checking the grammar of
+// [RFC 6265 Section 4.1.1] and that SameSite=None and Partitioned
+// cookies are Secure as browsers require.
+//
+// [RFC 6265 Section 4.1.1]: https://datatracker.ietf.org/doc/html/rfc6265#section-4.1.1
+func (c *Cookie) Valid() error {
+	if c.Name == "" || !isToken(c.Name) {
+		return fmt.Errorf("invalid cookie name %q", c.Name)
+	}
+	if !validCookieValue(c.Value) {
+		return fmt.Errorf("invalid value for cookie %q", c.Name)
+	}
+	if c.Domain != "" && !validCookieDomain(c.Domain) {
+		return fmt.Errorf("invalid domain %q for cookie %q", c.Domain, c.Name)
+	}
+	for _, r := range c.Path {
+		if r < 0x20 || r == 0x7f || r == ';' {
+			return fmt.Errorf("invalid path %q for cookie %q", c.Path, c.Name)
+		}
+	}
+	if !c.Expires.IsZero() && c.Expires.Year() < 1601 {
+		return fmt.Errorf("invalid expires for cookie %q", c.Name)
+	}
+	if (c.SameSite == SameSiteNone || c.Partitioned) && !c.Secure {
+		return fmt.Errorf("cookie %q must be secure", c.Name)
+	}
+	return nil
+}
+
+// validCookieValue reports whether v is made of cookie-octets, which
+// may be enclosed in double quotes.
+//
+//	cookie-value = *cookie-octet / ( DQUOTE *cookie-octet DQUOTE )
+//	cookie-octet = %x21 / %x23-2B / %x2D-3A / %x3C-5B / %x5D-7E
+//
+// A value containing spaces or commas is accepted and quoted by
+// [Cookie.String], as most user agents read it.
+func validCookieValue(v string) bool {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c == ' ' || c == ',' {
+			continue
+		}
+		if c < 0x21 || c > 0x7e || c == '"' || c == ';' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteCookieValue(v string) string {
+	if strings.ContainsAny(v, " ,") && !(len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"') {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// validCookieDomain reports whether d is a host name or an IP address.
+func validCookieDomain(d string) bool {
+	d = strings.TrimPrefix(d, ".")
+	if net.ParseIP(d) != nil {
+		return true
+	}
+	if d == "" || len(d) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(d, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !isAlphaNumeric(r) && r != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// ParseCookieHeader parses the cookie-string of a Cookie header into a
+// map of the cookie values by name. User agents send the cookies with
+// the most specific path first, so the first value of a name is kept.
+func ParseCookieHeader(v string) map[string]string {
+	cookies := map[string]string{}
+	for _, pair := range strings.Split(v, ";") {
+		name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found || name == "" || !isToken(name) {
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		if _, exists := cookies[name]; !exists {
+			cookies[name] = value
+		}
+	}
+	return cookies
+}
+
+// Cookies returns the cookies sent with the request by name.
+func (r *Request) Cookies() map[string]string {
+	return ParseCookieHeader(r.GetHeader("Cookie"))
+}
+
+// Cookie returns the value of the cookie named name, reports false if
+// the request has no such cookie.
+func (r *Request) Cookie(name string) (string, bool) {
+	v, ok := r.Cookies()[name]
+	return v, ok
+}
+
+// ParseSetCookie parses a Set-Cookie header value following the user
+// agent algorithm of [RFC 6265 Section 5.2]: attributes that cannot be
+// parsed are ignored, only a missing name makes the cookie invalid.
+//
+// A Max-Age of zero or less is returned as -1.
+//
+// [RFC 6265 Section 5.2]: https://datatracker.ietf.org/doc/html/rfc6265#section-5.2
+func ParseSetCookie(line string) (*Cookie, error) {
+	parts := strings.Split(line, ";")
+	name, value, found := strings.Cut(parts[0], "=")
+	name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+	if !found || name == "" {
+		return nil, errors.New("set-cookie has no cookie name")
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+
+	c := &Cookie{Name: name, Value: value}
+	for _, attr := range parts[1:] {
+		k, v, _ := strings.Cut(attr, "=")
+		k, v = strings.ToLower(strings.TrimSpace(k)), strings.TrimSpace(v)
+		switch k {
+		case "expires":
+			if t, err := parseCookieDate(v); err == nil {
+				c.Expires = t
+			}
+		case "max-age":
+			n, err := strconv.Atoi(v)
+			if err != nil || (v[0] != '-' && (v[0] < '0' || v[0] > '9')) {
+				continue
+			}
+			if n <= 0 {
+				n = -1
+			}
+			c.MaxAge = n
+		case "domain":
+			c.Domain = strings.ToLower(strings.TrimPrefix(v, "."))
+		case "path":
+			if strings.HasPrefix(v, "/") {
+				c.Path = v
+			}
+		case "secure":
+			c.Secure = true
+		case "httponly":
+			c.HttpOnly = true
+		case "samesite":
+			switch strings.ToLower(v) {
+			case "lax":
+				c.SameSite = SameSiteLax
+			case "strict":
+				c.SameSite = SameSiteStrict
+			case "none":
+				c.SameSite = SameSiteNone
+			}
+		case "partitioned":
+			c.Partitioned = true
+		}
+	}
+	return c, nil
+}
+
+// SetCookies returns the cookies of the Set-Cookie headers of the
+// response, skipping the ones that cannot be parsed.
+func (r *Response) SetCookies() []*Cookie {
+	var cookies []*Cookie
+	for _, line := range r.Headers.Values("Set-Cookie") {
+		if c, err := ParseSetCookie(line); err == nil {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+// parseCookieDate parses the Expires attribute as an HTTP date, falling
+// back to the formats still sent by servers that [RFC 6265 Section 5.1.1]
+// parses leniently: a zone other than GMT and the dashed Netscape date.
+//
+// [RFC 6265 Section 5.1.1]: https://www.rfc-editor.org/rfc/rfc6265#section-5.1.1
+func parseCookieDate(v string) (time.Time, error) {
+	t, err := ParseHTTPDate(v)
+	if err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.RFC1123, "Mon, 02-Jan-2006 15:04:05 MST"} {
+		if t, lerr := time.Parse(layout, v); lerr == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// AddCookie adds c to the Set-Cookie headers written by the next call
+// to [ResponseWriter.WriteHeaders], returns an error if c is not valid.
+func (w *ResponseWriter) AddCookie(c *Cookie) error {
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	w.cookies = append(w.cookies, c.String())
+	return nil
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCookieString(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cookie   *Cookie
+		expected string
+	}{
+		{
+			name:     "name and value",
+			cookie:   &Cookie{Name: "id", Value: "a3fWa"},
+			expected: "id=a3fWa",
+		},
+		{
+			name: "all attributes",
+			cookie: &Cookie{
+				Name:        "id",
+				Value:       "a3fWa",
+				Domain:      ".example.com",
+				Path:        "/app",
+				Expires:     time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC),
+				MaxAge:      3600,
+				Secure:      true,
+				HttpOnly:    true,
+				SameSite:    SameSiteNone,
+				Partitioned: true,
+			},
+			expected: "id=a3fWa; Domain=example.com; Path=/app; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=3600; Secure; HttpOnly; SameSite=None; Partitioned",
+		},
+		{
+			name:     "delete",
+			cookie:   &Cookie{Name: "id", MaxAge: -1, SameSite: SameSiteLax},
+			expected: "id=; Max-Age=0; SameSite=Lax",
+		},
+		{
+			name:     "value with a space is quoted",
+			cookie:   &Cookie{Name: "greeting", Value: "hello world"},
+			expected: `greeting="hello world"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.NoError(t, tc.cookie.Valid())
+			assert.Equal(t, tc.expected, tc.cookie.String())
+		})
+	}
+}
+
+func TestCookieValid(t *testing.T) {
+	testCases := []struct {
+		name   string
+		cookie *Cookie
+	}{
+		{"empty name", &Cookie{Value: "x"}},
+		{"separator in name", &Cookie{Name: "a;b", Value: "x"}},
+		{"semicolon in value", &Cookie{Name: "a", Value: "x;Domain=evil.com"}},
+		{"newline in value", &Cookie{Name: "a", Value: "x\r\nX-Injected: 1"}},
+		{"quote in value", &Cookie{Name: "a", Value: `x"y`}},
+		{"invalid domain", &Cookie{Name: "a", Domain: "exa mple.com"}},
+		{"semicolon in path", &Cookie{Name: "a", Path: "/;Secure"}},
+		{"samesite none without secure", &Cookie{Name: "a", SameSite: SameSiteNone}},
+		{"partitioned without secure", &Cookie{Name: "a", Partitioned: true}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Error(t, tc.cookie.Valid())
+		})
+	}
+}
+
+func TestParseCookieHeader(t *testing.T) {
+	r := NewRequest("GET", "/")
+	assert.Empty(t, r.Cookies())
+
+	r.Headers.Add("Cookie", `id=a3fWa; theme="dark"; id=older; bad name=x`)
+	r.Headers.Add("Cookie", "lang=en")
+	assert.Equal(t, map[string]string{"id": "a3fWa", "theme": "dark", "lang": "en"}, r.Cookies())
+
+	v, ok := r.Cookie("lang")
+	assert.True(t, ok)
+	assert.Equal(t, "en", v)
+	_, ok = r.Cookie("missing")
+	assert.False(t, ok)
+}
+
+func TestParseSetCookie(t *testing.T) {
+	testCases := []struct {
+		name     string
+		line     string
+		expected *Cookie
+	}{
+		{
+			name: "attributes",
+			line: `id="a3fWa"; Domain=.Example.com; Path=/app; Expires=Wed, 21 Oct 2015 07:28:00 GMT; Max-Age=60; Secure; HttpOnly; SameSite=strict; Partitioned`,
+			expected: &Cookie{
+				Name:        "id",
+				Value:       "a3fWa",
+				Domain:      "example.com",
+				Path:        "/app",
+				Expires:     time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC),
+				MaxAge:      60,
+				Secure:      true,
+				HttpOnly:    true,
+				SameSite:    SameSiteStrict,
+				Partitioned: true,
+			},
+		},
+		{
+			name:     "invalid attributes are ignored",
+			line:     "id=1; Max-Age=+5; Expires=tomorrow; Path=relative; SameSite=sometimes",
+			expected: &Cookie{Name: "id", Value: "1"},
+		},
+		{
+			name:     "non positive max-age",
+			line:     "id=1; Max-Age=0",
+			expected: &Cookie{Name: "id", Value: "1", MaxAge: -1},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := ParseSetCookie(tc.line)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, c)
+		})
+	}
+
+	_, err := ParseSetCookie("=novalue")
+	assert.Error(t, err)
+}
+
+func TestParseCookieDate(t *testing.T) {
+	expected := time.Date(2015, time.October, 21, 7, 28, 0, 0, time.UTC)
+	for _, v := range []string{
+		"Wed, 21 Oct 2015 07:28:00 GMT",
+		"Wednesday, 21-Oct-15 07:28:00 GMT",
+		"Wed Oct 21 07:28:00 2015",
+		"Wed, 21 Oct 2015 07:28:00 UTC",
+		"Wed, 21-Oct-2015 07:28:00 GMT",
+	} {
+		got, err := parseCookieDate(v)
+		assert.NoError(t, err, v)
+		assert.True(t, expected.Equal(got), v)
+	}
+	_, err := parseCookieDate("tomorrow")
+	assert.Error(t, err)
+}
+
+func TestSetCookieFieldLines(t *testing.T) {
+	resp, err := ReadResponseHead(bufio.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\n" +
+		"Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\n" +
+		"Set-Cookie: b=2\r\n" +
+		"Vary: Accept\r\n" +
+		"Vary: Cookie\r\n" +
+		"\r\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT", "b=2"}, resp.Headers.Values("Set-Cookie"))
+	assert.Equal(t, []string{"Accept,Cookie"}, resp.Headers.Values("Vary"))
+	assert.Len(t, resp.SetCookies(), 2)
+
+	var buf bytes.Buffer
+	w := NewResponseWriter(&buf)
+	assert.NoError(t, w.AddCookie(&Cookie{Name: "c", Value: "3", HttpOnly: true}))
+	assert.Error(t, w.AddCookie(&Cookie{Name: "bad;name"}))
+	assert.NoError(t, w.WriteHeaders(resp.Headers))
+	out := buf.String()
+	assert.Contains(t, out, "Set-Cookie: a=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT\r\n")
+	assert.Contains(t, out, "Set-Cookie: b=2\r\n")
+	assert.Contains(t, out, "Set-Cookie: c=3; HttpOnly\r\n")
+	assert.Equal(t, 3, strings.Count(out, "Set-Cookie:"))
+}
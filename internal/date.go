@@ -0,0 +1,28 @@
+package internal
+
+import "time"
+
+// TimeFormat is the IMF-fixdate format of HTTP dates, e.g.
+// "Sun, 06 Nov 1994 08:49:37 GMT".
+const TimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// FormatHTTPDate formats t as an IMF-fixdate.
+func FormatHTTPDate(t time.Time) string {
+	return t.UTC().Format(TimeFormat)
+}
+
+// ParseHTTPDate parses an HTTP date, accepting the preferred IMF-fixdate
+// and the obsolete RFC 850 and asctime formats as recipients must, see
+// [RFC 9110 Section 5.6.7].
+//
+// [RFC 9110 Section 5.6.7]: https://www.rfc-editor.org/rfc/rfc9110#name-date-time-formats
+func ParseHTTPDate(v string) (time.Time, error) {
+	var err error
+	for _, layout := range []string{TimeFormat, time.RFC850, time.ANSIC} {
+		var t time.Time
+		if t, err = time.Parse(layout, v); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, err
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHTTPDate(t *testing.T) {
+	expected := time.Date(1994, time.November, 6, 8, 49, 37, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		input   string
+		wantErr bool
+	}{
+		{
+			name:  "IMF-fixdate",
+			input: "Sun, 06 Nov 1994 08:49:37 GMT",
+		},
+		{
+			name:  "RFC 850",
+			input: "Sunday, 06-Nov-94 08:49:37 GMT",
+		},
+		{
+			name:  "asctime",
+			input: "Sun Nov  6 08:49:37 1994",
+		},
+		{
+			name:    "invalid",
+			input:   "yesterday",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseHTTPDate(tc.input)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.True(t, expected.Equal(got))
+		})
+	}
+	assert.Equal(t, "Sun, 06 Nov 1994 08:49:37 GMT", FormatHTTPDate(expected))
+}
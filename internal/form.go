@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	// ErrNotMultipart is returned when the request is not a
+	// multipart/form-data request with a boundary.
+	ErrNotMultipart = errors.New("request Content-Type is not multipart/form-data")
+	// ErrTooManyParts is returned when a multipart body has more parts
+	// than allowed.
+	ErrTooManyParts = errors.New("multipart body has too many parts")
+	// ErrFieldTooLarge is returned when a form field exceeds its limit.
+	ErrFieldTooLarge = errors.New("form field exceeds the maximum size")
+	// ErrFileTooLarge is returned when an uploaded file exceeds its limit.
+	ErrFileTooLarge = errors.New("uploaded file exceeds the maximum size")
+)
+
+// Query returns the values of the query component of the
+// request-target, or empty values if it cannot be parsed.
+func (r *Request) Query() url.Values {
+	_, query, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return url.Values{}
+	}
+	return values
+}
+
+// ParseForm returns the values of an application/x-www-form-urlencoded
+// body followed by the ones of the query component, a field sent several
+// times keeps all of its values. The body of other requests is ignored.
+func (r *Request) ParseForm() (url.Values, error) {
+	values := url.Values{}
+	mediaType, _, _ := mime.ParseMediaType(r.GetHeader("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		var err error
+		if values, err = url.ParseQuery(string(r.Body)); err != nil {
+			return nil, err
+		}
+	}
+	for k, vs := range r.Query() {
+		values[k] = append(values[k], vs...)
+	}
+	return values, nil
+}
+
+// MultipartReader returns a [multipart.Reader] iterating over the parts
+// of a multipart/form-data body, see [RFC 7578]. The body is the one
+// read into memory with the request, whose size the server limits with
+// its maximum body size.
+//
+// [RFC 7578]: https://www.rfc-editor.org/rfc/rfc7578
+func (r *Request) MultipartReader() (*multipart.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(r.GetHeader("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" || params["boundary"] == "" {
+		return nil, ErrNotMultipart
+	}
+	return multipart.NewReader(bytes.NewReader(r.Body), params["boundary"]), nil
+}
+
+// MultipartOptions limits the parsing of a multipart/form-data body by
+// [Request.ParseMultipartForm].
+type MultipartOptions struct {
+	maxMemory    int64
+	maxFileSize  int64
+	maxFieldSize int64
+	maxParts     int
+	tempDir      string
+}
+
+// DefaultMultipartOptions returns the default limits: files are kept in
+// memory up to 10MiB in total, a file may have 32MiB, a field 1MiB and
+// a body 1000 parts.
+func DefaultMultipartOptions() *MultipartOptions {
+	return &MultipartOptions{
+		maxMemory:    10 << 20,
+		maxFileSize:  32 << 20,
+		maxFieldSize: 1 << 20,
+		maxParts:     1000,
+	}
+}
+
+type MultipartOption func(*MultipartOptions)
+
+// WithMaxMemory sets the total size of the files kept in memory by the
+// form, the files that do not fit are copied to temporary files.
+func WithMaxMemory(n int64) MultipartOption {
+	return func(opts *MultipartOptions) {
+		opts.maxMemory = n
+	}
+}
+
+// WithMaxFileSize sets the maximum size of an uploaded file.
+func WithMaxFileSize(n int64) MultipartOption {
+	return func(opts *MultipartOptions) {
+		opts.maxFileSize = n
+	}
+}
+
+// WithMaxFieldSize sets the maximum size of the value of a field.
+func WithMaxFieldSize(n int64) MultipartOption {
+	return func(opts *MultipartOptions) {
+		opts.maxFieldSize = n
+	}
+}
+
+// WithMaxParts sets the maximum number of parts of a body.
+func WithMaxParts(n int) MultipartOption {
+	return func(opts *MultipartOptions) {
+		opts.maxParts = n
+	}
+}
+
+// WithTempDir sets the directory of the temporary files, [os.TempDir]
+// by default.
+func WithTempDir(dir string) MultipartOption {
+	return func(opts *MultipartOptions) {
+		opts.tempDir = dir
+	}
+}
+
+// MultipartForm is a parsed multipart/form-data body.
+type MultipartForm struct {
+	Value url.Values
+	File  map[string][]*FormFile
+}
+
+// RemoveAll removes the temporary files of the form.
+func (f *MultipartForm) RemoveAll() error {
+	var errs []error
+	for _, files := range f.File {
+		for _, file := range files {
+			if file.tmpPath == "" {
+				continue
+			}
+			if err := os.Remove(file.tmpPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FormFile is a file uploaded in a multipart/form-data body.
+type FormFile struct {
+	FieldName string
+	// Filename is the base name of the file sent by the client.
+	Filename    string
+	ContentType string
+	Size        int64
+	Header      textproto.MIMEHeader
+
+	content []byte
+	tmpPath string
+}
+
+// Open returns the content of the file.
+func (f *FormFile) Open() (io.ReadCloser, error) {
+	if f.tmpPath != "" {
+		return os.Open(f.tmpPath)
+	}
+	return io.NopCloser(bytes.NewReader(f.content)), nil
+}
+
+// InMemory reports whether the content of the file is kept in memory
+// rather than in a temporary file.
+func (f *FormFile) InMemory() bool {
+	return f.tmpPath == ""
+}
+
+// ParseMultipartForm parses a multipart/form-data body into its fields
+// and files. Files are kept in memory until they exceed the memory
+// limit, the remaining ones are copied to temporary files which
+// [MultipartForm.RemoveAll] removes, so that the form can outlive the
+// body. The limits apply to the parsing of the body already in memory,
+// its size is limited by the server while reading the request.
+func (r *Request) ParseMultipartForm(opts ...MultipartOption) (*MultipartForm, error) {
+	o := DefaultMultipartOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &MultipartForm{Value: url.Values{}, File: map[string][]*FormFile{}}
+	memLeft := o.maxMemory
+	for parts := 0; ; parts++ {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return form, nil
+		}
+		if err == nil && parts >= o.maxParts {
+			err = ErrTooManyParts
+		}
+		if err == nil {
+			memLeft, err = form.add(p, o, memLeft)
+		}
+		if err != nil {
+			_ = form.RemoveAll()
+			return nil, err
+		}
+	}
+}
+
+// add adds the part p to the form, returns the memory left for files.
+func (f *MultipartForm) add(p *multipart.Part, o *MultipartOptions, memLeft int64) (int64, error) {
+	defer p.Close()
+	name := p.FormName()
+	if name == "" {
+		return memLeft, nil
+	}
+	filename := p.FileName()
+	if filename == "" {
+		b, err := io.ReadAll(io.LimitReader(p, o.maxFieldSize+1))
+		if err != nil {
+			return memLeft, err
+		}
+		if int64(len(b)) > o.maxFieldSize {
+			return memLeft, ErrFieldTooLarge
+		}
+		f.Value.Add(name, string(b))
+		return memLeft, nil
+	}
+
+	file := &FormFile{
+		FieldName:   name,
+		Filename:    filename,
+		ContentType: p.Header.Get("Content-Type"),
+		Header:      p.Header,
+	}
+	if file.ContentType == "" {
+		file.ContentType = "application/octet-stream"
+	}
+	// the file is added first so that a failure removes its temporary file.
+	f.File[name] = append(f.File[name], file)
+
+	content := io.LimitReader(p, o.maxFileSize+1)
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, content, max(memLeft, 0)+1)
+	if err != nil && err != io.EOF {
+		return memLeft, err
+	}
+	if n <= memLeft {
+		if n > o.maxFileSize {
+			return memLeft, ErrFileTooLarge
+		}
+		file.content, file.Size = buf.Bytes(), n
+		return memLeft - n, nil
+	}
+
+	tmp, err := os.CreateTemp(o.tempDir, "multipart-")
+	if err != nil {
+		return memLeft, err
+	}
+	file.tmpPath = tmp.Name()
+	m, err := io.Copy(tmp, io.MultiReader(&buf, content))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return memLeft, err
+	}
+	file.Size = m
+	if m > o.maxFileSize {
+		return memLeft, ErrFileTooLarge
+	}
+	return memLeft, nil
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseForm(t *testing.T) {
+	testCases := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+		expected    url.Values
+		wantErr     bool
+	}{
+		{
+			name:        "body and query",
+			target:      "/submit?b=3&c=4",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        "a=1&b=2&a=%C3%A9+x",
+			expected:    url.Values{"a": {"1", "é x"}, "b": {"2", "3"}, "c": {"4"}},
+		},
+		{
+			name:        "other content type ignores the body",
+			target:      "/submit?q=go",
+			contentType: "application/json",
+			body:        `{"a":1}`,
+			expected:    url.Values{"q": {"go"}},
+		},
+		{
+			name:        "malformed body",
+			target:      "/",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "a=%zz",
+			wantErr:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRequest("POST", tc.target)
+			r.Headers.Set("Content-Type", tc.contentType)
+			r.Body = []byte(tc.body)
+			got, err := r.ParseForm()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+// multipartRequest returns a request whose multipart/form-data body has
+// the fields, then a part per file named by the keys of files.
+func multipartRequest(t *testing.T, fields map[string]string, files map[string]string) *Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		assert.NoError(t, mw.WriteField(k, v))
+	}
+	for name, content := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="upload"; filename="../../`+name+`"`)
+		if strings.HasSuffix(name, ".txt") {
+			h.Set("Content-Type", "text/plain")
+		}
+		pw, err := mw.CreatePart(h)
+		assert.NoError(t, err)
+		_, _ = pw.Write([]byte(content))
+	}
+	assert.NoError(t, mw.Close())
+
+	r := NewRequest("POST", "/upload")
+	r.Headers.Set("Content-Type", mw.FormDataContentType())
+	r.Body = body.Bytes()
+	return r
+}
+
+func TestParseMultipartForm(t *testing.T) {
+	dir := t.TempDir()
+	r := multipartRequest(t,
+		map[string]string{"title": "report"},
+		map[string]string{"small.txt": "hello", "big.bin": strings.Repeat("x", 100)},
+	)
+
+	form, err := r.ParseMultipartForm(WithMaxMemory(50), WithTempDir(dir))
+	assert.NoError(t, err)
+	assert.Equal(t, url.Values{"title": {"report"}}, form.Value)
+	assert.Len(t, form.File["upload"], 2)
+
+	files := map[string]*FormFile{}
+	for _, f := range form.File["upload"] {
+		files[f.Filename] = f
+	}
+	small, big := files["small.txt"], files["big.bin"]
+	assert.NotNil(t, small)
+	assert.NotNil(t, big)
+
+	assert.True(t, small.InMemory())
+	assert.Equal(t, "text/plain", small.ContentType)
+	assert.Equal(t, int64(5), small.Size)
+
+	assert.False(t, big.InMemory())
+	assert.Equal(t, "application/octet-stream", big.ContentType)
+	assert.Equal(t, int64(100), big.Size)
+	rc, err := big.Open()
+	assert.NoError(t, err)
+	b, _ := io.ReadAll(rc)
+	_ = rc.Close()
+	assert.Equal(t, strings.Repeat("x", 100), string(b))
+
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 1)
+	assert.NoError(t, form.RemoveAll())
+	entries, _ = os.ReadDir(dir)
+	assert.Empty(t, entries)
+}
+
+func TestParseMultipartFormLimits(t *testing.T) {
+	testCases := []struct {
+		name     string
+		fields   map[string]string
+		files    map[string]string
+		opts     []MultipartOption
+		expected error
+	}{
+		{
+			name:     "file too large in memory",
+			files:    map[string]string{"a.bin": strings.Repeat("x", 20)},
+			opts:     []MultipartOption{WithMaxFileSize(10)},
+			expected: ErrFileTooLarge,
+		},
+		{
+			name:     "file too large on disk",
+			files:    map[string]string{"a.bin": strings.Repeat("x", 20)},
+			opts:     []MultipartOption{WithMaxFileSize(10), WithMaxMemory(5)},
+			expected: ErrFileTooLarge,
+		},
+		{
+			name:     "field too large",
+			fields:   map[string]string{"a": "0123456789"},
+			opts:     []MultipartOption{WithMaxFieldSize(5)},
+			expected: ErrFieldTooLarge,
+		},
+		{
+			name:     "too many parts",
+			fields:   map[string]string{"a": "1", "b": "2"},
+			opts:     []MultipartOption{WithMaxParts(1)},
+			expected: ErrTooManyParts,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			r := multipartRequest(t, tc.fields, tc.files)
+			_, err := r.ParseMultipartForm(append(tc.opts, WithTempDir(dir))...)
+			assert.ErrorIs(t, err, tc.expected)
+			entries, _ := os.ReadDir(dir)
+			assert.Empty(t, entries)
+		})
+	}
+
+	r := NewRequest("POST", "/")
+	r.Headers.Set("Content-Type", "application/json")
+	_, err := r.ParseMultipartForm()
+	assert.ErrorIs(t, err, ErrNotMultipart)
+}
@@ -99,14 +99,7 @@ func (h HTTPHeaders) parseHeaderLine(s string) (n int, done bool, err error) {
 		return 0, false, errors.New("malformed header received")
 	}
 
-	key = titleCase(key)
-	v, exists := h.HeadersMap[key]
-	if exists {
-		h.HeadersMap[key] = v + "," + strings.TrimSpace(val)
-	} else {
-		h.HeadersMap[key] = strings.TrimSpace(val)
-
-	}
+	h.Add(key, strings.TrimSpace(val))
 	return consumed, false, nil
 }
 
@@ -133,6 +126,48 @@ func (h HTTPHeaders) Set(name string, val string) {
 	h.HeadersMap[titleCase(name)] = val
 }
 
+// Add appends val to the values of a header, combining the field lines
+// into a comma separated list as [RFC 9110 Section 5.3] allows.
+//
+// Set-Cookie field lines cannot be combined ([RFC 6265 Section 3]), so
+// they are kept apart by a newline, which a field value cannot contain,
+// and written back as separate lines by [ResponseWriter.WriteHeaders].
+// Cookie field lines are combined with "; " into a single cookie-string.
+//
+// [RFC 9110 Section 5.3]: https://www.rfc-editor.org/rfc/rfc9110#name-field-order
+// [RFC 6265 Section 3]: https://datatracker.ietf.org/doc/html/rfc6265#section-3
+func (h HTTPHeaders) Add(name string, val string) {
+	key := titleCase(name)
+	prior, exists := h.HeadersMap[key]
+	if !exists {
+		h.HeadersMap[key] = val
+		return
+	}
+	sep := ","
+	switch key {
+	case "Set-Cookie":
+		sep = NEWLINE
+	case "Cookie":
+		sep = "; "
+	}
+	h.HeadersMap[key] = prior + sep + val
+}
+
+// Values returns the field lines of a header kept apart by [HTTPHeaders.Add],
+// which are the Set-Cookie ones, or the combined value of any other header.
+// Writers of the header section go through Values so that every Set-Cookie
+// field gets a line of its own.
+func (h HTTPHeaders) Values(name string) []string {
+	v, exists := h.HeadersMap[titleCase(name)]
+	if !exists {
+		return nil
+	}
+	if titleCase(name) != "Set-Cookie" {
+		return []string{v}
+	}
+	return strings.Split(v, NEWLINE)
+}
+
 // Replace updates the value of a header, assuming it already exists.
 func (h HTTPHeaders) Replace(name string, val string) {
 	h.HeadersMap[titleCase(name)] = val
@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AcceptSpec is a member of an Accept, Accept-Language, Accept-Charset
+// or Accept-Encoding header.
+type AcceptSpec struct {
+	// Value is the lower-cased media range, language range, charset or
+	// content coding, e.g. "text/*".
+	Value string
+	// Q is the weight of the member, from 0 to 1.
+	Q float64
+	// Params holds the media type parameters other than the weight.
+	Params map[string]string
+}
+
+// ParseAccept parses the members of an Accept-family header, ranked from
+// the most to the least preferred. Members of equal weight are ranked
+// from the most to the least specific, then in the order they are sent.
+//
+// A weight that is not a valid qvalue is read as 0, see
+// [RFC 9110 Section 12.4.2].
+//
+// [RFC 9110 Section 12.4.2]: https://www.rfc-editor.org/rfc/rfc9110#name-quality-values
+func ParseAccept(v string) []AcceptSpec {
+	var specs []AcceptSpec
+	for _, member := range splitQuoted(v, ',') {
+		params := splitQuoted(member, ';')
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+		spec := AcceptSpec{Value: value, Q: 1, Params: map[string]string{}}
+		for _, p := range params[1:] {
+			name, pv, _ := strings.Cut(p, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			pv = strings.TrimSpace(pv)
+			if name == "q" {
+				spec.Q = parseQValue(pv)
+				// parameters after the weight are accept-ext.
+				break
+			}
+			if name != "" {
+				spec.Params[name] = unquote(pv)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	sort.SliceStable(specs, func(i, j int) bool {
+		if specs[i].Q != specs[j].Q {
+			return specs[i].Q > specs[j].Q
+		}
+		return specs[i].specificity() > specs[j].specificity()
+	})
+	return specs
+}
+
+// specificity ranks "*" and "*/*" below "type/*", below a value, below
+// a value with parameters.
+func (s AcceptSpec) specificity() int {
+	switch {
+	case s.Value == "*" || s.Value == "*/*":
+		return 0
+	case strings.HasSuffix(s.Value, "/*"):
+		return 1
+	}
+	return 2 + len(s.Params)
+}
+
+// parseQValue parses a qvalue, returns 0 if it is invalid.
+//
+//	qvalue = ( "0" [ "." 0*3DIGIT ] )
+//	       / ( "1" [ "." 0*3("0") ] )
+func parseQValue(v string) float64 {
+	if v == "" || len(v) > 5 || (v[0] != '0' && v[0] != '1') {
+		return 0
+	}
+	q, err := strconv.ParseFloat(v, 64)
+	if err != nil || q < 0 || q > 1 {
+		return 0
+	}
+	return q
+}
+
+// splitQuoted splits s around sep, ignoring the separators inside
+// quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped, start := false, false, 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unquote removes the quotes and the escapes of a quoted-string.
+func unquote(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var b strings.Builder
+	for i := 1; i < len(v)-1; i++ {
+		if v[i] == '\\' && i+1 < len(v)-1 {
+			i++
+		}
+		b.WriteByte(v[i])
+	}
+	return b.String()
+}
+
+// Negotiate returns the media type among offers that the Accept header
+// of r prefers, following [RFC 9110 Section 12.5.1]. The weight of an
+// offer is given by the most specific media range matching it, ties are
+// won by the offer listed first. Without an Accept header the first
+// offer is returned, "" is returned if no offer is acceptable.
+//
+// [RFC 9110 Section 12.5.1]: https://www.rfc-editor.org/rfc/rfc9110#name-accept
+func (r *Request) Negotiate(offers ...string) string {
+	return negotiate(r.GetHeader("Accept"), offers, matchMediaRange)
+}
+
+// NegotiateLanguage returns the language tag among offers that the
+// Accept-Language header of r prefers, matching the language ranges
+// with the basic filtering of [RFC 4647 Section 3.3.1], see
+// [RFC 9110 Section 12.5.4].
+//
+// [RFC 4647 Section 3.3.1]: https://www.rfc-editor.org/rfc/rfc4647#section-3.3.1
+// [RFC 9110 Section 12.5.4]: https://www.rfc-editor.org/rfc/rfc9110#name-accept-language
+func (r *Request) NegotiateLanguage(offers ...string) string {
+	return negotiate(r.GetHeader("Accept-Language"), offers, matchLanguageRange)
+}
+
+// NegotiateCharset returns the charset among offers that the
+// Accept-Charset header of r prefers, see [RFC 9110 Section 12.5.2].
+//
+// [RFC 9110 Section 12.5.2]: https://www.rfc-editor.org/rfc/rfc9110#name-accept-charset
+func (r *Request) NegotiateCharset(offers ...string) string {
+	return negotiate(r.GetHeader("Accept-Charset"), offers, func(spec AcceptSpec, offer string) (int, bool) {
+		if spec.Value == "*" {
+			return 0, true
+		}
+		return 1, spec.Value == strings.ToLower(offer)
+	})
+}
+
+// negotiate returns the offer with the highest weight in the header,
+// the weight of an offer being the one of the most specific member
+// match accepts for it.
+func negotiate(header string, offers []string, match func(spec AcceptSpec, offer string) (int, bool)) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	if strings.TrimSpace(header) == "" {
+		return offers[0]
+	}
+	specs := ParseAccept(header)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q, specificity := 0.0, -1
+		for _, spec := range specs {
+			if s, ok := match(spec, offer); ok && s > specificity {
+				q, specificity = spec.Q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// matchMediaRange reports whether the media range of spec matches the
+// media type offer, including all of its parameters.
+func matchMediaRange(spec AcceptSpec, offer string) (int, bool) {
+	mediaType, params, _ := strings.Cut(offer, ";")
+	typ, subtype, _ := strings.Cut(strings.ToLower(strings.TrimSpace(mediaType)), "/")
+	rangeType, rangeSubtype, _ := strings.Cut(spec.Value, "/")
+	switch {
+	case rangeType == "*" && rangeSubtype == "*":
+	case rangeType == typ && rangeSubtype == "*":
+	case rangeType == typ && rangeSubtype == subtype:
+	default:
+		return 0, false
+	}
+	if len(spec.Params) > 0 {
+		offered := map[string]string{}
+		for _, p := range splitQuoted(params, ';') {
+			name, v, _ := strings.Cut(p, "=")
+			offered[strings.ToLower(strings.TrimSpace(name))] = unquote(strings.TrimSpace(v))
+		}
+		for name, v := range spec.Params {
+			if !strings.EqualFold(offered[name], v) {
+				return 0, false
+			}
+		}
+	}
+	return spec.specificity(), true
+}
+
+// matchLanguageRange reports whether the language range of spec matches
+// the language tag offer, longer ranges being more specific.
+func matchLanguageRange(spec AcceptSpec, offer string) (int, bool) {
+	if spec.Value == "*" {
+		return 0, true
+	}
+	tag := strings.ToLower(offer)
+	if tag == spec.Value || strings.HasPrefix(tag, spec.Value+"-") {
+		return len(spec.Value), true
+	}
+	return 0, false
+}
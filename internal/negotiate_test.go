@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccept(t *testing.T) {
+	specs := ParseAccept(`text/*;q=0.3, text/html;q=0.7, text/html;level=1, text/html;level=2;q=0.4, */*;q=0.5, application/json;q=bogus, text/plain;format="a,b"`)
+	var values []string
+	for _, s := range specs {
+		values = append(values, s.Value)
+	}
+	assert.Equal(t, []string{"text/html", "text/plain", "text/html", "*/*", "text/html", "text/*", "application/json"}, values)
+	assert.Equal(t, map[string]string{"level": "1"}, specs[0].Params)
+	assert.Equal(t, map[string]string{"format": "a,b"}, specs[1].Params)
+	assert.Equal(t, 0.7, specs[2].Q)
+	assert.Equal(t, 0.0, specs[6].Q)
+
+	assert.Empty(t, ParseAccept(""))
+	assert.Equal(t, []AcceptSpec{{Value: "gzip", Q: 1, Params: map[string]string{}}}, ParseAccept(" , GZIP ,"))
+}
+
+func TestNegotiate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		accept   string
+		offers   []string
+		expected string
+	}{
+		{
+			name:     "no accept header",
+			offers:   []string{"text/html", "application/json"},
+			expected: "text/html",
+		},
+		{
+			name:     "exact",
+			accept:   "application/json",
+			offers:   []string{"text/html", "application/json"},
+			expected: "application/json",
+		},
+		{
+			name:     "weights",
+			accept:   "text/html;q=0.5, application/json;q=0.9",
+			offers:   []string{"text/html", "application/json"},
+			expected: "application/json",
+		},
+		{
+			name:     "ties go to the first offer",
+			accept:   "application/json, text/html",
+			offers:   []string{"text/html", "application/json"},
+			expected: "text/html",
+		},
+		{
+			name:     "most specific range wins",
+			accept:   "text/*, text/html;q=0",
+			offers:   []string{"text/html", "text/plain"},
+			expected: "text/plain",
+		},
+		{
+			name:     "wildcard",
+			accept:   "*/*;q=0.1, image/png",
+			offers:   []string{"text/html", "image/png"},
+			expected: "image/png",
+		},
+		{
+			name:     "parameters",
+			accept:   "text/html;level=1, text/html;q=0.1",
+			offers:   []string{"text/html;level=2", "text/html;level=1"},
+			expected: "text/html;level=1",
+		},
+		{
+			name:     "browser accept",
+			accept:   "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			offers:   []string{"application/json", "text/html"},
+			expected: "text/html",
+		},
+		{
+			name:   "nothing acceptable",
+			accept: "image/*",
+			offers: []string{"text/html", "application/json"},
+		},
+		{
+			name:   "no offers",
+			accept: "*/*",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRequest("GET", "/")
+			if tc.accept != "" {
+				r.Headers.Set("Accept", tc.accept)
+			}
+			assert.Equal(t, tc.expected, r.Negotiate(tc.offers...))
+		})
+	}
+}
+
+func TestNegotiateLanguageAndCharset(t *testing.T) {
+	r := NewRequest("GET", "/")
+	assert.Equal(t, "en", r.NegotiateLanguage("en", "fr"))
+
+	r.Headers.Set("Accept-Language", "fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5")
+	assert.Equal(t, "fr-CH", r.NegotiateLanguage("en-US", "fr", "fr-CH"))
+	assert.Equal(t, "fr-FR", r.NegotiateLanguage("en-US", "fr-FR"))
+	assert.Equal(t, "en-US", r.NegotiateLanguage("en-US", "de"))
+	assert.Equal(t, "ja", r.NegotiateLanguage("ja"))
+
+	r.Headers.Set("Accept-Language", "en, *;q=0")
+	assert.Equal(t, "", r.NegotiateLanguage("ja"))
+
+	r.Headers.Set("Accept-Charset", "iso-8859-5, UTF-8;q=0.8")
+	assert.Equal(t, "ISO-8859-5", r.NegotiateCharset("utf-8", "ISO-8859-5"))
+	assert.Equal(t, "", r.NegotiateCharset("us-ascii"))
+}
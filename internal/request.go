@@ -1,8 +1,11 @@
 package internal
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"unicode"
 )
@@ -21,6 +24,32 @@ type Request struct {
 	Headers       HTTPHeaders
 	ContentLength int
 	Body          []byte
+	// RemoteAddr is the network address of the client that sent the
+	// request, set by the server.
+	RemoteAddr string
+	ctx        context.Context
+}
+
+// Context returns the context of the request. The server cancels it
+// when the client closes the connection, the server is closed or the
+// handler returns, it is [context.Background] otherwise.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r whose context is ctx, for
+// middleware setting a deadline or deriving values such as the request
+// ID or the authenticated principal into the context.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("nil context")
+	}
+	r2 := *r
+	r2.ctx = ctx
+	return &r2
 }
 
 type RequestLine struct {
@@ -71,8 +100,10 @@ func (r *Request) String() string {
 	builder.WriteString(r.RequestLine.String())
 
 	if r.Headers.HeadersMap != nil {
-		for k, v := range r.Headers.HeadersMap {
-			builder.WriteString(k + ": " + v + CRLFDELIMETER)
+		for k := range r.Headers.HeadersMap {
+			for _, v := range r.Headers.Values(k) {
+				builder.WriteString(k + ": " + v + CRLFDELIMETER)
+			}
 		}
 	}
 
@@ -204,6 +235,72 @@ func ParseRequestLine(s string) (*Request, int, error) {
 
 }
 
+// ErrBodyTooLarge is returned by [ReadRequestLimit] when the body of a
+// request exceeds the limit.
+var ErrBodyTooLarge = errors.New("request body exceeds the maximum size")
+
+// ReadRequest reads a complete request including its body from br,
+// returns [*Request] and error if any.
+//
+// Unlike [MessageFromReader] it never reads past the end of the request,
+// so further requests sent on the same connection stay in br. The body
+// is framed by the chunked transfer coding or the [Content-Length], a
+// request with neither has no body, see [RFC 9112 Section 6.3].
+//
+// [RFC 9112 Section 6.3]: https://datatracker.ietf.org/doc/html/rfc9112#name-message-body-length
+func ReadRequest(br *bufio.Reader) (*Request, error) {
+	return ReadRequestLimit(br, 0)
+}
+
+// ReadRequestLimit is like [ReadRequest] but fails with [ErrBodyTooLarge]
+// when the body is longer than max bytes, 0 meaning no limit. A request
+// whose Content-Length exceeds max is rejected before its body is read,
+// a chunked one as soon as it exceeds max, so that at most max bytes of
+// body are held in memory.
+func ReadRequestLimit(br *bufio.Reader, max int64) (*Request, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := ParseRequestLine(line)
+	if err != nil {
+		return nil, err
+	}
+	if err := readHeaders(br, r.Headers); err != nil {
+		return nil, err
+	}
+
+	var body io.Reader
+	if r.Headers.Get("Transfer-Encoding") != "" {
+		if !isChunked(r.Headers) {
+			return nil, errors.New("unsupported transfer-encoding received")
+		}
+		body = NewChunkedReader(br)
+	} else {
+		cl, _, err := parseContentLength(r.Headers)
+		if err != nil {
+			return nil, err
+		}
+		if max > 0 && cl > max {
+			return nil, ErrBodyTooLarge
+		}
+		body = newLimitedBodyReader(br, cl)
+	}
+	if max > 0 {
+		body = io.LimitReader(body, max+1)
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && int64(len(b)) > max {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body = b
+	r.ContentLength = len(b)
+	return r, nil
+}
+
 // isMethod checks whether the given request method is case-sensitive and alphabetic.
 func isMethod(m string) bool {
 	for _, v := range m {
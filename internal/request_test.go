@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -35,6 +36,16 @@ func TestRequestString(t *testing.T) {
 				"hello world!\n"},
 		},
 	}
+	fieldLines := NewRequest("GET", "/")
+	fieldLines.Headers.Add("Set-Cookie", "a=1")
+	fieldLines.Headers.Add("Set-Cookie", "b=2")
+	testCases = append(testCases, struct {
+		input    *Request
+		expected []string
+	}{
+		input:    fieldLines,
+		expected: []string{"Set-Cookie: a=1\r\nSet-Cookie: b=2\r\n"},
+	})
 	for _, tc := range testCases {
 		got := tc.input.String()
 		for _, exp := range tc.expected {
@@ -132,3 +143,15 @@ func TestParseRequestLineReturnsError(t *testing.T) {
 
 	}
 }
+
+func TestRequestWithContext(t *testing.T) {
+	r := NewRequest("GET", "/")
+	assert.Equal(t, context.Background(), r.Context())
+
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "id")
+	r2 := r.WithContext(ctx)
+	assert.Equal(t, "id", r2.Context().Value(key{}))
+	assert.Nil(t, r.Context().Value(key{}))
+	assert.Equal(t, r.RequestLine, r2.RequestLine)
+}
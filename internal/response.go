@@ -1,10 +1,12 @@
 package internal
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -12,11 +14,92 @@ import (
 type HTTPStatusCode int
 
 const (
+	StatusContinue            HTTPStatusCode = 100
+	StatusSwitchingProtocols  HTTPStatusCode = 101
 	StatusOK                  HTTPStatusCode = 200
+	StatusCreated             HTTPStatusCode = 201
+	StatusAccepted            HTTPStatusCode = 202
+	StatusNoContent           HTTPStatusCode = 204
+	StatusPartialContent      HTTPStatusCode = 206
+	StatusMovedPermanently    HTTPStatusCode = 301
+	StatusFound               HTTPStatusCode = 302
+	StatusSeeOther            HTTPStatusCode = 303
+	StatusNotModified         HTTPStatusCode = 304
+	StatusTemporaryRedirect   HTTPStatusCode = 307
+	StatusPermanentRedirect   HTTPStatusCode = 308
 	StatusBadRequest          HTTPStatusCode = 400
+	StatusUnauthorized        HTTPStatusCode = 401
+	StatusForbidden           HTTPStatusCode = 403
+	StatusNotFound            HTTPStatusCode = 404
+	StatusMethodNotAllowed    HTTPStatusCode = 405
+	StatusNotAcceptable       HTTPStatusCode = 406
+	StatusRequestTimeout      HTTPStatusCode = 408
+	StatusPreconditionFailed  HTTPStatusCode = 412
+	StatusRequestTooLarge     HTTPStatusCode = 413
+	StatusUnsupportedMedia    HTTPStatusCode = 415
+	StatusRangeNotSatisfiable HTTPStatusCode = 416
+	StatusUpgradeRequired     HTTPStatusCode = 426
 	StatusInternalServerError HTTPStatusCode = 500
+	StatusNotImplemented      HTTPStatusCode = 501
+	StatusBadGateway          HTTPStatusCode = 502
+	StatusServiceUnavailable  HTTPStatusCode = 503
+	StatusGatewayTimeout      HTTPStatusCode = 504
 )
 
+// statusText holds the reason phrases recommended by [RFC 9110 Section 15].
+//
+// [RFC 9110 Section 15]: https://www.rfc-editor.org/rfc/rfc9110#name-status-codes
+var statusText = map[HTTPStatusCode]string{
+	StatusContinue:            "Continue",
+	StatusSwitchingProtocols:  "Switching Protocols",
+	StatusOK:                  "OK",
+	StatusCreated:             "Created",
+	StatusAccepted:            "Accepted",
+	StatusNoContent:           "No Content",
+	StatusPartialContent:      "Partial Content",
+	StatusMovedPermanently:    "Moved Permanently",
+	StatusFound:               "Found",
+	StatusSeeOther:            "See Other",
+	StatusNotModified:         "Not Modified",
+	StatusTemporaryRedirect:   "Temporary Redirect",
+	StatusPermanentRedirect:   "Permanent Redirect",
+	StatusBadRequest:          "Bad Request",
+	StatusUnauthorized:        "Unauthorized",
+	StatusForbidden:           "Forbidden",
+	StatusNotFound:            "Not Found",
+	StatusMethodNotAllowed:    "Method Not Allowed",
+	StatusNotAcceptable:       "Not Acceptable",
+	StatusRequestTimeout:      "Request Timeout",
+	StatusPreconditionFailed:  "Precondition Failed",
+	StatusRequestTooLarge:     "Content Too Large",
+	StatusUnsupportedMedia:    "Unsupported Media Type",
+	StatusRangeNotSatisfiable: "Range Not Satisfiable",
+	StatusUpgradeRequired:     "Upgrade Required",
+	StatusInternalServerError: "Internal Server Error",
+	StatusNotImplemented:      "Not Implemented",
+	StatusBadGateway:          "Bad Gateway",
+	StatusServiceUnavailable:  "Service Unavailable",
+	StatusGatewayTimeout:      "Gateway Timeout",
+}
+
+// StatusText returns the reason phrase for the status code,
+// or an empty string if the code is unknown.
+func StatusText(code HTTPStatusCode) string {
+	return statusText[code]
+}
+
+// IsRedirect reports whether the status code asks the client to
+// follow the Location header, see [RFC 9110 Section 15.4].
+//
+// [RFC 9110 Section 15.4]: https://www.rfc-editor.org/rfc/rfc9110#name-redirection-3xx
+func (c HTTPStatusCode) IsRedirect() bool {
+	switch c {
+	case StatusMovedPermanently, StatusFound, StatusSeeOther, StatusTemporaryRedirect, StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
 type Response struct {
 	ResponseLine  ResponseLine
 	Headers       HTTPHeaders
@@ -157,39 +240,217 @@ func ParseResponseLine(s string) (*Response, int, error) {
 
 }
 
+// ReadResponseHead reads the status-line and the header section of a
+// response from br, returns [*Response] without a body and error if any.
+//
+// Unlike [MessageFromReader] it never reads past the end of the header
+// section, so the body can be consumed with [ResponseBodyReader].
+func ReadResponseHead(br *bufio.Reader) (*Response, error) {
+	line, err := readLine(br)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := ParseResponseLine(line)
+	if err != nil {
+		return nil, err
+	}
+	if err := readHeaders(br, resp.Headers); err != nil {
+		return nil, err
+	}
+	cl, ok, err := parseContentLength(resp.Headers)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		resp.ContentLength = int(cl)
+	}
+	return resp, nil
+}
+
+// ResponseBodyReader returns an [io.Reader] for the body of resp,
+// whose head has already been read from br, following the message
+// body length rules of [RFC 9112 Section 6.3]. The method of the
+// request resp answers is needed since responses to HEAD carry no body.
+//
+// [RFC 9112 Section 6.3]: https://datatracker.ietf.org/doc/html/rfc9112#name-message-body-length
+func ResponseBodyReader(br *bufio.Reader, resp *Response, method string) (io.Reader, error) {
+	if !resp.hasBody(method) {
+		return bytes.NewReader(nil), nil
+	}
+	if isChunked(resp.Headers) {
+		return NewChunkedReader(br), nil
+	}
+	if resp.IsCloseDelimited(method) {
+		return br, nil
+	}
+	cl, _, err := parseContentLength(resp.Headers)
+	if err != nil {
+		return nil, err
+	}
+	return newLimitedBodyReader(br, cl), nil
+}
+
+// IsCloseDelimited reports whether the body of the response to a request
+// with the given method ends only when the server closes the connection,
+// in which case the connection cannot be reused for another request.
+func (r *Response) IsCloseDelimited(method string) bool {
+	if !r.hasBody(method) {
+		return false
+	}
+	if r.Headers.Get("Transfer-Encoding") != "" {
+		return !isChunked(r.Headers)
+	}
+	return r.Headers.Get("Content-Length") == ""
+}
+
+// hasBody reports whether a response to a request with the given
+// method can carry a body.
+func (r *Response) hasBody(method string) bool {
+	sc := r.ResponseLine.StatusCode
+	return method != "HEAD" && (sc < 100 || sc >= 200) && sc != 204 && sc != 304
+}
+
+// ReadResponse reads a complete response including its body from br,
+// returns [*Response] and error if any.
+//
+// see also [ReadResponseHead], [ResponseBodyReader]
+func ReadResponse(br *bufio.Reader, method string) (*Response, error) {
+	resp, err := ReadResponseHead(br)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ResponseBodyReader(br, resp, method)
+	if err != nil {
+		return nil, err
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = b
+	if resp.hasBody(method) {
+		resp.ContentLength = len(b)
+	}
+	return resp, nil
+}
+
 type ResponseWriter struct {
 	Writer io.Writer
+	// cookies are the Set-Cookie values added by [ResponseWriter.AddCookie].
+	cookies []string
+	// buf is the buffer of a writer made by [NewBufferedResponseWriter],
+	// it is then Writer too.
+	buf *bufio.Writer
+	// conn is the writer the response is written to once buffered.
+	conn     io.Writer
+	hijacked bool
 }
 
 func NewResponseWriter(w io.Writer) *ResponseWriter {
 	return &ResponseWriter{
 		Writer: w,
+		conn:   w,
 	}
 }
 
+// NewBufferedResponseWriter creates a [ResponseWriter] buffering up to
+// size bytes before writing them to w, so that the status-line, the
+// headers and small chunks are sent together. The buffered bytes are
+// sent by [ResponseWriter.Flush].
+func NewBufferedResponseWriter(w io.Writer, size int) *ResponseWriter {
+	bw := bufio.NewWriterSize(w, size)
+	return &ResponseWriter{
+		Writer: bw,
+		buf:    bw,
+		conn:   w,
+	}
+}
+
+// Flusher is implemented by the writers that buffer data, such as
+// [*bufio.Writer] and [ResponseWriter].
+type Flusher interface {
+	Flush() error
+}
+
+// Flush sends the buffered bytes of the response, for streaming handlers
+// to decide when the client gets the data written so far. A writer that
+// does not buffer passes the flush on to the writer it wraps, if it is a
+// [Flusher], so that it reaches the connection through middleware.
+func (w *ResponseWriter) Flush() error {
+	if w.buf != nil {
+		return w.buf.Flush()
+	}
+	if f, ok := w.Writer.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 func (w *ResponseWriter) Write(p []byte) (int, error) {
+	if w.hijacked {
+		return 0, ErrHijacked
+	}
 	return w.Writer.Write(p)
 }
 
-// WriteStatusLine builds and writes the status line based on the
-// statusCode provided, returns error if any.
-func (w *ResponseWriter) WriteStatusLine(statusCode HTTPStatusCode) error {
-
-	var reasonPhrase string
-	switch statusCode {
-	case StatusOK:
-		reasonPhrase = "HTTP/1.1 200 OK"
+var (
+	// ErrNotHijackable is returned by [ResponseWriter.Hijack] when its
+	// writer is not a connection that can be taken over.
+	ErrNotHijackable = errors.New("connection cannot be hijacked")
+	// ErrHijacked is returned when using a connection that has been
+	// hijacked through the response writer.
+	ErrHijacked = errors.New("connection has been hijacked")
+)
 
-	case StatusBadRequest:
-		reasonPhrase = "HTTP/1.1 400 Bad Request"
+// Hijacker is implemented by the writers handing over the connection a
+// request was read from, such as the one the server passes to handlers.
+type Hijacker interface {
+	Hijack() (net.Conn, *bufio.Reader, error)
+}
 
-	case StatusInternalServerError:
-		reasonPhrase = "HTTP/1.1 500 Internal Server Error"
-	default:
-		reasonPhrase = "HTTP/1.1 500 Internal Server Error"
+// Hijack takes over the connection of the response, for protocols
+// layered on an HTTP/1.1 Upgrade or CONNECT. It returns the connection
+// and the reader the request was parsed from, which holds the bytes the
+// client sent after the request.
+//
+// The server then neither writes to nor closes the connection, which
+// the caller must close. The buffered bytes of the response are flushed
+// first. Hijack returns [ErrNotHijackable] if the writer does not
+// implement [Hijacker], as when a middleware replaced it.
+func (w *ResponseWriter) Hijack() (net.Conn, *bufio.Reader, error) {
+	h, ok := w.conn.(Hijacker)
+	if !ok {
+		return nil, nil, ErrNotHijackable
+	}
+	// the response written before hijacking, such as a 101, goes first.
+	if err := w.Flush(); err != nil {
+		return nil, nil, err
 	}
+	nc, br, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.hijacked = true
+	return nc, br, nil
+}
 
-	_, err := w.Write([]byte(reasonPhrase + "\r\n"))
+// Hijackable reports whether [ResponseWriter.Hijack] may succeed.
+func (w *ResponseWriter) Hijackable() bool {
+	_, ok := w.conn.(Hijacker)
+	return ok
+}
+
+// WriteStatusLine builds and writes the status line based on the
+// statusCode provided, returns error if any.
+//
+// The reason phrase is taken from [StatusText], a status code that is
+// not made of three digits is written as 500 Internal Server Error.
+func (w *ResponseWriter) WriteStatusLine(statusCode HTTPStatusCode) error {
+	if statusCode < 100 || statusCode > 999 {
+		statusCode = StatusInternalServerError
+	}
+	statusLine := fmt.Sprintf("HTTP/%s %d %s\r\n", HTTP_VERSION, statusCode, StatusText(statusCode))
+	_, err := w.Write([]byte(statusLine))
 	return err
 
 }
@@ -203,38 +464,28 @@ func (w *ResponseWriter) WriteStatusLine(statusCode HTTPStatusCode) error {
 func (w *ResponseWriter) WriteHeaders(headers HTTPHeaders) error {
 	hdrs := []byte{}
 
-	for k, v := range headers.HeadersMap {
-		sngleHdr := k + ": " + v + "\r\n"
-		hdrs = append(hdrs, []byte(sngleHdr)...)
+	for k := range headers.HeadersMap {
+		for _, v := range headers.Values(k) {
+			hdrs = append(hdrs, []byte(k+": "+v+"\r\n")...)
+		}
+	}
+	for _, c := range w.cookies {
+		hdrs = append(hdrs, []byte("Set-Cookie: "+c+"\r\n")...)
 	}
+	w.cookies = nil
 	hdrs = append(hdrs, []byte("\r\n")...)
 	_, err := w.Write(hdrs)
 	return err
 
 }
 
-// WriteChunkedBody writes the body in chunks,
+// WriteChunkedBody writes p as a single chunk,
 // returns the number of bytes written and error if any.
+// An empty p writes nothing as it would end the body.
 //
 // see also [WriteChunkedBodyDone]
 func (w *ResponseWriter) WriteChunkedBody(p []byte) (int, error) {
-	var err error
-	trimmed, _ := bytes.CutSuffix(p, []byte("\n"))
-	chunkSize := fmt.Sprintf("%x\r\n", len(trimmed))
-	_, err = w.Write([]byte(chunkSize))
-	if err != nil {
-		return 0, err
-	}
-
-	chunkData := fmt.Sprintf("%s\r\n", trimmed)
-	var n int
-	n, err = w.Write([]byte(chunkData))
-	if err != nil {
-		return 0, err
-	}
-
-	return n, nil
-
+	return NewChunkedWriter(w.Writer).Write(p)
 }
 
 // WriteChunkedBodyDone writes the "0\r\n\r\n",
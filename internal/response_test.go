@@ -3,6 +3,8 @@ package internal
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -130,6 +132,14 @@ func TestWriteStatusLine(t *testing.T) {
 		err := respWriter.WriteStatusLine(tc.input)
 		assert.NoError(t, err)
 	}
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n"+
+		"HTTP/1.1 400 Bad Request\r\n"+
+		"HTTP/1.1 500 Internal Server Error\r\n"+
+		"HTTP/1.1 500 Internal Server Error\r\n", buff.String())
+
+	buff.Reset()
+	assert.NoError(t, respWriter.WriteStatusLine(StatusNotFound))
+	assert.Equal(t, "HTTP/1.1 404 Not Found\r\n", buff.String())
 
 }
 
@@ -163,8 +173,12 @@ func TestWriteChunkedBody(t *testing.T) {
 		_, err := respWriter.WriteChunkedBody([]byte(tc.input))
 		assert.NoError(t, err)
 	}
-	_, err := respWriter.WriteChunkedBodyDone()
+	n, err := respWriter.WriteChunkedBody([]byte("data: x\n\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 9, n)
+	_, err = respWriter.WriteChunkedBodyDone()
 	assert.NoError(t, err)
+	assert.Equal(t, "7\r\nWelcome\r\na\r\nHelloWorld\r\n9\r\ndata: x\n\n\r\n0\r\n\r\n", buff.String())
 
 }
 func TestGetDefaultHeaders(t *testing.T) {
@@ -179,3 +193,70 @@ func TestGetDefaultHeaders(t *testing.T) {
 	}
 
 }
+
+// countingWriter counts the writes reaching it, each one being a
+// syscall on a connection.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.Buffer.Write(p)
+}
+
+func TestBufferedResponseWriter(t *testing.T) {
+	conn := &countingWriter{}
+	w := NewBufferedResponseWriter(conn, 4096)
+	assert.NoError(t, w.WriteStatusLine(StatusOK))
+	assert.NoError(t, w.WriteHeaders(HTTPHeaders{map[string]string{"Transfer-Encoding": "chunked"}}))
+	_, err := w.WriteChunkedBody([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conn.writes)
+
+	assert.NoError(t, w.Flush())
+	assert.Equal(t, 1, conn.writes)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n", conn.String())
+
+	// a middleware writer passes the flush on to the buffered one.
+	inner := NewResponseWriter(w)
+	_, err = inner.WriteChunkedBodyDone()
+	assert.NoError(t, err)
+	assert.NoError(t, inner.Flush())
+	assert.Equal(t, 2, conn.writes)
+	assert.True(t, strings.HasSuffix(conn.String(), "0\r\n\r\n"))
+
+	_, _, err = w.Hijack()
+	assert.ErrorIs(t, err, ErrNotHijackable)
+}
+
+// BenchmarkChunkedResponse writes a response of 100 chunks of 30 bytes,
+// reporting the writes reaching the connection.
+func BenchmarkChunkedResponse(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 30)
+	h := HTTPHeaders{map[string]string{"Transfer-Encoding": "chunked", "Content-Type": "text/plain"}}
+	for _, bc := range []struct {
+		name string
+		new  func(w io.Writer) *ResponseWriter
+	}{
+		{"unbuffered", NewResponseWriter},
+		{"buffered", func(w io.Writer) *ResponseWriter { return NewBufferedResponseWriter(w, 4096) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			conn := &countingWriter{}
+			for i := 0; i < b.N; i++ {
+				conn.Reset()
+				w := bc.new(conn)
+				_ = w.WriteStatusLine(StatusOK)
+				_ = w.WriteHeaders(h)
+				for j := 0; j < 100; j++ {
+					_, _ = w.WriteChunkedBody(chunk)
+				}
+				_, _ = w.WriteChunkedBodyDone()
+				_ = w.Flush()
+			}
+			b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
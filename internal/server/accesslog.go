@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"httpfromtcp/internal"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat is the format of the lines of an access log.
+type AccessLogFormat string
+
+const (
+	// CommonLogFormat is the [Common Log Format] of NCSA and Apache.
+	//
+	// [Common Log Format]: https://httpd.apache.org/docs/current/logs.html#common
+	CommonLogFormat AccessLogFormat = "common"
+	// CombinedLogFormat is the Common Log Format followed by the Referer
+	// and the User-Agent of the request.
+	CombinedLogFormat AccessLogFormat = "combined"
+	// JSONLogFormat writes every attribute of the record as a JSON object.
+	JSONLogFormat AccessLogFormat = "json"
+)
+
+// clfTimeLayout is the layout of the time of the Common Log Format.
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogOptions configures [AccessLog].
+type AccessLogOptions struct {
+	logger *slog.Logger
+	now    func() time.Time
+}
+
+// DefaultAccessLogOptions returns the default options of [AccessLog],
+// which logs to [slog.Default].
+func DefaultAccessLogOptions() *AccessLogOptions {
+	return &AccessLogOptions{now: time.Now}
+}
+
+type AccessLogOption func(*AccessLogOptions)
+
+// WithAccessLogger logs the requests to l, such as a logger returned by
+// [NewAccessLogger].
+func WithAccessLogger(l *slog.Logger) AccessLogOption {
+	return func(opts *AccessLogOptions) {
+		opts.logger = l
+	}
+}
+
+// NewAccessLogger returns a logger writing the records of [AccessLog]
+// to w in format.
+func NewAccessLogger(w io.Writer, format AccessLogFormat) (*slog.Logger, error) {
+	switch format {
+	case CommonLogFormat, CombinedLogFormat:
+		return slog.New(&clfHandler{w: w, combined: format == CombinedLogFormat, mu: &sync.Mutex{}}), nil
+	case JSONLogFormat:
+		return slog.New(slog.NewJSONHandler(w, nil)), nil
+	}
+	return nil, fmt.Errorf("unknown access log format %q", format)
+}
+
+// AccessLog returns a [Middleware] logging a "request" record once the
+// handler returns, with the method, target and protocol of the request,
+// the status and the bytes of the response body as sent, the duration
+// of the handler, the remote address, the User-Agent, the Referer and
+// the request ID.
+//
+// The status of a response whose head was not written is 0. A hijacked
+// connection is logged when the handler returns, with its status, such
+// as 101 Switching Protocols.
+func AccessLog(opts ...AccessLogOption) Middleware {
+	o := DefaultAccessLogOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+	return func(next Handler) Handler {
+		return func(w *internal.ResponseWriter, r *internal.Request) {
+			start := o.now()
+			var status internal.HTTPStatusCode
+			body := &countingWriter{}
+			hi := newHeadInterceptor(func(resp *internal.Response) (io.Writer, error) {
+				status = resp.ResponseLine.StatusCode
+				body.w = w.Writer
+				return body, writeHead(w.Writer, resp.ResponseLine.StatusCode, resp.Headers)
+			})
+			next(internal.NewResponseWriter(&hijackInterceptor{headInterceptor: hi, w: w}), r)
+
+			logger := o.logger
+			if logger == nil {
+				logger = slog.Default()
+			}
+			logger.LogAttrs(r.Context(), slog.LevelInfo, "request",
+				slog.String("method", r.RequestLine.Method),
+				slog.String("target", r.RequestLine.RequestTarget),
+				slog.String("proto", "HTTP/"+r.RequestLine.HttpVersion),
+				slog.Int("status", int(status)),
+				slog.Int64("bytes", body.n),
+				slog.Duration("duration", o.now().Sub(start)),
+				slog.String("remote_addr", r.RemoteAddr),
+				slog.String("user_agent", r.GetHeader("User-Agent")),
+				slog.String("referer", r.GetHeader("Referer")),
+				slog.String("request_id", requestIDOf(r)),
+			)
+		}
+	}
+}
+
+// requestIDOf returns the ID given to r by [RequestID], or the one the
+// client sent.
+func requestIDOf(r *internal.Request) string {
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		return id
+	}
+	return r.GetHeader("X-Request-Id")
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Flush() error {
+	if f, ok := c.w.(internal.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// clfHandler is a [slog.Handler] writing the records of [AccessLog] in
+// the Common or Combined Log Format. Attributes outside of them are
+// left out, groups are ignored.
+type clfHandler struct {
+	w        io.Writer
+	combined bool
+	attrs    []slog.Attr
+	mu       *sync.Mutex
+}
+
+func (h *clfHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo
+}
+
+func (h *clfHandler) Handle(_ context.Context, rec slog.Record) error {
+	fields := map[string]slog.Value{}
+	for _, a := range h.attrs {
+		fields[a.Key] = a.Value
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		fields[a.Key] = a.Value
+		return true
+	})
+	field := func(key string) string {
+		if v, ok := fields[key]; ok {
+			if s := v.String(); s != "" {
+				return s
+			}
+		}
+		return "-"
+	}
+
+	host := field("remote_addr")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	bytes := field("bytes")
+	if bytes == "0" {
+		bytes = "-"
+	}
+	var b strings.Builder
+	b.WriteString(host + " - - [" + rec.Time.Format(clfTimeLayout) + "] ")
+	b.WriteString(strconv.Quote(field("method") + " " + field("target") + " " + field("proto")))
+	b.WriteString(" " + field("status") + " " + bytes)
+	if h.combined {
+		b.WriteString(" " + strconv.Quote(field("referer")) + " " + strconv.Quote(field("user_agent")))
+	}
+	b.WriteString("\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func (h *clfHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)
+	return &h2
+}
+
+func (h *clfHandler) WithGroup(string) slog.Handler {
+	return h
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessLog(t *testing.T) {
+	testCases := []struct {
+		name     string
+		format   AccessLogFormat
+		expected string
+	}{
+		{
+			name:     "common",
+			format:   CommonLogFormat,
+			expected: `192.0.2.1 - - [TIME] "GET /missing?a=1 HTTP/1.1" 404 14` + "\n",
+		},
+		{
+			name:     "combined",
+			format:   CombinedLogFormat,
+			expected: `192.0.2.1 - - [TIME] "GET /missing?a=1 HTTP/1.1" 404 14 "-" "curl/8.0"` + "\n",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := NewAccessLogger(&buf, tc.format)
+			assert.NoError(t, err)
+			r := internal.NewRequest("GET", "/missing?a=1")
+			r.RemoteAddr = "192.0.2.1:51000"
+			r.Headers.Set("User-Agent", "curl/8.0")
+
+			h := AccessLog(WithAccessLogger(logger))(func(w *internal.ResponseWriter, r *internal.Request) {
+				writeStatus(w, internal.StatusNotFound, internal.NewHeaders())
+			})
+			resp := proxyRequest(t, h, r)
+			assert.Equal(t, internal.StatusNotFound, resp.ResponseLine.StatusCode)
+
+			line := buf.String()
+			start, end := strings.Index(line, "["), strings.Index(line, "]")
+			if assert.True(t, start != -1 && end > start, line) {
+				_, err := time.Parse(clfTimeLayout, line[start+1:end])
+				assert.NoError(t, err)
+				line = line[:start+1] + "TIME" + line[end:]
+			}
+			assert.Equal(t, tc.expected, line)
+		})
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewAccessLogger(&buf, JSONLogFormat)
+	assert.NoError(t, err)
+	now := time.Unix(0, 0)
+	clock := func(o *AccessLogOptions) {
+		o.now = func() time.Time {
+			now = now.Add(25 * time.Millisecond)
+			return now
+		}
+	}
+
+	r := internal.NewRequest("POST", "/items")
+	r.RemoteAddr = "192.0.2.1:51000"
+	r.Headers.Set("User-Agent", "curl/8.0")
+	r.Headers.Set("Referer", "https://example.com/")
+	r.Headers.Set("X-Request-Id", "abc")
+	h := AccessLog(WithAccessLogger(logger), clock)(func(w *internal.ResponseWriter, r *internal.Request) {
+		assert.NoError(t, WriteJSON(w, internal.StatusCreated, map[string]int{"id": 1}))
+	})
+	proxyRequest(t, h, r)
+
+	var rec map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal(t, "request", rec["msg"])
+	assert.Equal(t, "POST", rec["method"])
+	assert.Equal(t, "/items", rec["target"])
+	assert.Equal(t, float64(201), rec["status"])
+	assert.Equal(t, float64(len(`{"id":1}`+"\n")), rec["bytes"])
+	assert.Equal(t, float64(25*time.Millisecond), rec["duration"])
+	assert.Equal(t, "192.0.2.1:51000", rec["remote_addr"])
+	assert.Equal(t, "curl/8.0", rec["user_agent"])
+	assert.Equal(t, "https://example.com/", rec["referer"])
+	assert.Equal(t, "abc", rec["request_id"])
+
+	_, err = NewAccessLogger(&buf, "apache")
+	assert.Error(t, err)
+}
+
+func TestAccessLogHijack(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewAccessLogger(&buf, CommonLogFormat)
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	h := AccessLog(WithAccessLogger(logger))(func(w *internal.ResponseWriter, r *internal.Request) {
+		ws, err := Upgrade(w, r)
+		if assert.NoError(t, err) {
+			assert.NoError(t, ws.Close(CloseNormal, ""))
+		}
+	})
+	path := serveUnix(t, func(w *internal.ResponseWriter, r *internal.Request) {
+		defer close(done)
+		h(w, r)
+	})
+
+	conn, err := net.Dial("unix", path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(websocketRequest().String()))
+	assert.NoError(t, err)
+	<-done
+	assert.Contains(t, buf.String(), `"GET /ws HTTP/1.1" 101 -`)
+}
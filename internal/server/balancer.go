@@ -0,0 +1,186 @@
+package server
+
+import (
+	"hash/crc32"
+	"httpfromtcp/internal"
+	"net"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is one of the upstreams a [ReverseProxy] balances requests
+// across.
+type Backend struct {
+	url          *url.URL
+	active       atomic.Int64 // requests in flight
+	fails        atomic.Int64 // consecutive failures
+	unhealthy    atomic.Bool  // the last active health check failed
+	ejectedUntil atomic.Int64 // unix nanoseconds, set by passive ejection
+}
+
+func newBackend(u *url.URL) *Backend {
+	return &Backend{url: u}
+}
+
+// URL returns the URL of the backend.
+func (b *Backend) URL() *url.URL {
+	return b.url
+}
+
+// ActiveRequests returns the number of requests in flight.
+func (b *Backend) ActiveRequests() int64 {
+	return b.active.Load()
+}
+
+// Available reports whether the backend passed its last health check
+// and is not ejected after consecutive failures.
+func (b *Backend) Available() bool {
+	return !b.unhealthy.Load() && time.Now().UnixNano() >= b.ejectedUntil.Load()
+}
+
+// failed records a failed request and ejects the backend for d once
+// maxFails consecutive requests failed.
+func (b *Backend) failed(maxFails int, d time.Duration) {
+	if n := b.fails.Add(1); maxFails > 0 && n >= int64(maxFails) {
+		b.ejectedUntil.Store(time.Now().Add(d).UnixNano())
+		b.fails.Store(0)
+	}
+}
+
+func (b *Backend) succeeded() {
+	b.fails.Store(0)
+}
+
+// setHealthy records the result of an active health check, a passing
+// check ends a passive ejection.
+func (b *Backend) setHealthy(ok bool) {
+	b.unhealthy.Store(!ok)
+	if ok {
+		b.ejectedUntil.Store(0)
+		b.fails.Store(0)
+	}
+}
+
+// Balancer picks the backend serving a request.
+//
+// Next is given every backend of the proxy, in the order they were
+// configured, and must skip the unavailable ones. It returns nil if no
+// backend is available.
+type Balancer interface {
+	Next(backends []*Backend, r *internal.Request) *Backend
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+// RoundRobin returns a [Balancer] cycling through the available backends.
+func RoundRobin() Balancer {
+	return &roundRobin{}
+}
+
+func (rr *roundRobin) Next(backends []*Backend, r *internal.Request) *Backend {
+	n := uint64(len(backends))
+	for range n {
+		b := backends[(rr.next.Add(1)-1)%n]
+		if b.Available() {
+			return b
+		}
+	}
+	return nil
+}
+
+type leastConnections struct{}
+
+// LeastConnections returns a [Balancer] picking the available backend
+// with the fewest requests in flight, the first configured one on ties.
+func LeastConnections() Balancer {
+	return leastConnections{}
+}
+
+func (leastConnections) Next(backends []*Backend, r *internal.Request) *Backend {
+	var best *Backend
+	for _, b := range backends {
+		if b.Available() && (best == nil || b.ActiveRequests() < best.ActiveRequests()) {
+			best = b
+		}
+	}
+	return best
+}
+
+// hashReplicas is the number of points each backend has on the ring.
+const hashReplicas = 128
+
+type ringPoint struct {
+	hash    uint32
+	backend *Backend
+}
+
+type consistentHash struct {
+	header string
+	mu     sync.Mutex
+	// backends are the ones the ring was built from.
+	backends []*Backend
+	ring     []ringPoint // sorted by hash
+}
+
+// ConsistentHash returns a [Balancer] mapping the value of the header,
+// or the client address without it, to a backend on a hash ring. A
+// request keeps its backend while it is available and only the requests
+// of an unavailable backend move to the others. The ring is rebuilt when
+// Next is given a different set of backends.
+func ConsistentHash(header string) Balancer {
+	return &consistentHash{header: header}
+}
+
+func (ch *consistentHash) Next(backends []*Backend, r *internal.Request) *Backend {
+	ring := ch.ringOf(backends)
+	if len(ring) == 0 {
+		return nil
+	}
+
+	key := r.GetHeader(ch.header)
+	if key == "" {
+		key, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	h := hashKey(key)
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= h
+	})
+	for i := range ring {
+		if p := ring[(start+i)%len(ring)]; p.backend.Available() {
+			return p.backend
+		}
+	}
+	return nil
+}
+
+// ringOf returns the ring of backends, building it again if they are
+// not the ones of the current ring.
+func (ch *consistentHash) ringOf(backends []*Backend) []ringPoint {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.ring != nil && slices.Equal(ch.backends, backends) {
+		return ch.ring
+	}
+	ring := make([]ringPoint, 0, len(backends)*hashReplicas)
+	for _, b := range backends {
+		for i := range hashReplicas {
+			ring = append(ring, ringPoint{hash: hashKey(b.url.String() + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	ch.backends, ch.ring = slices.Clone(backends), ring
+	return ring
+}
+
+func hashKey(s string) uint32 {
+	return crc32.ChecksumIEEE([]byte(s))
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"httpfromtcp/internal"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBackends(n int) []*Backend {
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backends[i] = newBackend(&url.URL{Scheme: "http", Host: fmt.Sprintf("10.0.0.%d:80", i+1)})
+	}
+	return backends
+}
+
+func TestRoundRobin(t *testing.T) {
+	backends := testBackends(3)
+	backends[1].setHealthy(false)
+	rr := RoundRobin()
+	r := internal.NewRequest("GET", "/")
+
+	var picked []*Backend
+	for range 4 {
+		picked = append(picked, rr.Next(backends, r))
+	}
+	assert.Equal(t, []*Backend{backends[0], backends[2], backends[0], backends[2]}, picked)
+
+	backends[0].setHealthy(false)
+	backends[2].setHealthy(false)
+	assert.Nil(t, rr.Next(backends, r))
+}
+
+func TestLeastConnections(t *testing.T) {
+	backends := testBackends(3)
+	backends[0].active.Store(2)
+	backends[1].active.Store(1)
+	backends[2].active.Store(1)
+	lc := LeastConnections()
+	r := internal.NewRequest("GET", "/")
+
+	assert.Equal(t, backends[1], lc.Next(backends, r))
+	backends[1].failed(1, time.Minute)
+	assert.Equal(t, backends[2], lc.Next(backends, r))
+}
+
+func TestConsistentHash(t *testing.T) {
+	backends := testBackends(4)
+	ch := ConsistentHash("X-User")
+
+	request := func(user string) *internal.Request {
+		r := internal.NewRequest("GET", "/")
+		r.Headers.Set("X-User", user)
+		return r
+	}
+	assigned := make(map[string]*Backend)
+	used := make(map[*Backend]bool)
+	for i := range 100 {
+		user := fmt.Sprintf("user-%d", i)
+		assigned[user] = ch.Next(backends, request(user))
+		used[assigned[user]] = true
+		assert.Equal(t, assigned[user], ch.Next(backends, request(user)))
+	}
+	assert.Len(t, used, len(backends))
+
+	// only the users of the unavailable backend move.
+	down := assigned["user-0"]
+	down.setHealthy(false)
+	for user, b := range assigned {
+		got := ch.Next(backends, request(user))
+		if b == down {
+			assert.NotEqual(t, down, got)
+		} else {
+			assert.Equal(t, b, got)
+		}
+	}
+
+	// without the header the client address is hashed.
+	r := internal.NewRequest("GET", "/")
+	r.RemoteAddr = "192.0.2.1:1234"
+	first := ch.Next(backends, r)
+	r.RemoteAddr = "192.0.2.1:5678"
+	assert.Equal(t, first, ch.Next(backends, r))
+
+	// a different set of backends gets a ring of its own.
+	others := testBackends(6)[4:]
+	for i := range 20 {
+		assert.Contains(t, others, ch.Next(others, request(fmt.Sprintf("user-%d", i))))
+	}
+}
+
+func TestPassiveEjection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	assert.NoError(t, ln.Close())
+
+	p, err := NewReverseProxy("http://"+addr, WithPassiveEjection(2, time.Minute))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	codes := make([]internal.HTTPStatusCode, 3)
+	for i := range codes {
+		codes[i] = proxyRequest(t, p.Handle, internal.NewRequest("GET", "/")).ResponseLine.StatusCode
+	}
+	assert.Equal(t, []internal.HTTPStatusCode{internal.StatusBadGateway, internal.StatusBadGateway, internal.StatusServiceUnavailable}, codes)
+	assert.False(t, p.Backends()[0].Available())
+}
+
+// hangingUpstream accepts the connections but never answers.
+func hangingUpstream(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				_ = conn.Close()
+			}
+		}()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestPassiveEjectionIgnoresCancelledRequests(t *testing.T) {
+	p, err := NewReverseProxy(hangingUpstream(t), WithPassiveEjection(1, time.Minute))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	for range 3 {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(10*time.Millisecond, cancel)
+		proxyRequest(t, p.Handle, internal.NewRequest("GET", "/").WithContext(ctx))
+	}
+	assert.True(t, p.Backends()[0].Available())
+}
+
+func TestPassiveEjectionCountsExpiredDeadlines(t *testing.T) {
+	p, err := NewReverseProxy(hangingUpstream(t), WithPassiveEjection(1, time.Minute))
+	assert.NoError(t, err)
+	defer p.Close()
+
+	resp := proxyRequest(t, Timeout(10*time.Millisecond)(p.Handle), internal.NewRequest("GET", "/"))
+	assert.Equal(t, internal.StatusGatewayTimeout, resp.ResponseLine.StatusCode)
+	assert.False(t, p.Backends()[0].Available())
+}
+
+// healthServer answers every request with the status stored in status.
+func healthServer(t *testing.T, status *atomic.Int32) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := internal.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 %d Status\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status.Load())
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestHealthCheck(t *testing.T) {
+	var status1, status2 atomic.Int32
+	status1.Store(200)
+	status2.Store(503)
+	p, err := NewBalancedProxy(
+		[]string{healthServer(t, &status1), healthServer(t, &status2)},
+		WithHealthCheck("/healthz", 10*time.Millisecond, time.Second),
+	)
+	assert.NoError(t, err)
+	defer p.Close()
+
+	backends := p.Backends()
+	assert.Eventually(t, func() bool {
+		return backends[0].Available() && !backends[1].Available()
+	}, time.Second, 5*time.Millisecond)
+
+	status2.Store(204)
+	assert.Eventually(t, backends[1].Available, time.Second, 5*time.Millisecond)
+
+	status1.Store(500)
+	assert.Eventually(t, func() bool {
+		return !backends[0].Available()
+	}, time.Second, 5*time.Millisecond)
+
+	r := internal.NewRequest("GET", "/")
+	assert.Equal(t, internal.HTTPStatusCode(204), proxyRequest(t, p.Handle, r).ResponseLine.StatusCode)
+}
@@ -0,0 +1,537 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"httpfromtcp/internal"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// heuristicStatus are the status codes cacheable by default, whose
+// responses may be given a heuristic freshness lifetime, see
+// [RFC 9110 Section 15.1]. 206 is left out as partial content is not
+// stored.
+//
+// [RFC 9110 Section 15.1]: https://www.rfc-editor.org/rfc/rfc9110#name-overview-of-status-codes
+var heuristicStatus = map[internal.HTTPStatusCode]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+type CacheOptions struct {
+	store        CacheStore
+	maxEntrySize int64
+	now          func() time.Time
+}
+
+// Cache is a shared cache of the responses to GET requests following
+// [RFC 9111], meant to sit in front of a proxy handler.
+//
+// Responses are stored unless Cache-Control forbids it and served as
+// long as they are fresh. Stale responses are revalidated with a
+// conditional request when they carry an ETag or a Last-Modified date.
+// Every response to a GET or HEAD request gets an X-Cache header, HIT if
+// it was served from the cache and MISS otherwise, and cached responses
+// get an Age header.
+//
+// [RFC 9111]: https://www.rfc-editor.org/rfc/rfc9111
+type Cache struct {
+	opts *CacheOptions
+}
+
+// DefaultCacheOptions stores up to 64MiB in memory, responses larger than
+// 8MiB are not stored.
+func DefaultCacheOptions() *CacheOptions {
+	return &CacheOptions{
+		store:        NewMemoryStore(64 << 20),
+		maxEntrySize: 8 << 20,
+		now:          time.Now,
+	}
+}
+
+type CacheOption func(*CacheOptions)
+
+// WithCacheStore sets where the responses are stored, e.g. a
+// [MemoryStore] or a [DiskStore].
+func WithCacheStore(s CacheStore) CacheOption {
+	return func(opts *CacheOptions) {
+		opts.store = s
+	}
+}
+
+// WithMaxEntrySize sets the size of the largest body stored.
+func WithMaxEntrySize(n int64) CacheOption {
+	return func(opts *CacheOptions) {
+		opts.maxEntrySize = n
+	}
+}
+
+// NewCache creates a new Cache with options provided.
+func NewCache(opts ...CacheOption) *Cache {
+	o := DefaultCacheOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return &Cache{opts: o}
+}
+
+// Middleware is the [Middleware] serving the responses of next from
+// the cache.
+func (c *Cache) Middleware(next Handler) Handler {
+	return func(w *internal.ResponseWriter, r *internal.Request) {
+		method := r.RequestLine.Method
+		if method != "GET" && method != "HEAD" {
+			// unsafe methods invalidate the stored responses,
+			// see RFC 9111 Section 4.4.
+			if method != "OPTIONS" && method != "TRACE" && method != "CONNECT" {
+				c.opts.store.Delete(cacheKey(r))
+			}
+			next(w, r)
+			return
+		}
+
+		reqCC := parseCacheControl(r.GetHeader("Cache-Control"))
+		if _, ok := reqCC["no-store"]; ok {
+			c.fetch(next, w, r, r, "", nil, -1)
+			return
+		}
+
+		key := cacheKey(r)
+		entries, _ := c.opts.store.Get(key)
+		idx := matchVariant(entries, r)
+		if idx >= 0 {
+			e := entries[idx]
+			if c.usable(e, r, reqCC) {
+				c.serve(w, r, e)
+				return
+			}
+			if h := e.header(); h.Get("ETag") != "" || h.Get("Last-Modified") != "" {
+				c.fetch(next, w, r, conditionalRequest(r, h), key, entries, idx)
+				return
+			}
+		}
+		if _, ok := reqCC["only-if-cached"]; ok {
+			writeProxyError(w, internal.StatusGatewayTimeout, errors.New("no cached response for only-if-cached request"))
+			return
+		}
+		c.fetch(next, w, r, r, key, entries, idx)
+	}
+}
+
+// fetch passes out, the request r or its conditional version, to next
+// and relays the response to w while recording it. An empty key does
+// not store the response.
+//
+// A 304 response to the conditional request is not relayed, it
+// refreshes the stored entries[idx] which is served instead.
+func (c *Cache) fetch(next Handler, w *internal.ResponseWriter, r, out *internal.Request, key string, entries []*CacheEntry, idx int) {
+	reqTime := c.opts.now()
+	var notModified *internal.Response
+	var stored *internal.Response
+	rec := &bodyRecorder{max: c.opts.maxEntrySize}
+
+	hi := newHeadInterceptor(func(resp *internal.Response) (io.Writer, error) {
+		code := resp.ResponseLine.StatusCode
+		if code == internal.StatusNotModified && idx >= 0 && out != r {
+			notModified = resp
+			return io.Discard, nil
+		}
+		resp.Headers.Set("X-Cache", "MISS")
+		if err := writeHead(w.Writer, code, resp.Headers); err != nil {
+			return nil, err
+		}
+		if key == "" || r.RequestLine.Method != "GET" || !storable(r, resp) {
+			return w.Writer, nil
+		}
+		stored = resp
+		return &teeWriter{w: w.Writer, rec: rec}, nil
+	})
+	next(internal.NewResponseWriter(hi), out)
+	now := c.opts.now()
+
+	switch {
+	case notModified != nil:
+		e := refresh(entries[idx], notModified, reqTime, now)
+		c.opts.store.Set(key, replaceVariant(entries, e))
+		c.serve(w, r, e)
+	case stored != nil && !rec.overflow:
+		e := newCacheEntry(r, stored, rec.buf.Bytes(), reqTime, now)
+		if e == nil {
+			return
+		}
+		if freshnessLifetime(e) > 0 || e.Headers["Etag"] != "" || e.Headers["Last-Modified"] != "" {
+			c.opts.store.Set(key, replaceVariant(entries, e))
+		}
+	}
+}
+
+// serve writes the stored response e to w, or a 304 response if the
+// request r is a conditional request that e satisfies.
+func (c *Cache) serve(w *internal.ResponseWriter, r *internal.Request, e *CacheEntry) {
+	h := e.header()
+	h.Set("Age", strconv.FormatInt(int64(currentAge(e, c.opts.now())/time.Second), 10))
+	h.Set("X-Cache", "HIT")
+
+	code := e.StatusCode
+	if code == internal.StatusOK && notModified(r, h.Get("ETag"), h.Get("Last-Modified")) {
+		code = internal.StatusNotModified
+		h.Delete("Content-Length")
+		h.Delete("Transfer-Encoding")
+	}
+	if err := writeHead(w.Writer, code, h); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
+		return
+	}
+	if code == internal.StatusNotModified || r.RequestLine.Method == "HEAD" {
+		return
+	}
+	if _, err := w.Write(e.Body); err != nil {
+		slog.Error("error writing the body to the connection", "err", err)
+	}
+}
+
+// usable reports whether e may be served to r without revalidation,
+// see [RFC 9111 Section 4.2] and the request directives of
+// [RFC 9111 Section 5.2.1].
+//
+// [RFC 9111 Section 4.2]: https://www.rfc-editor.org/rfc/rfc9111#name-freshness
+// [RFC 9111 Section 5.2.1]: https://www.rfc-editor.org/rfc/rfc9111#name-request-directives
+func (c *Cache) usable(e *CacheEntry, r *internal.Request, reqCC map[string]string) bool {
+	respCC := parseCacheControl(e.Headers["Cache-Control"])
+	_, reqNoCache := reqCC["no-cache"]
+	if r.GetHeader("Cache-Control") == "" && strings.Contains(strings.ToLower(r.GetHeader("Pragma")), "no-cache") {
+		reqNoCache = true
+	}
+	if _, ok := respCC["no-cache"]; ok || reqNoCache {
+		return false
+	}
+
+	age := currentAge(e, c.opts.now())
+	lifetime := freshnessLifetime(e)
+	if maxAge, ok := ccSeconds(reqCC, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := ccSeconds(reqCC, "min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	if age < lifetime {
+		return true
+	}
+
+	for _, d := range []string{"must-revalidate", "proxy-revalidate", "s-maxage"} {
+		if _, ok := respCC[d]; ok {
+			return false
+		}
+	}
+	v, ok := reqCC["max-stale"]
+	if !ok {
+		return false
+	}
+	if v == "" {
+		return true
+	}
+	maxStale, ok := ccSeconds(reqCC, "max-stale")
+	return ok && age-lifetime <= maxStale
+}
+
+// storable reports whether the response to r may be stored by a shared
+// cache, see [RFC 9111 Section 3].
+//
+// [RFC 9111 Section 3]: https://www.rfc-editor.org/rfc/rfc9111#name-storing-responses-in-caches
+func storable(r *internal.Request, resp *internal.Response) bool {
+	code := resp.ResponseLine.StatusCode
+	if code < 200 || code == internal.StatusPartialContent || code == internal.StatusNotModified {
+		return false
+	}
+	cc := parseCacheControl(resp.GetHeader("Cache-Control"))
+	for _, d := range []string{"no-store", "private"} {
+		if _, ok := cc[d]; ok {
+			return false
+		}
+	}
+	if strings.TrimSpace(resp.GetHeader("Vary")) == "*" {
+		return false
+	}
+	_, public := cc["public"]
+	_, sMaxAge := cc["s-maxage"]
+	_, mustRevalidate := cc["must-revalidate"]
+	if r.GetHeader("Authorization") != "" && !public && !sMaxAge && !mustRevalidate {
+		return false
+	}
+	_, maxAge := cc["max-age"]
+	explicit := public || sMaxAge || maxAge || resp.GetHeader("Expires") != ""
+	return explicit || heuristicStatus[code]
+}
+
+// newCacheEntry creates the entry of the response to r with the raw
+// body, or returns nil if the body is incomplete. A body delimited by
+// the end of the response is given a Content-Length.
+func newCacheEntry(r *internal.Request, resp *internal.Response, body []byte, reqTime, respTime time.Time) *CacheEntry {
+	e := &CacheEntry{
+		StatusCode:   resp.ResponseLine.StatusCode,
+		Headers:      make(map[string]string, len(resp.Headers.HeadersMap)),
+		Body:         bytes.Clone(body),
+		Vary:         make(map[string]string),
+		RequestTime:  reqTime,
+		ResponseTime: respTime,
+	}
+	for k, v := range resp.Headers.HeadersMap {
+		e.Headers[k] = v
+	}
+	delete(e.Headers, "X-Cache")
+
+	if resp.GetHeader("Transfer-Encoding") == "" {
+		cl := resp.GetHeader("Content-Length")
+		if cl == "" {
+			e.Headers["Content-Length"] = strconv.Itoa(len(body))
+		} else if n, err := strconv.Atoi(cl); err != nil || n != len(body) {
+			return nil
+		}
+	}
+	// a recipient with a clock adds a missing Date, see RFC 9110
+	// Section 6.6.1.
+	if resp.GetHeader("Date") == "" {
+		e.Headers["Date"] = internal.FormatHTTPDate(respTime)
+	}
+	for _, name := range strings.Split(resp.GetHeader("Vary"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			e.Vary[strings.ToLower(name)] = strings.TrimSpace(r.GetHeader(name))
+		}
+	}
+	return e
+}
+
+// refresh returns a copy of e updated with the headers of the 304
+// response resp, see [RFC 9111 Section 4.3.4].
+//
+// [RFC 9111 Section 4.3.4]: https://www.rfc-editor.org/rfc/rfc9111#name-freshening-stored-responses
+func refresh(e *CacheEntry, resp *internal.Response, reqTime, respTime time.Time) *CacheEntry {
+	updated := *e
+	updated.Headers = make(map[string]string, len(e.Headers))
+	for k, v := range e.Headers {
+		updated.Headers[k] = v
+	}
+	for k, v := range resp.Headers.HeadersMap {
+		switch k {
+		case "Content-Length", "Transfer-Encoding", "Connection", "X-Cache":
+			continue
+		}
+		updated.Headers[k] = v
+	}
+	if resp.GetHeader("Date") == "" {
+		updated.Headers["Date"] = internal.FormatHTTPDate(respTime)
+	}
+	updated.RequestTime = reqTime
+	updated.ResponseTime = respTime
+	return &updated
+}
+
+// freshnessLifetime implements [RFC 9111 Section 4.2.1] for a shared
+// cache, the heuristic lifetime being 10% of the time since the response
+// was last modified.
+//
+// [RFC 9111 Section 4.2.1]: https://www.rfc-editor.org/rfc/rfc9111#name-calculating-freshness-lifet
+func freshnessLifetime(e *CacheEntry) time.Duration {
+	cc := parseCacheControl(e.Headers["Cache-Control"])
+	if d, ok := ccSeconds(cc, "s-maxage"); ok {
+		return d
+	}
+	if d, ok := ccSeconds(cc, "max-age"); ok {
+		return d
+	}
+	date := dateValue(e)
+	if v, ok := e.Headers["Expires"]; ok {
+		expires, err := internal.ParseHTTPDate(v)
+		if err != nil {
+			// an invalid Expires means already expired.
+			return 0
+		}
+		return expires.Sub(date)
+	}
+	if lm, err := internal.ParseHTTPDate(e.Headers["Last-Modified"]); err == nil && heuristicStatus[e.StatusCode] {
+		if d := date.Sub(lm); d > 0 {
+			return d / 10
+		}
+	}
+	return 0
+}
+
+// currentAge implements [RFC 9111 Section 4.2.3].
+//
+// [RFC 9111 Section 4.2.3]: https://www.rfc-editor.org/rfc/rfc9111#name-calculating-age
+func currentAge(e *CacheEntry, now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(dateValue(e)))
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Headers["Age"], 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	responseDelay := e.ResponseTime.Sub(e.RequestTime)
+	correctedInitialAge := max(apparentAge, ageValue+responseDelay)
+	return correctedInitialAge + now.Sub(e.ResponseTime)
+}
+
+func dateValue(e *CacheEntry) time.Time {
+	if d, err := internal.ParseHTTPDate(e.Headers["Date"]); err == nil {
+		return d
+	}
+	return e.ResponseTime
+}
+
+// conditionalRequest returns a copy of r validating the stored response
+// with headers h.
+func conditionalRequest(r *internal.Request, h internal.HTTPHeaders) *internal.Request {
+	out := cloneRequest(r)
+	out.Headers.Delete("If-None-Match")
+	out.Headers.Delete("If-Modified-Since")
+	if etag := h.Get("ETag"); etag != "" {
+		out.Headers.Set("If-None-Match", etag)
+	}
+	if lm := h.Get("Last-Modified"); lm != "" {
+		out.Headers.Set("If-Modified-Since", lm)
+	}
+	return out
+}
+
+func cloneRequest(r *internal.Request) *internal.Request {
+	out := *r
+	out.Headers = internal.NewHeaders()
+	for k, v := range r.Headers.HeadersMap {
+		out.Headers.Set(k, v)
+	}
+	return &out
+}
+
+// cacheKey returns the key of the responses to r, the effective
+// request URI.
+func cacheKey(r *internal.Request) string {
+	target := r.RequestLine.RequestTarget
+	if strings.Contains(target, "://") {
+		return target
+	}
+	return "http://" + strings.ToLower(r.GetHeader("Host")) + target
+}
+
+// matchVariant returns the index of the entry selected by the request
+// headers of r, or -1, see [RFC 9111 Section 4.1].
+//
+// [RFC 9111 Section 4.1]: https://www.rfc-editor.org/rfc/rfc9111#name-calculating-cache-keys-with
+func matchVariant(entries []*CacheEntry, r *internal.Request) int {
+	for i, e := range entries {
+		if variantMatches(e.Vary, r) {
+			return i
+		}
+	}
+	return -1
+}
+
+func variantMatches(vary map[string]string, r *internal.Request) bool {
+	for name, v := range vary {
+		if strings.TrimSpace(r.GetHeader(name)) != v {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceVariant returns entries with the variant of e replaced by e.
+func replaceVariant(entries []*CacheEntry, e *CacheEntry) []*CacheEntry {
+	out := make([]*CacheEntry, 0, len(entries)+1)
+	for _, old := range entries {
+		if !sameVary(old.Vary, e.Vary) {
+			out = append(out, old)
+		}
+	}
+	return append(out, e)
+}
+
+func sameVary(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCacheControl parses the directives of a Cache-Control header,
+// see [RFC 9111 Section 5.2]. Directive names are lower-cased and the
+// quotes around values removed, directives without value map to "".
+//
+// [RFC 9111 Section 5.2]: https://www.rfc-editor.org/rfc/rfc9111#name-cache-control
+func parseCacheControl(v string) map[string]string {
+	cc := make(map[string]string)
+	for _, d := range strings.Split(v, ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			cc[name] = strings.Trim(strings.TrimSpace(val), `"`)
+		}
+	}
+	return cc
+}
+
+// ccSeconds returns the delta-seconds value of the directive name, an
+// invalid value is reported as 0 so the response is treated as stale and
+// values beyond 2^31 are capped, see [RFC 9111 Section 1.2.2].
+//
+// [RFC 9111 Section 1.2.2]: https://www.rfc-editor.org/rfc/rfc9111#name-delta-seconds
+func ccSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if errors.Is(err, strconv.ErrRange) && !strings.HasPrefix(v, "-") {
+		n, err = 1<<31, nil
+	}
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(min(n, 1<<31)) * time.Second, true
+}
+
+// teeWriter writes to w and records what was written to rec, passing
+// flushes on to w so that streamed responses are not held back.
+type teeWriter struct {
+	w   io.Writer
+	rec *bodyRecorder
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	_, _ = t.rec.Write(p[:n])
+	return n, err
+}
+
+func (t *teeWriter) Flush() error {
+	if f, ok := t.w.(internal.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// bodyRecorder keeps the body written through it unless it grows
+// beyond max.
+type bodyRecorder struct {
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if int64(b.buf.Len()+len(p)) > b.max {
+		b.overflow = true
+		b.buf.Reset()
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
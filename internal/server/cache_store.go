@@ -0,0 +1,216 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"httpfromtcp/internal"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a stored response.
+type CacheEntry struct {
+	StatusCode internal.HTTPStatusCode
+	Headers    map[string]string
+	// Body is the message body framed as the headers declare.
+	Body []byte
+	// Vary holds the values of the request headers nominated by the Vary
+	// header of the response, keyed by their canonical names.
+	Vary         map[string]string
+	RequestTime  time.Time // when the request causing the response was sent
+	ResponseTime time.Time // when the response was received
+}
+
+func (e *CacheEntry) header() internal.HTTPHeaders {
+	h := internal.NewHeaders()
+	for k, v := range e.Headers {
+		h.Set(k, v)
+	}
+	return h
+}
+
+func (e *CacheEntry) size() int64 {
+	n := int64(len(e.Body))
+	for k, v := range e.Headers {
+		n += int64(len(k) + len(v))
+	}
+	for k, v := range e.Vary {
+		n += int64(len(k) + len(v))
+	}
+	return n
+}
+
+// CacheStore stores the responses of a [Cache], keyed by the request
+// method and URI. A key holds one entry per variant selected by the
+// Vary header.
+//
+// Implementations must be safe for concurrent use, and callers must not
+// modify the entries they get or set.
+type CacheStore interface {
+	Get(key string) ([]*CacheEntry, bool)
+	Set(key string, entries []*CacheEntry)
+	Delete(key string)
+}
+
+type memoryItem struct {
+	key     string
+	entries []*CacheEntry
+	size    int64
+}
+
+// MemoryStore is an in-memory [CacheStore] evicting the least recently
+// used keys once its size limit is reached.
+type MemoryStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List // of *memoryItem, most recently used first
+	items    map[string]*list.Element
+}
+
+// NewMemoryStore creates a new MemoryStore holding at most maxBytes of
+// headers and bodies.
+func NewMemoryStore(maxBytes int64) *MemoryStore {
+	return &MemoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (s *MemoryStore) Get(key string) ([]*CacheEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(el)
+	return el.Value.(*memoryItem).entries, true
+}
+
+// Set stores the entries of key, they are not stored if they alone
+// exceed the size limit.
+func (s *MemoryStore) Set(key string, entries []*CacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteLocked(key)
+
+	item := &memoryItem{key: key, entries: entries}
+	for _, e := range entries {
+		item.size += e.size()
+	}
+	if item.size > s.maxBytes {
+		return
+	}
+	s.items[key] = s.lru.PushFront(item)
+	s.size += item.size
+	for s.size > s.maxBytes {
+		s.deleteLocked(s.lru.Back().Value.(*memoryItem).key)
+	}
+}
+
+func (s *MemoryStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteLocked(key)
+}
+
+// Size returns the number of bytes stored.
+func (s *MemoryStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+func (s *MemoryStore) deleteLocked(key string) {
+	el, ok := s.items[key]
+	if !ok {
+		return
+	}
+	s.lru.Remove(el)
+	delete(s.items, key)
+	s.size -= el.Value.(*memoryItem).size
+}
+
+// DiskStore is a [CacheStore] keeping every key in a file of its
+// directory, so the cached responses survive restarts.
+type DiskStore struct {
+	dir string
+}
+
+// diskRecord is the content of a DiskStore file, the key is kept to
+// tell apart keys whose file names collide.
+type diskRecord struct {
+	Key     string
+	Entries []*CacheEntry
+}
+
+// NewDiskStore creates a new DiskStore in dir, creating the directory
+// if needed.
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+func (s *DiskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+}
+
+func (s *DiskStore) Get(key string) ([]*CacheEntry, bool) {
+	f, err := os.Open(s.path(key))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("error opening the cache file", "err", err)
+		}
+		return nil, false
+	}
+	defer f.Close()
+
+	var rec diskRecord
+	if err := gob.NewDecoder(f).Decode(&rec); err != nil {
+		slog.Error("error decoding the cache file", "err", err)
+		return nil, false
+	}
+	if rec.Key != key {
+		return nil, false
+	}
+	return rec.Entries, true
+}
+
+// Set writes the entries to a temporary file first and renames it, so
+// concurrent readers never see a partially written file.
+func (s *DiskStore) Set(key string, entries []*CacheEntry) {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		slog.Error("error creating the cache file", "err", err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(diskRecord{Key: key, Entries: entries})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(key))
+	}
+	if err != nil {
+		slog.Error("error writing the cache file", "err", err)
+		_ = os.Remove(f.Name())
+	}
+}
+
+func (s *DiskStore) Delete(key string) {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("error removing the cache file", "err", err)
+	}
+}
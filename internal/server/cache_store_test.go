@@ -0,0 +1,68 @@
+package server
+
+import (
+	"httpfromtcp/internal"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testEntry(body string) *CacheEntry {
+	return &CacheEntry{
+		StatusCode:   internal.StatusOK,
+		Headers:      map[string]string{"Etag": `"x"`},
+		Body:         []byte(body),
+		Vary:         map[string]string{},
+		RequestTime:  time.Unix(100, 0).UTC(),
+		ResponseTime: time.Unix(101, 0).UTC(),
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	// each entry is 10 bytes of body and 7 bytes of headers.
+	s := NewMemoryStore(50)
+	s.Set("a", []*CacheEntry{testEntry("0123456789")})
+	s.Set("b", []*CacheEntry{testEntry("0123456789")})
+	_, ok := s.Get("a")
+	assert.True(t, ok)
+
+	// "b" is the least recently used.
+	s.Set("c", []*CacheEntry{testEntry("0123456789")})
+	_, ok = s.Get("b")
+	assert.False(t, ok)
+	_, ok = s.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(34), s.Size())
+
+	s.Set("big", []*CacheEntry{testEntry(string(make([]byte, 64)))})
+	_, ok = s.Get("big")
+	assert.False(t, ok)
+	assert.Equal(t, int64(34), s.Size())
+
+	s.Delete("a")
+	assert.Equal(t, int64(17), s.Size())
+}
+
+func TestDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDiskStore(dir)
+	assert.NoError(t, err)
+
+	_, ok := s.Get("http://example.com/")
+	assert.False(t, ok)
+
+	entries := []*CacheEntry{testEntry("hello")}
+	s.Set("http://example.com/", entries)
+
+	// the entries survive a new store on the same directory.
+	s, err = NewDiskStore(dir)
+	assert.NoError(t, err)
+	got, ok := s.Get("http://example.com/")
+	assert.True(t, ok)
+	assert.Equal(t, entries, got)
+
+	s.Delete("http://example.com/")
+	_, ok = s.Get("http://example.com/")
+	assert.False(t, ok)
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bufio"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// origin is a handler answering with its headers and body while
+// recording the requests it receives.
+type origin struct {
+	code     internal.HTTPStatusCode
+	headers  map[string]string
+	body     string
+	requests []*internal.Request
+}
+
+func (o *origin) handle(w *internal.ResponseWriter, r *internal.Request) {
+	o.requests = append(o.requests, r)
+	h := internal.GetDefaultHeaders(len(o.body))
+	for k, v := range o.headers {
+		h.Set(k, v)
+	}
+	_ = w.WriteStatusLine(o.code)
+	_ = w.WriteHeaders(h)
+	if o.code != internal.StatusNotModified {
+		_, _ = w.Write([]byte(o.body))
+	}
+}
+
+// testCache returns a cache whose clock is moved by the returned function.
+func testCache(opts ...CacheOption) (*Cache, func(time.Duration)) {
+	now := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	c := NewCache(opts...)
+	c.opts.now = func() time.Time { return now }
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+func getRequest(target string, headers ...string) *internal.Request {
+	r := internal.NewRequest("GET", target)
+	r.Headers.Set("Host", "example.com")
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Headers.Set(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func TestCacheFreshness(t *testing.T) {
+	o := &origin{code: internal.StatusOK, headers: map[string]string{"Cache-Control": "max-age=60"}, body: "hello"}
+	c, advance := testCache()
+	h := c.Middleware(o.handle)
+
+	resp := proxyRequest(t, h, getRequest("/a"))
+	assert.Equal(t, "MISS", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "hello", string(resp.Body))
+
+	advance(10 * time.Second)
+	resp = proxyRequest(t, h, getRequest("/a"))
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "HIT", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "10", resp.GetHeader("Age"))
+	assert.Equal(t, "hello", string(resp.Body))
+
+	head := getRequest("/a")
+	head.RequestLine.Method = "HEAD"
+	resp = proxyRequest(t, h, head)
+	assert.Equal(t, "HIT", resp.GetHeader("X-Cache"))
+	assert.Empty(t, resp.Body)
+
+	resp = proxyRequest(t, h, getRequest("/a", "Cache-Control", "max-age=5"))
+	assert.Equal(t, "MISS", resp.GetHeader("X-Cache"))
+
+	advance(61 * time.Second)
+	resp = proxyRequest(t, h, getRequest("/a"))
+	assert.Equal(t, "MISS", resp.GetHeader("X-Cache"))
+
+	resp = proxyRequest(t, h, getRequest("/a", "Cache-Control", "max-stale"))
+	assert.Equal(t, "HIT", resp.GetHeader("X-Cache"))
+	assert.Len(t, o.requests, 3)
+}
+
+func TestCacheNotStored(t *testing.T) {
+	testCases := []struct {
+		name    string
+		code    internal.HTTPStatusCode
+		headers map[string]string
+		request []string
+		opts    []CacheOption
+	}{
+		{
+			name:    "no-store",
+			code:    internal.StatusOK,
+			headers: map[string]string{"Cache-Control": "no-store, max-age=60"},
+		},
+		{
+			name:    "private",
+			code:    internal.StatusOK,
+			headers: map[string]string{"Cache-Control": "private, max-age=60"},
+		},
+		{
+			name:    "vary star",
+			code:    internal.StatusOK,
+			headers: map[string]string{"Cache-Control": "max-age=60", "Vary": "*"},
+		},
+		{
+			name:    "authorization",
+			code:    internal.StatusOK,
+			headers: map[string]string{"Cache-Control": "max-age=60"},
+			request: []string{"Authorization", "Bearer token"},
+		},
+		{
+			name:    "request no-store",
+			code:    internal.StatusOK,
+			headers: map[string]string{"Cache-Control": "max-age=60"},
+			request: []string{"Cache-Control", "no-store"},
+		},
+		{
+			name:    "status not cacheable by default",
+			code:    internal.StatusFound,
+			headers: map[string]string{"Last-Modified": "Mon, 01 Jan 2023 00:00:00 GMT"},
+		},
+		{
+			name: "no freshness nor validator",
+			code: internal.StatusOK,
+		},
+		{
+			name:    "body larger than the limit",
+			code:    internal.StatusOK,
+			headers: map[string]string{"Cache-Control": "max-age=60"},
+			opts:    []CacheOption{WithMaxEntrySize(10)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := &origin{code: tc.code, headers: tc.headers, body: "hello world"}
+			c, _ := testCache(tc.opts...)
+			h := c.Middleware(o.handle)
+			for range 2 {
+				resp := proxyRequest(t, h, getRequest("/", tc.request...))
+				assert.Equal(t, "MISS", resp.GetHeader("X-Cache"))
+				assert.Equal(t, "hello world", string(resp.Body))
+			}
+			assert.Len(t, o.requests, 2)
+		})
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	o := &origin{code: internal.StatusOK, headers: map[string]string{"Cache-Control": "no-cache", "ETag": `"v1"`}, body: "hello"}
+	c, advance := testCache()
+	h := c.Middleware(o.handle)
+
+	resp := proxyRequest(t, h, getRequest("/doc"))
+	assert.Equal(t, "MISS", resp.GetHeader("X-Cache"))
+
+	o.code = internal.StatusNotModified
+	o.headers = map[string]string{"Cache-Control": "max-age=30", "ETag": `"v1"`}
+	advance(5 * time.Second)
+	resp = proxyRequest(t, h, getRequest("/doc"))
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "HIT", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "hello", string(resp.Body))
+	assert.Equal(t, `"v1"`, o.requests[1].GetHeader("If-None-Match"))
+
+	// the 304 response refreshed the stored one.
+	advance(10 * time.Second)
+	resp = proxyRequest(t, h, getRequest("/doc"))
+	assert.Equal(t, "HIT", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "10", resp.GetHeader("Age"))
+	assert.Len(t, o.requests, 2)
+
+	// a conditional request is answered from the cache.
+	resp = proxyRequest(t, h, getRequest("/doc", "If-None-Match", `W/"v0", "v1"`))
+	assert.Equal(t, internal.StatusNotModified, resp.ResponseLine.StatusCode)
+	assert.Len(t, o.requests, 2)
+
+	// a changed representation replaces the stored one.
+	o.code = internal.StatusOK
+	o.headers = map[string]string{"Cache-Control": "max-age=30", "ETag": `"v2"`}
+	o.body = "changed"
+	resp = proxyRequest(t, h, getRequest("/doc", "Cache-Control", "no-cache"))
+	assert.Equal(t, "MISS", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "changed", string(resp.Body))
+	resp = proxyRequest(t, h, getRequest("/doc"))
+	assert.Equal(t, "HIT", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "changed", string(resp.Body))
+}
+
+func TestCacheVary(t *testing.T) {
+	o := &origin{code: internal.StatusOK, headers: map[string]string{"Cache-Control": "max-age=60", "Vary": "Accept-Language"}, body: "hello"}
+	c, _ := testCache()
+	h := c.Middleware(o.handle)
+
+	assert.Equal(t, "MISS", proxyRequest(t, h, getRequest("/", "Accept-Language", "en")).GetHeader("X-Cache"))
+	o.body = "bonjour"
+	resp := proxyRequest(t, h, getRequest("/", "Accept-Language", "fr"))
+	assert.Equal(t, "MISS", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "bonjour", string(resp.Body))
+
+	resp = proxyRequest(t, h, getRequest("/", "Accept-Language", "en"))
+	assert.Equal(t, "HIT", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "hello", string(resp.Body))
+	resp = proxyRequest(t, h, getRequest("/", "Accept-Language", "fr"))
+	assert.Equal(t, "HIT", resp.GetHeader("X-Cache"))
+	assert.Equal(t, "bonjour", string(resp.Body))
+}
+
+func TestCacheInvalidationAndOnlyIfCached(t *testing.T) {
+	o := &origin{code: internal.StatusOK, headers: map[string]string{"Cache-Control": "max-age=60"}, body: "hello"}
+	c, _ := testCache()
+	h := c.Middleware(o.handle)
+
+	resp := proxyRequest(t, h, getRequest("/", "Cache-Control", "only-if-cached"))
+	assert.Equal(t, internal.StatusGatewayTimeout, resp.ResponseLine.StatusCode)
+	assert.Empty(t, o.requests)
+
+	proxyRequest(t, h, getRequest("/"))
+	assert.Equal(t, "HIT", proxyRequest(t, h, getRequest("/", "Cache-Control", "only-if-cached")).GetHeader("X-Cache"))
+
+	post := getRequest("/")
+	post.RequestLine.Method = "POST"
+	resp = proxyRequest(t, h, post)
+	assert.Empty(t, resp.GetHeader("X-Cache"))
+	assert.Equal(t, "MISS", proxyRequest(t, h, getRequest("/")).GetHeader("X-Cache"))
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	date := "Mon, 01 Jan 2024 12:00:00 GMT"
+	testCases := []struct {
+		name     string
+		code     internal.HTTPStatusCode
+		headers  map[string]string
+		expected time.Duration
+	}{
+		{
+			name:     "s-maxage over max-age",
+			code:     internal.StatusOK,
+			headers:  map[string]string{"Cache-Control": "max-age=10, s-maxage=20", "Date": date},
+			expected: 20 * time.Second,
+		},
+		{
+			name:     "max-age over expires",
+			code:     internal.StatusOK,
+			headers:  map[string]string{"Cache-Control": "max-age=10", "Expires": "Mon, 01 Jan 2024 13:00:00 GMT", "Date": date},
+			expected: 10 * time.Second,
+		},
+		{
+			name:     "expires",
+			code:     internal.StatusOK,
+			headers:  map[string]string{"Expires": "Mon, 01 Jan 2024 13:00:00 GMT", "Date": date},
+			expected: time.Hour,
+		},
+		{
+			name:     "invalid expires",
+			code:     internal.StatusOK,
+			headers:  map[string]string{"Expires": "0", "Date": date},
+			expected: 0,
+		},
+		{
+			name:     "heuristic",
+			code:     internal.StatusOK,
+			headers:  map[string]string{"Last-Modified": "Mon, 01 Jan 2024 02:00:00 GMT", "Date": date},
+			expected: time.Hour,
+		},
+		{
+			name:     "no heuristic for status",
+			code:     internal.StatusFound,
+			headers:  map[string]string{"Last-Modified": "Mon, 01 Jan 2024 02:00:00 GMT", "Date": date},
+			expected: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := &CacheEntry{StatusCode: tc.code, Headers: tc.headers}
+			assert.Equal(t, tc.expected, freshnessLifetime(e))
+		})
+	}
+}
+
+func TestCurrentAge(t *testing.T) {
+	respTime := time.Date(2024, time.January, 1, 12, 0, 0, 0, time.UTC)
+	e := &CacheEntry{
+		Headers: map[string]string{
+			"Date": "Mon, 01 Jan 2024 11:59:50 GMT",
+			"Age":  "5",
+		},
+		RequestTime:  respTime.Add(-2 * time.Second),
+		ResponseTime: respTime,
+	}
+	// the apparent age of 10s exceeds the corrected age of 5s+2s.
+	assert.Equal(t, 40*time.Second, currentAge(e, respTime.Add(30*time.Second)))
+}
+
+func TestCacheFlush(t *testing.T) {
+	release := make(chan struct{})
+	c := NewCache()
+	path := serveUnix(t, c.Middleware(func(w *internal.ResponseWriter, r *internal.Request) {
+		h := internal.NewHeaders()
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("Transfer-Encoding", "chunked")
+		_ = w.WriteStatusLine(internal.StatusOK)
+		_ = w.WriteHeaders(h)
+		cw := internal.NewChunkedWriter(w)
+		_, _ = io.WriteString(cw, "hello")
+		assert.NoError(t, w.Flush())
+		// the client reads the flushed chunk before the handler returns.
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		_ = cw.Close()
+	}))
+
+	conn, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	defer conn.Close()
+	// shorter than the wait of the handler, which must not be needed.
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.WriteString(conn, "GET /stream HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := internal.ReadResponseHead(br)
+	if !assert.NoError(t, err) {
+		close(release)
+		return
+	}
+	assert.Equal(t, "MISS", resp.GetHeader("X-Cache"))
+	body, err := internal.ResponseBodyReader(br, resp, "GET")
+	assert.NoError(t, err)
+	buf := make([]byte, len("hello"))
+	_, err = io.ReadFull(body, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	close(release)
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"httpfromtcp/internal"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// CompressOptions configures a [Compressor].
+type CompressOptions struct {
+	level          int
+	minSize        int
+	types          []string
+	maxDecodedSize int64
+}
+
+// DefaultCompressOptions returns the default options of a [Compressor].
+//
+// Textual responses of at least 1KiB are compressed with the default
+// level, uploads may decode to at most 10MiB.
+func DefaultCompressOptions() *CompressOptions {
+	return &CompressOptions{
+		level:   gzip.DefaultCompression,
+		minSize: 1024,
+		types: []string{
+			"text/",
+			"application/json",
+			"application/javascript",
+			"application/xml",
+			"application/xhtml+xml",
+			"image/svg+xml",
+		},
+		maxDecodedSize: 10 << 20,
+	}
+}
+
+// CompressOption configures a [Compressor].
+type CompressOption func(*CompressOptions)
+
+// WithCompressionLevel sets the level of gzip and deflate, from
+// [gzip.BestSpeed] to [gzip.BestCompression].
+func WithCompressionLevel(level int) CompressOption {
+	return func(opts *CompressOptions) {
+		opts.level = level
+	}
+}
+
+// WithMinSize sets the Content-Length below which a response is not
+// compressed. Responses of unknown length are always compressed.
+func WithMinSize(n int) CompressOption {
+	return func(opts *CompressOptions) {
+		opts.minSize = n
+	}
+}
+
+// WithCompressibleTypes sets the media types that are compressed, a type
+// ending with "/" matches every subtype. Types with a +json or +xml
+// suffix are always compressible.
+func WithCompressibleTypes(types ...string) CompressOption {
+	return func(opts *CompressOptions) {
+		opts.types = types
+	}
+}
+
+// WithMaxDecodedSize limits the size of a request body once its content
+// coding is removed, larger bodies are answered with 413.
+func WithMaxDecodedSize(n int64) CompressOption {
+	return func(opts *CompressOptions) {
+		opts.maxDecodedSize = n
+	}
+}
+
+// Compressor applies the gzip and deflate content codings of
+// [RFC 9110 Section 8.4.1] to responses, and removes them from request
+// bodies.
+//
+// [RFC 9110 Section 8.4.1]: https://www.rfc-editor.org/rfc/rfc9110#name-content-codings
+type Compressor struct {
+	opts *CompressOptions
+}
+
+// NewCompressor creates a [Compressor] configured by opts.
+func NewCompressor(opts ...CompressOption) *Compressor {
+	o := DefaultCompressOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+	return &Compressor{opts: o}
+}
+
+var errDecodedTooLarge = errors.New("decoded body exceeds the maximum size")
+
+// Middleware returns a [Handler] decoding the body of r before passing it
+// to next, and compressing the response of next with the coding the
+// client prefers in its Accept-Encoding header.
+func (c *Compressor) Middleware(next Handler) Handler {
+	return func(w *internal.ResponseWriter, r *internal.Request) {
+		// upgraded connections and tunnels are not HTTP responses to
+		// compress.
+		if IsWebSocketUpgrade(r) || r.RequestLine.Method == "CONNECT" {
+			next(w, r)
+			return
+		}
+		if err := c.decodeRequest(r); err != nil {
+			h := internal.NewHeaders()
+			code := internal.StatusBadRequest
+			switch {
+			case errors.Is(err, errDecodedTooLarge):
+				code = internal.StatusRequestTooLarge
+			case errors.Is(err, errUnsupportedCoding):
+				// [RFC 9110 Section 12.5.3] lists the codings we accept.
+				code = internal.StatusUnsupportedMedia
+				h.Set("Accept-Encoding", "gzip, deflate")
+			}
+			slog.Error("error decoding the request body", "err", err)
+			writeStatus(w, code, h)
+			return
+		}
+
+		coding := negotiateEncoding(r.GetHeader("Accept-Encoding"))
+		var cw *compressWriter
+		hi := newHeadInterceptor(func(resp *internal.Response) (io.Writer, error) {
+			if !c.compressible(resp) {
+				return w.Writer, writeHead(w.Writer, resp.ResponseLine.StatusCode, resp.Headers)
+			}
+			appendHeader(resp.Headers, "Vary", "Accept-Encoding")
+			if coding == "" || !hasBody(r, resp) {
+				return w.Writer, writeHead(w.Writer, resp.ResponseLine.StatusCode, resp.Headers)
+			}
+
+			// the body is still framed as the handler declared it.
+			unchunk := resp.GetHeader("Transfer-Encoding") != ""
+
+			resp.Headers.Set("Content-Encoding", coding)
+			resp.Headers.Delete("Content-Length")
+			resp.Headers.Set("Transfer-Encoding", "chunked")
+			// the compressed representation differs from the identity one.
+			if etag := resp.GetHeader("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				resp.Headers.Set("ETag", "W/"+etag)
+			}
+			if err := writeHead(w.Writer, resp.ResponseLine.StatusCode, resp.Headers); err != nil {
+				return nil, err
+			}
+
+			chunked := internal.NewChunkedWriter(w.Writer)
+			enc, err := c.newEncoder(coding, chunked)
+			if err != nil {
+				return nil, err
+			}
+			cw = &compressWriter{body: enc, enc: enc, chunked: chunked, w: w}
+			if unchunk {
+				cw.body = &dechunkWriter{w: enc}
+			}
+			return cw, nil
+		})
+		next(internal.NewResponseWriter(&hijackInterceptor{headInterceptor: hi, w: w}), r)
+		if cw != nil {
+			if err := cw.Close(); err != nil {
+				slog.Error("error compressing the response body", "err", err)
+			}
+		}
+	}
+}
+
+// encoder is the writer of a content coding.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter compresses the body written by a handler into the
+// chunked body of the response written to w.
+type compressWriter struct {
+	// body removes the framing of the handler, if chunked, before enc.
+	body    io.Writer
+	enc     encoder
+	chunked io.WriteCloser
+	w       *internal.ResponseWriter
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	return cw.body.Write(p)
+}
+
+// Flush sends the data compressed so far, for streaming handlers.
+func (cw *compressWriter) Flush() error {
+	if err := cw.enc.Flush(); err != nil {
+		return err
+	}
+	return cw.w.Flush()
+}
+
+// Close ends the compressed stream and the chunked body.
+func (cw *compressWriter) Close() error {
+	if err := cw.enc.Close(); err != nil {
+		return err
+	}
+	return cw.chunked.Close()
+}
+
+func (c *Compressor) newEncoder(coding string, w io.Writer) (encoder, error) {
+	if coding == "gzip" {
+		return gzip.NewWriterLevel(w, c.opts.level)
+	}
+	// the deflate coding is the zlib format, see RFC 9110 Section 8.4.1.2.
+	return zlib.NewWriterLevel(w, c.opts.level)
+}
+
+// compressible reports whether resp may be compressed: it is not already
+// encoded, not a partial representation, does not forbid transformations
+// and has a compressible media type of at least the minimum size.
+func (c *Compressor) compressible(resp *internal.Response) bool {
+	if resp.GetHeader("Content-Encoding") != "" || resp.GetHeader("Content-Range") != "" {
+		return false
+	}
+	if _, ok := parseCacheControl(resp.GetHeader("Cache-Control"))["no-transform"]; ok {
+		return false
+	}
+	if cl := resp.GetHeader("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err != nil || n < c.opts.minSize {
+			return false
+		}
+	}
+	mediaType, _, _ := strings.Cut(resp.GetHeader("Content-Type"), ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	if strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	for _, t := range c.opts.types {
+		if mediaType == t || (strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBody reports whether the response to r carries a body.
+func hasBody(r *internal.Request, resp *internal.Response) bool {
+	code := resp.ResponseLine.StatusCode
+	return r.RequestLine.Method != "HEAD" && code >= 200 && code != internal.StatusNoContent && code != internal.StatusNotModified
+}
+
+// negotiateEncoding returns the content coding preferred by the
+// Accept-Encoding header among gzip and deflate, or "" if the response
+// is sent without coding, see [RFC 9110 Section 12.5.3].
+//
+// [RFC 9110 Section 12.5.3]: https://www.rfc-editor.org/rfc/rfc9110#name-accept-encoding
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+	for _, spec := range internal.ParseAccept(accept) {
+		if _, ok := q[spec.Value]; !ok {
+			q[spec.Value] = spec.Q
+		}
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		cq, ok := q[coding]
+		if !ok {
+			if coding == "gzip" {
+				cq, ok = q["x-gzip"]
+			}
+			if !ok {
+				cq = q["*"]
+			}
+		}
+		if cq > bestQ {
+			best, bestQ = coding, cq
+		}
+	}
+	return best
+}
+
+var errUnsupportedCoding = errors.New("unsupported content coding")
+
+// decodeRequest replaces the body of r by its decoded form when it is
+// sent with the gzip or deflate content coding.
+func (c *Compressor) decodeRequest(r *internal.Request) error {
+	coding := strings.ToLower(strings.TrimSpace(r.GetHeader("Content-Encoding")))
+	if coding == "" || coding == "identity" {
+		return nil
+	}
+	var dec io.Reader
+	var err error
+	switch coding {
+	case "gzip", "x-gzip":
+		dec, err = gzip.NewReader(bytes.NewReader(r.Body))
+	case "deflate":
+		dec, err = zlib.NewReader(bytes.NewReader(r.Body))
+	default:
+		return errUnsupportedCoding
+	}
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(io.LimitReader(dec, c.opts.maxDecodedSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > c.opts.maxDecodedSize {
+		return errDecodedTooLarge
+	}
+	r.Body = body
+	r.ContentLength = len(body)
+	r.Headers.Delete("Content-Encoding")
+	r.Headers.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
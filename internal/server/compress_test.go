@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decompress(t *testing.T, coding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	var err error
+	if coding == "gzip" {
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	} else {
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	}
+	assert.NoError(t, err)
+	b, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func TestCompressorResponses(t *testing.T) {
+	text := strings.Repeat("hello, world ", 100)
+	testCases := []struct {
+		name     string
+		accept   string
+		method   string
+		headers  map[string]string
+		chunked  bool
+		coding   string
+		vary     bool
+		expected string
+	}{
+		{
+			name:     "gzip",
+			accept:   "gzip, deflate",
+			headers:  map[string]string{"Content-Type": "text/plain", "ETag": `"v1"`},
+			coding:   "gzip",
+			vary:     true,
+			expected: text,
+		},
+		{
+			name:     "deflate preferred by q-value",
+			accept:   "gzip;q=0.5, deflate",
+			headers:  map[string]string{"Content-Type": "application/json"},
+			coding:   "deflate",
+			vary:     true,
+			expected: text,
+		},
+		{
+			name:     "chunked response",
+			accept:   "*",
+			headers:  map[string]string{"Content-Type": "application/problem+json"},
+			chunked:  true,
+			coding:   "gzip",
+			vary:     true,
+			expected: text,
+		},
+		{
+			name:     "not accepted",
+			accept:   "gzip;q=0, br",
+			headers:  map[string]string{"Content-Type": "text/plain"},
+			vary:     true,
+			expected: text,
+		},
+		{
+			name:     "no accept-encoding",
+			headers:  map[string]string{"Content-Type": "text/plain"},
+			vary:     true,
+			expected: text,
+		},
+		{
+			name:     "already encoded",
+			accept:   "gzip",
+			headers:  map[string]string{"Content-Type": "text/plain", "Content-Encoding": "br"},
+			expected: text,
+		},
+		{
+			name:     "not compressible type",
+			accept:   "gzip",
+			headers:  map[string]string{"Content-Type": "image/png"},
+			expected: text,
+		},
+		{
+			name:     "no-transform",
+			accept:   "gzip",
+			headers:  map[string]string{"Content-Type": "text/plain", "Cache-Control": "no-transform"},
+			expected: text,
+		},
+		{
+			name:     "below the minimum size",
+			accept:   "gzip",
+			headers:  map[string]string{"Content-Type": "text/plain", "Content-Length": "5"},
+			expected: "small",
+		},
+		{
+			name:    "head",
+			accept:  "gzip",
+			method:  "HEAD",
+			headers: map[string]string{"Content-Type": "text/plain"},
+			vary:    true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := []byte(tc.expected)
+			if tc.method == "HEAD" {
+				body = []byte(text)
+			}
+			next := func(w *internal.ResponseWriter, r *internal.Request) {
+				h := internal.GetDefaultHeaders(len(body))
+				for k, v := range tc.headers {
+					h.Set(k, v)
+				}
+				if tc.chunked {
+					h.Delete("Content-Length")
+					h.Set("Transfer-Encoding", "chunked")
+				}
+				_ = w.WriteStatusLine(internal.StatusOK)
+				_ = w.WriteHeaders(h)
+				if r.RequestLine.Method == "HEAD" {
+					return
+				}
+				if tc.chunked {
+					cw := internal.NewChunkedWriter(w)
+					for i := 0; i < len(body); i += 100 {
+						_, _ = cw.Write(body[i:min(i+100, len(body))])
+					}
+					_ = cw.Close()
+					return
+				}
+				_, _ = w.Write(body)
+			}
+
+			method := "GET"
+			if tc.method != "" {
+				method = tc.method
+			}
+			r := internal.NewRequest(method, "/")
+			if tc.accept != "" {
+				r.Headers.Set("Accept-Encoding", tc.accept)
+			}
+			resp := proxyRequest(t, NewCompressor().Middleware(next), r)
+			assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+			if tc.coding != "" {
+				assert.Equal(t, tc.coding, resp.GetHeader("Content-Encoding"))
+			}
+			if tc.vary {
+				assert.Equal(t, "Accept-Encoding", resp.GetHeader("Vary"))
+			} else {
+				assert.Empty(t, resp.GetHeader("Vary"))
+			}
+			if tc.coding == "" {
+				assert.Equal(t, tc.headers["Content-Encoding"], resp.GetHeader("Content-Encoding"))
+				assert.Equal(t, tc.expected, string(resp.Body))
+				return
+			}
+			assert.Equal(t, "chunked", resp.GetHeader("Transfer-Encoding"))
+			assert.Empty(t, resp.GetHeader("Content-Length"))
+			assert.Less(t, len(resp.Body), len(tc.expected))
+			assert.Equal(t, tc.expected, decompress(t, tc.coding, resp.Body))
+			if etag := tc.headers["ETag"]; etag != "" {
+				assert.Equal(t, "W/"+etag, resp.GetHeader("ETag"))
+			}
+		})
+	}
+}
+
+func TestCompressorFlush(t *testing.T) {
+	release := make(chan struct{})
+	path := serveUnix(t, NewCompressor().Middleware(func(w *internal.ResponseWriter, r *internal.Request) {
+		h := internal.NewHeaders()
+		h.Set("Content-Type", "text/plain")
+		h.Set("Transfer-Encoding", "chunked")
+		_ = w.WriteStatusLine(internal.StatusOK)
+		_ = w.WriteHeaders(h)
+		cw := internal.NewChunkedWriter(w)
+		_, _ = io.WriteString(cw, "hello")
+		assert.NoError(t, w.Flush())
+		// the client reads the flushed data before the handler returns.
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		_, _ = io.WriteString(cw, " world")
+		_ = cw.Close()
+	}))
+
+	conn, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	defer conn.Close()
+	// shorter than the wait of the handler, which must not be needed.
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nAccept-Encoding: gzip\r\n\r\n")
+	assert.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := internal.ReadResponseHead(br)
+	if !assert.NoError(t, err) {
+		close(release)
+		return
+	}
+	assert.Equal(t, "gzip", resp.GetHeader("Content-Encoding"))
+	body, err := internal.ResponseBodyReader(br, resp, "GET")
+	assert.NoError(t, err)
+	zr, err := gzip.NewReader(body)
+	if !assert.NoError(t, err) {
+		close(release)
+		return
+	}
+	buf := make([]byte, len("hello"))
+	_, err = io.ReadFull(zr, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	close(release)
+
+	rest, err := io.ReadAll(zr)
+	assert.NoError(t, err)
+	assert.Equal(t, " world", string(rest))
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	testCases := []struct {
+		accept   string
+		expected string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"x-gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.2, deflate;q=0.8", "deflate"},
+		{"GZIP;Q=0.5", "gzip"},
+		{"*", "gzip"},
+		{"*;q=0.5, gzip;q=0", "deflate"},
+		{"br, identity", ""},
+		{"gzip;q=nope", ""},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, negotiateEncoding(tc.accept), tc.accept)
+	}
+}
+
+func TestCompressorRequestBody(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write([]byte(`{"hello":"world"}`))
+	_ = zw.Close()
+
+	testCases := []struct {
+		name     string
+		coding   string
+		body     []byte
+		opts     []CompressOption
+		status   internal.HTTPStatusCode
+		expected string
+	}{
+		{
+			name:     "gzip",
+			coding:   "gzip",
+			body:     gz.Bytes(),
+			status:   internal.StatusOK,
+			expected: `{"hello":"world"}`,
+		},
+		{
+			name:     "identity",
+			body:     []byte("plain"),
+			status:   internal.StatusOK,
+			expected: "plain",
+		},
+		{
+			name:   "corrupt",
+			coding: "gzip",
+			body:   []byte("not gzip"),
+			status: internal.StatusBadRequest,
+		},
+		{
+			name:   "unsupported coding",
+			coding: "br",
+			body:   []byte("x"),
+			status: internal.StatusUnsupportedMedia,
+		},
+		{
+			name:   "too large once decoded",
+			coding: "gzip",
+			body:   gz.Bytes(),
+			opts:   []CompressOption{WithMaxDecodedSize(8)},
+			status: internal.StatusRequestTooLarge,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got *internal.Request
+			next := func(w *internal.ResponseWriter, r *internal.Request) {
+				got = r
+				writeStatus(w, internal.StatusOK, internal.NewHeaders())
+			}
+			r := internal.NewRequest("POST", "/")
+			r.Body = tc.body
+			r.Headers.Set("Content-Length", strconv.Itoa(len(tc.body)))
+			if tc.coding != "" {
+				r.Headers.Set("Content-Encoding", tc.coding)
+			}
+			resp := proxyRequest(t, NewCompressor(tc.opts...).Middleware(next), r)
+			assert.Equal(t, tc.status, resp.ResponseLine.StatusCode)
+			if tc.status != internal.StatusOK {
+				assert.Nil(t, got)
+				return
+			}
+			assert.Equal(t, tc.expected, string(got.Body))
+			assert.Empty(t, got.GetHeader("Content-Encoding"))
+			assert.Equal(t, strconv.Itoa(len(tc.expected)), got.GetHeader("Content-Length"))
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"httpfromtcp/internal"
+	"strings"
+)
+
+// preconditionFailed evaluates the If-Match and If-Unmodified-Since
+// preconditions of r against a representation with etag and
+// lastModified, reporting whether a 412 response must be sent, see
+// [RFC 9110 Section 13.2.2].
+//
+// [RFC 9110 Section 13.2.2]: https://www.rfc-editor.org/rfc/rfc9110#name-precedence-of-preconditions
+func preconditionFailed(r *internal.Request, etag, lastModified string) bool {
+	if im := r.GetHeader("If-Match"); im != "" {
+		return !etagListMatch(im, etag, true)
+	}
+	ius, err := internal.ParseHTTPDate(r.GetHeader("If-Unmodified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := internal.ParseHTTPDate(lastModified)
+	return err == nil && lm.After(ius)
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since
+// preconditions of r against a representation with etag and lastModified,
+// reporting whether a 304 response must be sent, see
+// [RFC 9110 Section 13.2.2].
+//
+// [RFC 9110 Section 13.2.2]: https://www.rfc-editor.org/rfc/rfc9110#name-precedence-of-preconditions
+func notModified(r *internal.Request, etag, lastModified string) bool {
+	if inm := r.GetHeader("If-None-Match"); inm != "" {
+		return etagListMatch(inm, etag, false)
+	}
+	ims, err := internal.ParseHTTPDate(r.GetHeader("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := internal.ParseHTTPDate(lastModified)
+	return err == nil && !lm.After(ims)
+}
+
+// etagListMatch reports whether etag matches one of the entity tags of
+// the list, or the list is "*". The strong comparison never matches weak
+// tags, see [RFC 9110 Section 8.8.3.2].
+//
+// [RFC 9110 Section 8.8.3.2]: https://www.rfc-editor.org/rfc/rfc9110#name-comparison
+func etagListMatch(list, etag string, strong bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return etag != ""
+	}
+	if etag == "" || (strong && strings.HasPrefix(etag, "W/")) {
+		return false
+	}
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if strong && strings.HasPrefix(candidate, "W/") {
+			continue
+		}
+		if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
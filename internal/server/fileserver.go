@@ -0,0 +1,564 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"httpfromtcp/internal"
+	"io"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type FileServerOptions struct {
+	stripPrefix string
+	indexFiles  []string
+	listDirs    bool
+}
+
+// FileServer serves the files of a file system, see [RFC 9110 Section 14]
+// for the range requests and [RFC 9110 Section 13] for the conditional
+// ones.
+//
+// [RFC 9110 Section 14]: https://www.rfc-editor.org/rfc/rfc9110#name-range-requests
+// [RFC 9110 Section 13]: https://www.rfc-editor.org/rfc/rfc9110#name-conditional-requests
+type FileServer struct {
+	fsys fs.FS
+	opts *FileServerOptions
+}
+
+// DefaultFileServerOptions serves "index.html" for directories and
+// does not list them.
+func DefaultFileServerOptions() *FileServerOptions {
+	return &FileServerOptions{
+		indexFiles: []string{"index.html"},
+	}
+}
+
+type FileServerOption func(*FileServerOptions)
+
+// WithFileStripPrefix removes prefix from the request-target before it
+// is looked up in the file system.
+func WithFileStripPrefix(prefix string) FileServerOption {
+	return func(opts *FileServerOptions) {
+		opts.stripPrefix = prefix
+	}
+}
+
+// WithIndexFiles sets the files served for a directory, the first one
+// found is served.
+func WithIndexFiles(names ...string) FileServerOption {
+	return func(opts *FileServerOptions) {
+		opts.indexFiles = names
+	}
+}
+
+// WithDirectoryListing lists the content of the directories without
+// index file instead of answering 403.
+func WithDirectoryListing() FileServerOption {
+	return func(opts *FileServerOptions) {
+		opts.listDirs = true
+	}
+}
+
+// NewFileServer creates a new FileServer serving fsys with options
+// provided.
+func NewFileServer(fsys fs.FS, opts ...FileServerOption) *FileServer {
+	o := DefaultFileServerOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return &FileServer{fsys: fsys, opts: o}
+}
+
+// NewDirFileServer creates a new FileServer serving the directory dir
+// with options provided. Symbolic links cannot escape dir.
+func NewDirFileServer(dir string, opts ...FileServerOption) (*FileServer, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileServer(root.FS(), opts...), nil
+}
+
+// Handle is the [Handler] serving the file named by the request-target.
+func (fsrv *FileServer) Handle(w *internal.ResponseWriter, r *internal.Request) {
+	if r.RequestLine.Method != "GET" && r.RequestLine.Method != "HEAD" {
+		h := internal.NewHeaders()
+		h.Set("Allow", "GET, HEAD")
+		writeStatus(w, internal.StatusMethodNotAllowed, h)
+		return
+	}
+	u, err := url.ParseRequestURI(r.RequestLine.RequestTarget)
+	if err != nil {
+		writeStatus(w, internal.StatusBadRequest, internal.NewHeaders())
+		return
+	}
+	urlPath := strings.TrimPrefix(u.Path, fsrv.opts.stripPrefix)
+	name, ok := fileName(urlPath)
+	if !ok {
+		writeStatus(w, internal.StatusBadRequest, internal.NewHeaders())
+		return
+	}
+
+	fi, err := fs.Stat(fsrv.fsys, name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	if fi.IsDir() {
+		if !strings.HasSuffix(u.Path, "/") {
+			// relative links of the index must resolve inside the directory.
+			h := internal.NewHeaders()
+			u.Path += "/"
+			h.Set("Location", u.RequestURI())
+			writeStatus(w, internal.StatusMovedPermanently, h)
+			return
+		}
+		for _, index := range fsrv.opts.indexFiles {
+			indexName := path.Join(name, index)
+			if ifi, err := fs.Stat(fsrv.fsys, indexName); err == nil && !ifi.IsDir() {
+				fsrv.serveFile(w, r, indexName, ifi)
+				return
+			}
+		}
+		if !fsrv.opts.listDirs {
+			writeStatus(w, internal.StatusForbidden, internal.NewHeaders())
+			return
+		}
+		fsrv.serveDir(w, r, name, u.Path)
+		return
+	}
+	fsrv.serveFile(w, r, name, fi)
+}
+
+// fileName converts the decoded path of a request-target into a name
+// of the file system, reports false if it cannot name a file. Dot-dot
+// segments are resolved against the root so they never leave it.
+func fileName(urlPath string) (string, bool) {
+	if strings.ContainsAny(urlPath, "\x00\\") {
+		return "", false
+	}
+	name := strings.TrimPrefix(path.Clean("/"+urlPath), "/")
+	if name == "" {
+		name = "."
+	}
+	return name, fs.ValidPath(name)
+}
+
+func (fsrv *FileServer) serveFile(w *internal.ResponseWriter, r *internal.Request, name string, fi fs.FileInfo) {
+	f, err := fsrv.fsys.Open(name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	defer f.Close()
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		b, err := io.ReadAll(f)
+		if err != nil {
+			writeFSError(w, err)
+			return
+		}
+		content = bytes.NewReader(b)
+	}
+
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		buf := make([]byte, sniffLen)
+		n, _ := io.ReadFull(content, buf)
+		ctype = sniffContentType(buf[:n])
+		if _, err := content.Seek(0, io.SeekStart); err != nil {
+			writeFSError(w, err)
+			return
+		}
+	}
+	serveContent(w, r, content, fi.Size(), ctype, fi.ModTime())
+}
+
+// serveContent writes the response to r for the content of size bytes,
+// answering conditional and range requests.
+func serveContent(w *internal.ResponseWriter, r *internal.Request, content io.ReadSeeker, size int64, ctype string, modTime time.Time) {
+	etag := fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+	var lastModified string
+	if !modTime.IsZero() && modTime.Unix() > 0 {
+		lastModified = internal.FormatHTTPDate(modTime)
+	}
+
+	h := internal.NewHeaders()
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("ETag", etag)
+	if lastModified != "" {
+		h.Set("Last-Modified", lastModified)
+	}
+
+	if preconditionFailed(r, etag, lastModified) {
+		writeStatus(w, internal.StatusPreconditionFailed, h)
+		return
+	}
+	if notModified(r, etag, lastModified) {
+		writeHeadOnly(w, internal.StatusNotModified, h)
+		return
+	}
+
+	ranges, err := parseRange(r.GetHeader("Range"), size)
+	if errors.Is(err, errUnsatisfiableRange) {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeStatus(w, internal.StatusRangeNotSatisfiable, h)
+		return
+	}
+	if err != nil || !ifRangeMatches(r, etag, lastModified) {
+		ranges = nil
+	}
+
+	code := internal.StatusOK
+	var body io.Reader = content
+	length := size
+	switch {
+	case len(ranges) == 1:
+		ra := ranges[0]
+		code = internal.StatusPartialContent
+		h.Set("Content-Range", ra.contentRange(size))
+		h.Set("Content-Type", ctype)
+		body = io.NewSectionReader(readerAt(content), ra.start, ra.length)
+		length = ra.length
+	case len(ranges) > 1:
+		code = internal.StatusPartialContent
+		boundary := randomBoundary()
+		h.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+		body, length = multipartRanges(content, ranges, size, ctype, boundary)
+	default:
+		h.Set("Content-Type", ctype)
+	}
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	h.Set("Connection", "close")
+
+	if err := w.WriteStatusLine(code); err != nil {
+		slog.Error("error writing the status-line to the connection", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
+		return
+	}
+	if r.RequestLine.Method == "HEAD" {
+		return
+	}
+	if _, err := io.CopyN(w, body, length); err != nil {
+		slog.Error("error writing the body to the connection", "err", err)
+	}
+}
+
+// ifRangeMatches evaluates the If-Range precondition of r, a range
+// request is only served if the representation did not change, see
+// [RFC 9110 Section 13.1.5].
+//
+// [RFC 9110 Section 13.1.5]: https://www.rfc-editor.org/rfc/rfc9110#name-if-range
+func ifRangeMatches(r *internal.Request, etag, lastModified string) bool {
+	ir := strings.TrimSpace(r.GetHeader("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return etagListMatch(ir, etag, true)
+	}
+	return lastModified != "" && ir == lastModified
+}
+
+func (fsrv *FileServer) serveDir(w *internal.ResponseWriter, r *internal.Request, name, urlPath string) {
+	entries, err := fs.ReadDir(fsrv.fsys, name)
+	if err != nil {
+		writeFSError(w, err)
+		return
+	}
+	var b strings.Builder
+	title := html.EscapeString("Index of " + urlPath)
+	fmt.Fprintf(&b, "<html>\n  <head>\n    <title>%s</title>\n  </head>\n  <body>\n    <h1>%s</h1>\n    <ul>\n", title, title)
+	if urlPath != "/" {
+		b.WriteString("      <li><a href=\"../\">../</a></li>\n")
+	}
+	for _, e := range entries {
+		display := e.Name()
+		if e.IsDir() {
+			display += "/"
+		}
+		href := (&url.URL{Path: display}).EscapedPath()
+		if strings.Contains(display, ":") {
+			// keep a colon in the first segment from reading as a scheme.
+			href = "./" + href
+		}
+		fmt.Fprintf(&b, "      <li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(display))
+	}
+	b.WriteString("    </ul>\n  </body>\n</html>\n")
+
+	body := []byte(b.String())
+	h := internal.GetDefaultHeaders(len(body))
+	h.Set("Content-Type", "text/html; charset=utf-8")
+	if err := w.WriteStatusLine(internal.StatusOK); err != nil {
+		slog.Error("error writing the status-line to the connection", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
+		return
+	}
+	if r.RequestLine.Method == "HEAD" {
+		return
+	}
+	if _, err := w.Write(body); err != nil {
+		slog.Error("error writing the body to the connection", "err", err)
+	}
+}
+
+// httpRange is a byte range of a representation.
+type httpRange struct {
+	start, length int64
+}
+
+func (ra httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.start+ra.length-1, size)
+}
+
+var errUnsatisfiableRange = errors.New("unsatisfiable range")
+
+// parseRange parses a Range header of the bytes unit for a
+// representation of size bytes, see [RFC 9110 Section 14.1.2]. It
+// returns no range without header, an error for an invalid header, to be
+// ignored, and errUnsatisfiableRange if no range overlaps the
+// representation. Ranges asking for more bytes than the representation
+// are reported as invalid, so the whole representation is sent instead.
+//
+// [RFC 9110 Section 14.1.2]: https://www.rfc-editor.org/rfc/rfc9110#name-byte-ranges
+func parseRange(s string, size int64) ([]httpRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	spec, found := strings.CutPrefix(s, "bytes=")
+	if !found {
+		return nil, errors.New("invalid range unit")
+	}
+	var ranges []httpRange
+	var total int64
+	for _, ra := range strings.Split(spec, ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		first, last, found := strings.Cut(ra, "-")
+		if !found {
+			return nil, errors.New("invalid range")
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var r httpRange
+		if first == "" {
+			// suffix-range: the last n bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid range")
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = httpRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errors.New("invalid range")
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, errors.New("invalid range")
+				}
+			}
+			if start >= size {
+				continue
+			}
+			end = min(end, size-1)
+			r = httpRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+		total += r.length
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	if total > size {
+		return nil, errors.New("ranges exceed the representation")
+	}
+	return ranges, nil
+}
+
+// multipartRanges returns the multipart/byteranges body of the ranges
+// of content and its length, see [RFC 9110 Section 14.6].
+//
+// [RFC 9110 Section 14.6]: https://www.rfc-editor.org/rfc/rfc9110#name-media-type-multipart-byteran
+func multipartRanges(content io.ReadSeeker, ranges []httpRange, size int64, ctype, boundary string) (io.Reader, int64) {
+	var parts []io.Reader
+	var length int64
+	add := func(r io.Reader, n int64) {
+		parts = append(parts, r)
+		length += n
+	}
+	for i, ra := range ranges {
+		var head string
+		if i > 0 {
+			head = "\r\n"
+		}
+		head += fmt.Sprintf("--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, ctype, ra.contentRange(size))
+		add(strings.NewReader(head), int64(len(head)))
+		add(io.NewSectionReader(readerAt(content), ra.start, ra.length), ra.length)
+	}
+	tail := "\r\n--" + boundary + "--\r\n"
+	add(strings.NewReader(tail), int64(len(tail)))
+	return io.MultiReader(parts...), length
+}
+
+// readerAt returns content as an [io.ReaderAt], seeking for every read
+// if it does not implement it.
+func readerAt(content io.ReadSeeker) io.ReaderAt {
+	if ra, ok := content.(io.ReaderAt); ok {
+		return ra
+	}
+	return seekReaderAt{content}
+}
+
+type seekReaderAt struct {
+	rs io.ReadSeeker
+}
+
+func (s seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := s.rs.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.rs, p)
+}
+
+func randomBoundary() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// sniffLen is the number of bytes looked at to detect a content type.
+const sniffLen = 512
+
+// sniffSignatures are the leading bytes of common binary formats.
+var sniffSignatures = []struct {
+	prefix string
+	ctype  string
+}{
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"%PDF-", "application/pdf"},
+	{"PK\x03\x04", "application/zip"},
+	{"\x1f\x8b\x08", "application/gzip"},
+	{"\x00asm", "application/wasm"},
+}
+
+// sniffContentType detects the content type of a file without known
+// extension from its first bytes, in the spirit of the MIME Sniffing
+// Standard: binary signatures first, then markup, then text or binary.
+func sniffContentType(data []byte) string {
+	for _, sig := range sniffSignatures {
+		if bytes.HasPrefix(data, []byte(sig.prefix)) {
+			return sig.ctype
+		}
+	}
+	if len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP" {
+		return "image/webp"
+	}
+
+	trimmed := bytes.TrimLeft(data, "\t\n\x0c\r ")
+	lower := bytes.ToLower(trimmed[:min(len(trimmed), 14)])
+	for _, tag := range []string{"<!doctype html", "<html", "<head", "<body", "<script", "<div", "<p"} {
+		if bytes.HasPrefix(lower, []byte(tag)) {
+			return "text/html; charset=utf-8"
+		}
+	}
+	if bytes.HasPrefix(trimmed, []byte("<?xml")) {
+		return "text/xml; charset=utf-8"
+	}
+
+	for _, c := range data {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != 0x0c && c != 0x1b {
+			return "application/octet-stream"
+		}
+	}
+	// a multi-byte sequence cut at the end is still text.
+	if !utf8.Valid(trimIncompleteRune(data)) {
+		return "application/octet-stream"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// trimIncompleteRune removes a multi-byte sequence cut at the end of data.
+func trimIncompleteRune(data []byte) []byte {
+	for i := 1; i < utf8.UTFMax && i <= len(data); i++ {
+		if utf8.RuneStart(data[len(data)-i]) {
+			if !utf8.FullRune(data[len(data)-i:]) {
+				return data[:len(data)-i]
+			}
+			break
+		}
+	}
+	return data
+}
+
+// writeFSError answers 404 for missing files, 403 for the ones that
+// cannot be read and 500 otherwise.
+func writeFSError(w *internal.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		writeStatus(w, internal.StatusNotFound, internal.NewHeaders())
+	case errors.Is(err, fs.ErrPermission):
+		writeStatus(w, internal.StatusForbidden, internal.NewHeaders())
+	default:
+		slog.Error("error reading the file", "err", err)
+		writeStatus(w, internal.StatusInternalServerError, internal.NewHeaders())
+	}
+}
+
+// writeStatus answers with code and the headers h, the status text
+// being the body.
+func writeStatus(w *internal.ResponseWriter, code internal.HTTPStatusCode, h internal.HTTPHeaders) {
+	body := []byte(fmt.Sprintf("%d %s\n", code, internal.StatusText(code)))
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Connection", "close")
+	if err := w.WriteStatusLine(code); err != nil {
+		slog.Error("error writing the status-line to the connection", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
+		return
+	}
+	if _, err := w.Write(body); err != nil {
+		slog.Error("error writing the body to the connection", "err", err)
+	}
+}
+
+// writeHeadOnly answers with code and the headers h without body.
+func writeHeadOnly(w *internal.ResponseWriter, code internal.HTTPStatusCode, h internal.HTTPHeaders) {
+	h.Set("Connection", "close")
+	if err := writeHead(w.Writer, code, h); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
+	}
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"httpfromtcp/internal"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var modTime = time.Date(2024, time.March, 1, 10, 0, 0, 0, time.UTC)
+
+func testFS() fstest.MapFS {
+	return fstest.MapFS{
+		"hello.txt":           {Data: []byte("hello, world"), ModTime: modTime},
+		"noext":               {Data: []byte("<!DOCTYPE html><p>hi</p>"), ModTime: modTime},
+		"site/index.html":     {Data: []byte("<h1>site</h1>"), ModTime: modTime},
+		"empty/.keep":         {Data: nil, ModTime: modTime},
+		"docs/a b.txt":        {Data: []byte("a"), ModTime: modTime},
+		"docs/<script>.txt":   {Data: []byte("b"), ModTime: modTime},
+		"docs/sub/readme.txt": {Data: []byte("c"), ModTime: modTime},
+	}
+}
+
+func fileRequest(method, target string, headers ...string) *internal.Request {
+	r := internal.NewRequest(method, target)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Headers.Set(headers[i], headers[i+1])
+	}
+	return r
+}
+
+func TestFileServer(t *testing.T) {
+	lastModified := internal.FormatHTTPDate(modTime)
+	fsrv := NewFileServer(testFS(), WithDirectoryListing())
+	etag := proxyRequest(t, fsrv.Handle, fileRequest("GET", "/hello.txt")).GetHeader("ETag")
+	assert.NotEmpty(t, etag)
+
+	testCases := []struct {
+		name     string
+		request  *internal.Request
+		status   internal.HTTPStatusCode
+		ctype    string
+		expected string
+		headers  map[string]string
+	}{
+		{
+			name:     "file",
+			request:  fileRequest("GET", "/hello.txt"),
+			status:   internal.StatusOK,
+			ctype:    "text/plain; charset=utf-8",
+			expected: "hello, world",
+			headers:  map[string]string{"Last-Modified": lastModified, "Accept-Ranges": "bytes"},
+		},
+		{
+			name:    "head",
+			request: fileRequest("HEAD", "/hello.txt"),
+			status:  internal.StatusOK,
+			ctype:   "text/plain; charset=utf-8",
+			headers: map[string]string{"Content-Length": "12"},
+		},
+		{
+			name:     "sniffed content type",
+			request:  fileRequest("GET", "/noext"),
+			status:   internal.StatusOK,
+			ctype:    "text/html; charset=utf-8",
+			expected: "<!DOCTYPE html><p>hi</p>",
+		},
+		{
+			name:     "index file",
+			request:  fileRequest("GET", "/site/"),
+			status:   internal.StatusOK,
+			ctype:    "text/html; charset=utf-8",
+			expected: "<h1>site</h1>",
+		},
+		{
+			name:    "directory redirect",
+			request: fileRequest("GET", "/site?x=1"),
+			status:  internal.StatusMovedPermanently,
+			headers: map[string]string{"Location": "/site/?x=1"},
+		},
+		{
+			name:    "missing file",
+			request: fileRequest("GET", "/missing.txt"),
+			status:  internal.StatusNotFound,
+		},
+		{
+			name:    "traversal stays in the root",
+			request: fileRequest("GET", "/../../hello.txt"),
+			status:  internal.StatusOK,
+		},
+		{
+			name:    "encoded traversal stays in the root",
+			request: fileRequest("GET", "/docs/%2e%2e/%2e%2e/missing"),
+			status:  internal.StatusNotFound,
+		},
+		{
+			name:    "backslash",
+			request: fileRequest("GET", "/docs\\..\\hello.txt"),
+			status:  internal.StatusBadRequest,
+		},
+		{
+			name:    "method not allowed",
+			request: fileRequest("POST", "/hello.txt"),
+			status:  internal.StatusMethodNotAllowed,
+			headers: map[string]string{"Allow": "GET, HEAD"},
+		},
+		{
+			name:    "if-none-match",
+			request: fileRequest("GET", "/hello.txt", "If-None-Match", etag),
+			status:  internal.StatusNotModified,
+		},
+		{
+			name:    "if-modified-since",
+			request: fileRequest("GET", "/hello.txt", "If-Modified-Since", lastModified),
+			status:  internal.StatusNotModified,
+		},
+		{
+			name:     "if-modified-since before the change",
+			request:  fileRequest("GET", "/hello.txt", "If-Modified-Since", internal.FormatHTTPDate(modTime.Add(-time.Hour))),
+			status:   internal.StatusOK,
+			expected: "hello, world",
+		},
+		{
+			name:    "if-match fails",
+			request: fileRequest("GET", "/hello.txt", "If-Match", `"other"`),
+			status:  internal.StatusPreconditionFailed,
+		},
+		{
+			name:    "if-unmodified-since fails",
+			request: fileRequest("GET", "/hello.txt", "If-Unmodified-Since", internal.FormatHTTPDate(modTime.Add(-time.Hour))),
+			status:  internal.StatusPreconditionFailed,
+		},
+		{
+			name:     "single range",
+			request:  fileRequest("GET", "/hello.txt", "Range", "bytes=7-"),
+			status:   internal.StatusPartialContent,
+			expected: "world",
+			headers:  map[string]string{"Content-Range": "bytes 7-11/12"},
+		},
+		{
+			name:     "suffix range",
+			request:  fileRequest("GET", "/hello.txt", "Range", "bytes=-5"),
+			status:   internal.StatusPartialContent,
+			expected: "world",
+			headers:  map[string]string{"Content-Range": "bytes 7-11/12"},
+		},
+		{
+			name:    "unsatisfiable range",
+			request: fileRequest("GET", "/hello.txt", "Range", "bytes=20-30"),
+			status:  internal.StatusRangeNotSatisfiable,
+			headers: map[string]string{"Content-Range": "bytes */12"},
+		},
+		{
+			name:     "invalid range is ignored",
+			request:  fileRequest("GET", "/hello.txt", "Range", "bytes=5-1"),
+			status:   internal.StatusOK,
+			expected: "hello, world",
+		},
+		{
+			name:     "if-range mismatch sends everything",
+			request:  fileRequest("GET", "/hello.txt", "Range", "bytes=0-4", "If-Range", `"old"`),
+			status:   internal.StatusOK,
+			expected: "hello, world",
+		},
+		{
+			name:     "if-range match",
+			request:  fileRequest("GET", "/hello.txt", "Range", "bytes=0-4", "If-Range", etag),
+			status:   internal.StatusPartialContent,
+			expected: "hello",
+		},
+		{
+			name:    "directory without index is listed",
+			request: fileRequest("GET", "/empty/"),
+			status:  internal.StatusOK,
+			ctype:   "text/html; charset=utf-8",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := proxyRequest(t, fsrv.Handle, tc.request)
+			assert.Equal(t, tc.status, resp.ResponseLine.StatusCode)
+			if tc.ctype != "" {
+				assert.Equal(t, tc.ctype, resp.GetHeader("Content-Type"))
+			}
+			if tc.expected != "" {
+				assert.Equal(t, tc.expected, string(resp.Body))
+			}
+			for k, v := range tc.headers {
+				assert.Equal(t, v, resp.GetHeader(k), k)
+			}
+		})
+	}
+}
+
+func TestFileServerMultipleRanges(t *testing.T) {
+	fsrv := NewFileServer(testFS())
+	resp := proxyRequest(t, fsrv.Handle, fileRequest("GET", "/hello.txt", "Range", "bytes=0-4, -5"))
+	assert.Equal(t, internal.StatusPartialContent, resp.ResponseLine.StatusCode)
+
+	mediaType, params, err := mime.ParseMediaType(resp.GetHeader("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+
+	mr := multipart.NewReader(strings.NewReader(string(resp.Body)), params["boundary"])
+	var parts, ranges []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		b, _ := io.ReadAll(p)
+		parts = append(parts, string(b))
+		ranges = append(ranges, p.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain; charset=utf-8", p.Header.Get("Content-Type"))
+	}
+	assert.Equal(t, []string{"hello", "world"}, parts)
+	assert.Equal(t, []string{"bytes 0-4/12", "bytes 7-11/12"}, ranges)
+}
+
+func TestFileServerListing(t *testing.T) {
+	fsrv := NewFileServer(testFS(), WithDirectoryListing())
+	resp := proxyRequest(t, fsrv.Handle, fileRequest("GET", "/docs/"))
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	body := string(resp.Body)
+	assert.Contains(t, body, `<a href="../">../</a>`)
+	assert.Contains(t, body, `<a href="a%20b.txt">a b.txt</a>`)
+	assert.Contains(t, body, `<a href="%3Cscript%3E.txt">&lt;script&gt;.txt</a>`)
+	assert.Contains(t, body, `<a href="sub/">sub/</a>`)
+
+	// without listing a directory without index is forbidden.
+	fsrv = NewFileServer(testFS())
+	resp = proxyRequest(t, fsrv.Handle, fileRequest("GET", "/docs/"))
+	assert.Equal(t, internal.StatusForbidden, resp.ResponseLine.StatusCode)
+}
+
+func TestDirFileServerSymlinkEscape(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(t.TempDir(), "secret.txt")
+	assert.NoError(t, os.WriteFile(secret, []byte("secret"), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "public.txt"), []byte("public"), 0o600))
+	assert.NoError(t, os.Symlink(secret, filepath.Join(dir, "link.txt")))
+
+	fsrv, err := NewDirFileServer(dir, WithFileStripPrefix("/static"))
+	assert.NoError(t, err)
+
+	resp := proxyRequest(t, fsrv.Handle, fileRequest("GET", "/static/public.txt"))
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "public", string(resp.Body))
+
+	resp = proxyRequest(t, fsrv.Handle, fileRequest("GET", "/static/link.txt"))
+	assert.NotEqual(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.NotContains(t, string(resp.Body), "secret")
+}
+
+func TestSniffContentType(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected string
+	}{
+		{"\x89PNG\r\n\x1a\n....", "image/png"},
+		{"%PDF-1.7", "application/pdf"},
+		{"  <html><body>", "text/html; charset=utf-8"},
+		{"<?xml version=\"1.0\"?>", "text/xml; charset=utf-8"},
+		{"plain text\n", "text/plain; charset=utf-8"},
+		{"caf\xc3", "text/plain; charset=utf-8"},
+		{"\x00\x01\x02", "application/octet-stream"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.expected, sniffContentType([]byte(tc.input)), tc.input)
+	}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal"
+	"httpfromtcp/internal/client"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ForwardProxyOptions struct {
+	allowedHosts []string
+	allowedPorts []int
+	client       *client.Client
+	dialTimeout  time.Duration
+}
+
+// ForwardProxy forwards requests with an absolute-form request-target
+// to their origin server and tunnels CONNECT requests, see
+// [RFC 9110 Section 9.3.6].
+//
+// [RFC 9110 Section 9.3.6]: https://www.rfc-editor.org/rfc/rfc9110#name-connect
+type ForwardProxy struct {
+	opts *ForwardProxyOptions
+}
+
+// DefaultForwardProxyOptions allows every host on the ports 80 and 443.
+func DefaultForwardProxyOptions() *ForwardProxyOptions {
+	return &ForwardProxyOptions{
+		allowedPorts: []int{80, 443},
+		client:       client.NewClient(client.WithTimeout(0)),
+		dialTimeout:  10 * time.Second,
+	}
+}
+
+type ForwardProxyOption func(*ForwardProxyOptions)
+
+// WithAllowedHosts restricts the destinations to the hosts given, a host
+// starting with "*." matches its subdomains, e.g. "*.example.com" matches
+// "api.example.com". Every host is allowed by default.
+func WithAllowedHosts(hosts ...string) ForwardProxyOption {
+	return func(opts *ForwardProxyOptions) {
+		opts.allowedHosts = hosts
+	}
+}
+
+// WithAllowedPorts restricts the destinations to the ports given,
+// 80 and 443 by default.
+func WithAllowedPorts(ports ...int) ForwardProxyOption {
+	return func(opts *ForwardProxyOptions) {
+		opts.allowedPorts = ports
+	}
+}
+
+// WithForwardClient sets the client used to reach the origin servers.
+func WithForwardClient(c *client.Client) ForwardProxyOption {
+	return func(opts *ForwardProxyOptions) {
+		opts.client = c
+	}
+}
+
+// WithTunnelDialTimeout sets the timeout of connecting to the
+// destination of a CONNECT request.
+func WithTunnelDialTimeout(d time.Duration) ForwardProxyOption {
+	return func(opts *ForwardProxyOptions) {
+		opts.dialTimeout = d
+	}
+}
+
+// NewForwardProxy creates a new ForwardProxy with options provided.
+func NewForwardProxy(opts ...ForwardProxyOption) *ForwardProxy {
+	o := DefaultForwardProxyOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return &ForwardProxy{opts: o}
+}
+
+// IsProxyRequest reports whether r is meant for a forward proxy, i.e. a
+// CONNECT request or a request with an absolute-form request-target.
+func IsProxyRequest(r *internal.Request) bool {
+	return r.RequestLine.Method == "CONNECT" || strings.Contains(r.RequestLine.RequestTarget, "://")
+}
+
+// Handle is the [Handler] forwarding r to its origin server, answering
+// 403 if the destination is not allowed.
+func (p *ForwardProxy) Handle(w *internal.ResponseWriter, r *internal.Request) {
+	if r.RequestLine.Method == "CONNECT" {
+		p.tunnel(w, r)
+		return
+	}
+
+	u, err := url.Parse(r.RequestLine.RequestTarget)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		writeProxyError(w, internal.StatusBadRequest, fmt.Errorf("invalid proxy request-target %q", r.RequestLine.RequestTarget))
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+	}
+	if err := p.allow(u.Hostname(), port); err != nil {
+		writeProxyError(w, internal.StatusForbidden, err)
+		return
+	}
+
+	out := internal.NewRequest(r.RequestLine.Method, u.String())
+	copyHeaders(out.Headers, r.Headers)
+	out.Headers.Delete("Host")
+	appendHeader(out.Headers, "Via", "1.1 httpfromtcp")
+	out.Body = r.Body
+
+	resp, body, err := p.opts.client.Stream(r.Context(), out)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	relayResponse(w, r, resp, body)
+}
+
+// tunnel connects to the authority-form request-target of the CONNECT
+// request r and relays the bytes in both directions until either side
+// closes the connection.
+func (p *ForwardProxy) tunnel(w *internal.ResponseWriter, r *internal.Request) {
+	host, port, err := net.SplitHostPort(r.RequestLine.RequestTarget)
+	if err != nil {
+		writeProxyError(w, internal.StatusBadRequest, err)
+		return
+	}
+	if err := p.allow(host, port); err != nil {
+		writeProxyError(w, internal.StatusForbidden, err)
+		return
+	}
+	if !w.Hijackable() {
+		writeProxyError(w, internal.StatusInternalServerError, errors.New("connection does not support tunneling"))
+		return
+	}
+
+	dst, err := net.DialTimeout("tcp", r.RequestLine.RequestTarget, p.opts.dialTimeout)
+	if err != nil {
+		writeUpstreamError(w, err)
+		return
+	}
+	defer func() {
+		_ = dst.Close()
+	}()
+
+	if _, err := io.WriteString(w, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		slog.Error("error writing the status-line to the connection", "err", err)
+		return
+	}
+	nc, br, err := w.Hijack()
+	if err != nil {
+		slog.Error("error hijacking the connection", "err", err)
+		return
+	}
+	defer func() {
+		_ = nc.Close()
+	}()
+	relay(hijackedConn{Conn: nc, br: br}, dst)
+}
+
+// hijackedConn is a hijacked connection reading through the reader the
+// request was parsed from, so that the bytes the client sent right
+// after the request are relayed too.
+type hijackedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c hijackedConn) Read(p []byte) (int, error) {
+	return c.br.Read(p)
+}
+
+// CloseWrite closes the write half of the connection, or the whole
+// connection if it does not support half-close.
+func (c hijackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// allow returns an error unless host and port are allowed destinations.
+func (p *ForwardProxy) allow(host, port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil || !slices.Contains(p.opts.allowedPorts, n) {
+		return fmt.Errorf("destination port %s is not allowed", port)
+	}
+	if len(p.opts.allowedHosts) == 0 {
+		return nil
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	for _, allowed := range p.opts.allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
+		}
+	}
+	return fmt.Errorf("destination host %s is not allowed", host)
+}
+
+// closeWriter is implemented by connections supporting half-close,
+// like [*net.TCPConn] and [*net.UnixConn].
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies between a and b in both directions. Once one side stops
+// sending the write half of the other one is closed, and relay returns
+// when both directions are done.
+func relay(a, b io.ReadWriter) {
+	var wg sync.WaitGroup
+	copyHalf := func(dst, src io.ReadWriter) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("error relaying the tunnel", "err", err)
+		}
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		} else if c, ok := dst.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}
+	wg.Add(2)
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bufio"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func portOf(t *testing.T, addr string) int {
+	t.Helper()
+	_, port, err := net.SplitHostPort(addr)
+	assert.NoError(t, err)
+	n, err := strconv.Atoi(port)
+	assert.NoError(t, err)
+	return n
+}
+
+func TestForwardProxyAbsoluteForm(t *testing.T) {
+	origin, received := standInUpstream(t, "HTTP/1.1 201 Created\r\nContent-Length: 2\r\n\r\nok")
+	host := origin[len("http://"):]
+	p := NewForwardProxy(WithAllowedHosts("127.0.0.1"), WithAllowedPorts(portOf(t, host)))
+
+	r := internal.NewRequest("POST", origin+"/items?id=1")
+	r.Headers.Set("Host", host)
+	r.Headers.Set("Proxy-Connection", "keep-alive")
+	r.Body = []byte("item")
+
+	resp := proxyRequest(t, p.Handle, r)
+	assert.Equal(t, internal.StatusCreated, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "ok", string(resp.Body))
+
+	out := <-received
+	assert.Equal(t, "POST", out.RequestLine.Method)
+	assert.Equal(t, "/items?id=1", out.RequestLine.RequestTarget)
+	assert.Equal(t, host, out.GetHeader("Host"))
+	assert.Equal(t, "1.1 httpfromtcp", out.GetHeader("Via"))
+	assert.Empty(t, out.GetHeader("Proxy-Connection"))
+	assert.Equal(t, "item", string(out.Body))
+}
+
+func TestForwardProxyDenied(t *testing.T) {
+	p := NewForwardProxy(WithAllowedHosts("example.com", "*.example.org"))
+
+	testCases := []struct {
+		name   string
+		method string
+		target string
+		status internal.HTTPStatusCode
+	}{
+		{
+			name:   "port not allowed",
+			method: "GET",
+			target: "http://example.com:8080/",
+			status: internal.StatusForbidden,
+		},
+		{
+			name:   "host not allowed",
+			method: "GET",
+			target: "http://example.net/",
+			status: internal.StatusForbidden,
+		},
+		{
+			name:   "wildcard does not match the domain itself",
+			method: "CONNECT",
+			target: "example.org:443",
+			status: internal.StatusForbidden,
+		},
+		{
+			name:   "connect port not allowed",
+			method: "CONNECT",
+			target: "example.com:22",
+			status: internal.StatusForbidden,
+		},
+		{
+			name:   "connect without port",
+			method: "CONNECT",
+			target: "example.com",
+			status: internal.StatusBadRequest,
+		},
+		{
+			name:   "https absolute-form",
+			method: "GET",
+			target: "https://example.com/",
+			status: internal.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := proxyRequest(t, p.Handle, internal.NewRequest(tc.method, tc.target))
+			assert.Equal(t, tc.status, resp.ResponseLine.StatusCode)
+		})
+	}
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	testCases := []struct {
+		name string
+		wrap Middleware
+	}{
+		{name: "direct", wrap: func(h Handler) Handler { return h }},
+		{name: "behind the compressor", wrap: NewCompressor().Middleware},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the destination echoes what it receives.
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			assert.NoError(t, err)
+			defer ln.Close()
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+
+			path := filepath.Join(t.TempDir(), "proxy.sock")
+			p := NewForwardProxy(WithAllowedHosts("127.0.0.1"), WithAllowedPorts(portOf(t, ln.Addr().String())))
+			srv := NewServer(WithUnix(path))
+			assert.NoError(t, srv.Serve(tc.wrap(p.Handle)))
+			defer srv.Close()
+
+			conn, err := net.Dial("unix", path)
+			assert.NoError(t, err)
+			defer conn.Close()
+			_, err = io.WriteString(conn, "CONNECT "+ln.Addr().String()+" HTTP/1.1\r\nHost: "+ln.Addr().String()+"\r\n\r\n")
+			assert.NoError(t, err)
+
+			br := bufio.NewReader(conn)
+			resp, err := internal.ReadResponseHead(br)
+			assert.NoError(t, err)
+			assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+			assert.Equal(t, "Connection Established", resp.ResponseLine.ReasonPhrase)
+
+			_, err = io.WriteString(conn, "ping")
+			assert.NoError(t, err)
+			assert.NoError(t, conn.(*net.UnixConn).CloseWrite())
+			echoed, err := io.ReadAll(br)
+			assert.NoError(t, err)
+			assert.Equal(t, "ping", string(echoed))
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+)
+
+// headInterceptor is handed to a wrapped handler in place of the
+// connection. It collects the status-line and the headers the handler
+// writes and passes them to onHead, the bytes following them are written
+// to the writer onHead returns, still framed as the head declares.
+type headInterceptor struct {
+	head   []byte
+	onHead func(resp *internal.Response) (io.Writer, error)
+	body   io.Writer
+}
+
+func newHeadInterceptor(onHead func(resp *internal.Response) (io.Writer, error)) *headInterceptor {
+	return &headInterceptor{onHead: onHead}
+}
+
+func (hi *headInterceptor) Write(p []byte) (int, error) {
+	if hi.body != nil {
+		return hi.body.Write(p)
+	}
+	hi.head = append(hi.head, p...)
+	end := bytes.Index(hi.head, []byte("\r\n\r\n"))
+	if end == -1 {
+		return len(p), nil
+	}
+	end += len("\r\n\r\n")
+
+	resp, err := internal.ReadResponseHead(bufio.NewReader(bytes.NewReader(hi.head[:end])))
+	if err != nil {
+		return 0, err
+	}
+	if hi.body, err = hi.onHead(resp); err != nil {
+		return 0, err
+	}
+	if rest := hi.head[end:]; len(rest) > 0 {
+		if _, err := hi.body.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	hi.head = nil
+	return len(p), nil
+}
+
+// Flush passes the flush of the wrapped handler on to the writer of the
+// body, once the head was written.
+func (hi *headInterceptor) Flush() error {
+	if f, ok := hi.body.(internal.Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// hijackInterceptor is a [headInterceptor] letting the wrapped handler
+// hijack the connection of w, for middleware that only observes the
+// response.
+type hijackInterceptor struct {
+	*headInterceptor
+	w *internal.ResponseWriter
+}
+
+// Hijack implements [internal.Hijacker].
+func (hi *hijackInterceptor) Hijack() (net.Conn, *bufio.Reader, error) {
+	return hi.w.Hijack()
+}
+
+// wroteHead reports whether the handler wrote a complete head.
+func (hi *headInterceptor) wroteHead() bool {
+	return hi.body != nil
+}
+
+// writeHead writes the status-line and headers of a response to w.
+func writeHead(w io.Writer, code internal.HTTPStatusCode, h internal.HTTPHeaders) error {
+	rw := internal.NewResponseWriter(w)
+	if err := rw.WriteStatusLine(code); err != nil {
+		return err
+	}
+	return rw.WriteHeaders(h)
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// JSONOptions configures [DecodeJSON].
+type JSONOptions struct {
+	maxBodySize    int64
+	disallowFields bool
+}
+
+// DefaultJSONOptions returns the default options of [DecodeJSON], bodies
+// of at most 1MiB whose unknown fields are ignored.
+func DefaultJSONOptions() *JSONOptions {
+	return &JSONOptions{maxBodySize: 1 << 20}
+}
+
+type JSONOption func(*JSONOptions)
+
+// WithMaxBodySize sets the maximum size of the JSON body.
+func WithMaxBodySize(n int64) JSONOption {
+	return func(opts *JSONOptions) {
+		opts.maxBodySize = n
+	}
+}
+
+// WithDisallowUnknownFields rejects the objects with fields that the
+// destination struct does not have.
+func WithDisallowUnknownFields() JSONOption {
+	return func(opts *JSONOptions) {
+		opts.disallowFields = true
+	}
+}
+
+// DecodeJSON decodes the JSON body of r into v. The error is a
+// [HandlerError] with status 415 if the body is not application/json or
+// a +json media type, 413 if it is larger than the maximum size and 400
+// if it is not a single valid JSON value for v.
+//
+// The body is already in memory when DecodeJSON checks its size, the
+// memory it may take being limited by the server with
+// [WithMaxRequestBodySize].
+func DecodeJSON(r *internal.Request, v any, opts ...JSONOption) error {
+	o := DefaultJSONOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.GetHeader("Content-Type"))
+	if err != nil || !isJSONMediaType(mediaType) {
+		return HandlerError{StatusCode: internal.StatusUnsupportedMedia, Message: "Content-Type must be application/json"}
+	}
+	if int64(len(r.Body)) > o.maxBodySize {
+		return HandlerError{StatusCode: internal.StatusRequestTooLarge, Message: fmt.Sprintf("body exceeds %d bytes", o.maxBodySize)}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(r.Body))
+	if o.disallowFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return HandlerError{StatusCode: internal.StatusBadRequest, Message: jsonErrorMessage(err)}
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return HandlerError{StatusCode: internal.StatusBadRequest, Message: "body must contain a single JSON value"}
+	}
+	return nil
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// jsonErrorMessage describes a decoding error for the client.
+func jsonErrorMessage(err error) string {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return fmt.Sprintf("field %q must be a %s", typeErr.Field, typeErr.Type)
+		}
+		return fmt.Sprintf("body must be a %s", typeErr.Type)
+	case errors.Is(err, io.EOF):
+		return "body must not be empty"
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "malformed JSON"
+	}
+	return err.Error()
+}
+
+// WriteJSON writes a response with status code whose body is v encoded
+// as JSON.
+func WriteJSON(w *internal.ResponseWriter, code internal.HTTPStatusCode, v any) error {
+	return writeJSON(w, code, "application/json", v)
+}
+
+func writeJSON(w *internal.ResponseWriter, code internal.HTTPStatusCode, contentType string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	body = append(body, '\n')
+	h := internal.NewHeaders()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Connection", "close")
+	if err := writeHead(w.Writer, code, h); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// Problem is a problem details object of [RFC 9457].
+//
+// [RFC 9457]: https://www.rfc-editor.org/rfc/rfc9457
+type Problem struct {
+	// Type is a URI reference identifying the problem type,
+	// "about:blank" when empty.
+	Type     string
+	Title    string
+	Status   internal.HTTPStatusCode
+	Detail   string
+	Instance string
+	// Extensions are additional members of the object.
+	Extensions map[string]any
+}
+
+// NewProblem returns the [Problem] of the status code, titled by its
+// reason phrase.
+func NewProblem(code internal.HTTPStatusCode, detail string) Problem {
+	return Problem{Title: internal.StatusText(code), Status: code, Detail: detail}
+}
+
+func (p Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]any, len(p.Extensions)+5)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	m["type"] = "about:blank"
+	if p.Type != "" {
+		m["type"] = p.Type
+	}
+	if p.Title != "" {
+		m["title"] = p.Title
+	}
+	if p.Status != 0 {
+		m["status"] = p.Status
+	}
+	if p.Detail != "" {
+		m["detail"] = p.Detail
+	}
+	if p.Instance != "" {
+		m["instance"] = p.Instance
+	}
+	return json.Marshal(m)
+}
+
+// WriteProblem writes p as an application/problem+json response, its
+// status being the one of the response.
+func WriteProblem(w *internal.ResponseWriter, p Problem) error {
+	if p.Status == 0 {
+		p.Status = internal.StatusInternalServerError
+	}
+	return writeJSON(w, p.Status, "application/problem+json", p)
+}
+
+// WriteError writes err as an application/problem+json response, a
+// [HandlerError] sets the status and detail, any other error is a 500
+// whose message is not disclosed.
+func WriteError(w *internal.ResponseWriter, err error) error {
+	var he HandlerError
+	if errors.As(err, &he) {
+		return WriteProblem(w, NewProblem(he.StatusCode, he.Message))
+	}
+	return WriteProblem(w, NewProblem(internal.StatusInternalServerError, ""))
+}
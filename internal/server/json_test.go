@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"httpfromtcp/internal"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type payload struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestDecodeJSON(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contentType string
+		body        string
+		opts        []JSONOption
+		expected    payload
+		status      internal.HTTPStatusCode
+		message     string
+	}{
+		{
+			name:        "valid",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"name":"a","count":2,"extra":true}`,
+			expected:    payload{Name: "a", Count: 2},
+		},
+		{
+			name:        "json suffix",
+			contentType: "application/merge-patch+json",
+			body:        `{"count":1}`,
+			expected:    payload{Count: 1},
+		},
+		{
+			name:        "wrong content type",
+			contentType: "text/plain",
+			body:        `{}`,
+			status:      internal.StatusUnsupportedMedia,
+		},
+		{
+			name:        "too large",
+			contentType: "application/json",
+			body:        `{"name":"0123456789"}`,
+			opts:        []JSONOption{WithMaxBodySize(10)},
+			status:      internal.StatusRequestTooLarge,
+		},
+		{
+			name:        "syntax error",
+			contentType: "application/json",
+			body:        `{"name":}`,
+			status:      internal.StatusBadRequest,
+			message:     "malformed JSON at offset 9",
+		},
+		{
+			name:        "wrong type",
+			contentType: "application/json",
+			body:        `{"count":"two"}`,
+			status:      internal.StatusBadRequest,
+			message:     `field "count" must be a int`,
+		},
+		{
+			name:        "unknown field",
+			contentType: "application/json",
+			body:        `{"name":"a","extra":true}`,
+			opts:        []JSONOption{WithDisallowUnknownFields()},
+			status:      internal.StatusBadRequest,
+			message:     `json: unknown field "extra"`,
+		},
+		{
+			name:        "empty",
+			contentType: "application/json",
+			status:      internal.StatusBadRequest,
+			message:     "body must not be empty",
+		},
+		{
+			name:        "trailing value",
+			contentType: "application/json",
+			body:        `{"name":"a"} {}`,
+			status:      internal.StatusBadRequest,
+			message:     "body must contain a single JSON value",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := internal.NewRequest("POST", "/")
+			r.Headers.Set("Content-Type", tc.contentType)
+			r.Body = []byte(tc.body)
+			var got payload
+			err := DecodeJSON(r, &got, tc.opts...)
+			if tc.status == 0 {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expected, got)
+				return
+			}
+			var he HandlerError
+			assert.True(t, errors.As(err, &he))
+			assert.Equal(t, tc.status, he.StatusCode)
+			if tc.message != "" {
+				assert.Equal(t, tc.message, he.Message)
+			}
+		})
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	h := func(w *internal.ResponseWriter, r *internal.Request) {
+		_ = WriteJSON(w, internal.StatusCreated, payload{Name: "a", Count: 1})
+	}
+	resp := proxyRequest(t, h, internal.NewRequest("GET", "/"))
+	assert.Equal(t, internal.StatusCreated, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "application/json", resp.GetHeader("Content-Type"))
+	assert.Equal(t, "23", resp.GetHeader("Content-Length"))
+	assert.Equal(t, "{\"name\":\"a\",\"count\":1}\n", string(resp.Body))
+}
+
+func TestWriteProblem(t *testing.T) {
+	testCases := []struct {
+		name     string
+		err      error
+		status   internal.HTTPStatusCode
+		expected map[string]any
+	}{
+		{
+			name:   "handler error",
+			err:    HandlerError{StatusCode: internal.StatusBadRequest, Message: "name is required"},
+			status: internal.StatusBadRequest,
+			expected: map[string]any{
+				"type":   "about:blank",
+				"title":  "Bad Request",
+				"status": float64(400),
+				"detail": "name is required",
+			},
+		},
+		{
+			name:   "other error",
+			err:    errors.New("database password is hunter2"),
+			status: internal.StatusInternalServerError,
+			expected: map[string]any{
+				"type":   "about:blank",
+				"title":  "Internal Server Error",
+				"status": float64(500),
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := func(w *internal.ResponseWriter, r *internal.Request) {
+				_ = WriteError(w, tc.err)
+			}
+			resp := proxyRequest(t, h, internal.NewRequest("GET", "/"))
+			assert.Equal(t, tc.status, resp.ResponseLine.StatusCode)
+			assert.Equal(t, "application/problem+json", resp.GetHeader("Content-Type"))
+			var got map[string]any
+			assert.NoError(t, json.Unmarshal(resp.Body, &got))
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+
+	b, err := json.Marshal(Problem{
+		Type:       "https://example.com/probs/out-of-credit",
+		Title:      "You do not have enough credit.",
+		Status:     internal.StatusForbidden,
+		Instance:   "/account/12345/msgs/abc",
+		Extensions: map[string]any{"balance": 30, "type": "ignored"},
+	})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type":"https://example.com/probs/out-of-credit","title":"You do not have enough credit.","status":403,"instance":"/account/12345/msgs/abc","balance":30}`, string(b))
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultLatencyBuckets are the upper bounds in seconds of the buckets
+// of the request duration histogram, the ones of the Prometheus clients.
+var defaultLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// defaultRoute is the route label of every request unless [WithRoute]
+// tells the routes apart.
+const defaultRoute = "other"
+
+// metricsMethods are the methods kept as a label, others being counted
+// as OTHER so that clients cannot create series at will.
+var metricsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE"}
+
+// MetricsOptions configures [Metrics].
+type MetricsOptions struct {
+	path    string
+	buckets []float64
+	route   func(r *internal.Request) string
+}
+
+// DefaultMetricsOptions returns the default options of [Metrics]: the
+// metrics are served on /metrics and every request has the route
+// "other", the paths sent by clients being unbounded.
+func DefaultMetricsOptions() *MetricsOptions {
+	return &MetricsOptions{
+		path:    "/metrics",
+		buckets: defaultLatencyBuckets,
+		route:   func(*internal.Request) string { return defaultRoute },
+	}
+}
+
+type MetricsOption func(*MetricsOptions)
+
+// WithMetricsPath sets the path the metrics are served on.
+func WithMetricsPath(path string) MetricsOption {
+	return func(opts *MetricsOptions) {
+		opts.path = path
+	}
+}
+
+// WithLatencyBuckets sets the upper bounds in seconds of the buckets of
+// the request duration histogram.
+func WithLatencyBuckets(buckets ...float64) MetricsOption {
+	return func(opts *MetricsOptions) {
+		opts.buckets = buckets
+	}
+}
+
+// WithRoute sets the function returning the route label of a request.
+// Every route being a series of its own, it should return the pattern
+// the request matched, such as "/users/:id", rather than its path, and a
+// fixed route such as "other" for the paths it does not know.
+func WithRoute(route func(r *internal.Request) string) MetricsOption {
+	return func(opts *MetricsOptions) {
+		opts.route = route
+	}
+}
+
+// Metrics instruments a [Server] and exposes its metrics in the
+// [Prometheus text format]: the requests by method, route and status,
+// their duration, the requests in flight, the open connections, the
+// bytes read and written and the requests that could not be parsed.
+//
+// The connection metrics are collected by a server created with
+// [WithMetrics], the request metrics by [Metrics.Middleware].
+//
+// [Prometheus text format]: https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+type Metrics struct {
+	opts *MetricsOptions
+
+	mu        sync.Mutex
+	requests  map[requestSeries]uint64
+	durations map[routeSeries]*histogram
+
+	inFlight    atomic.Int64
+	openConns   atomic.Int64
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	parseErrors atomic.Uint64
+}
+
+type requestSeries struct {
+	method, route, status string
+}
+
+type routeSeries struct {
+	method, route string
+}
+
+// histogram counts the observations falling in each bucket, the last
+// count being the ones above the largest bound.
+type histogram struct {
+	counts []uint64
+	sum    float64
+}
+
+// NewMetrics creates a [Metrics].
+func NewMetrics(opts ...MetricsOption) *Metrics {
+	o := DefaultMetricsOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+	o.buckets = slices.Clone(o.buckets)
+	slices.Sort(o.buckets)
+	return &Metrics{
+		opts:      o,
+		requests:  map[requestSeries]uint64{},
+		durations: map[routeSeries]*histogram{},
+	}
+}
+
+// Middleware returns a [Handler] serving the metrics on their path and
+// recording the requests handled by next otherwise. The requests for
+// the metrics are not recorded.
+func (m *Metrics) Middleware(next Handler) Handler {
+	return func(w *internal.ResponseWriter, r *internal.Request) {
+		if targetPath(r) == m.opts.path {
+			m.Handle(w, r)
+			return
+		}
+		m.inFlight.Add(1)
+		defer m.inFlight.Add(-1)
+		start := time.Now()
+
+		var status internal.HTTPStatusCode
+		hi := newHeadInterceptor(func(resp *internal.Response) (io.Writer, error) {
+			status = resp.ResponseLine.StatusCode
+			return w.Writer, writeHead(w.Writer, resp.ResponseLine.StatusCode, resp.Headers)
+		})
+		next(internal.NewResponseWriter(&hijackInterceptor{headInterceptor: hi, w: w}), r)
+		m.observe(r, status, time.Since(start))
+	}
+}
+
+func (m *Metrics) observe(r *internal.Request, status internal.HTTPStatusCode, d time.Duration) {
+	method := r.RequestLine.Method
+	if !slices.Contains(metricsMethods, method) {
+		method = "OTHER"
+	}
+	route := m.opts.route(r)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestSeries{method, route, strconv.Itoa(int(status))}]++
+	h, ok := m.durations[routeSeries{method, route}]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.opts.buckets)+1)}
+		m.durations[routeSeries{method, route}] = h
+	}
+	s := d.Seconds()
+	i, _ := slices.BinarySearch(m.opts.buckets, s)
+	h.counts[i]++
+	h.sum += s
+}
+
+// Handle answers GET and HEAD requests with the metrics.
+func (m *Metrics) Handle(w *internal.ResponseWriter, r *internal.Request) {
+	if r.RequestLine.Method != "GET" && r.RequestLine.Method != "HEAD" {
+		h := internal.NewHeaders()
+		h.Set("Allow", "GET, HEAD")
+		writeStatus(w, internal.StatusMethodNotAllowed, h)
+		return
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		writeStatus(w, internal.StatusInternalServerError, internal.NewHeaders())
+		return
+	}
+	h := internal.GetDefaultHeaders(buf.Len())
+	h.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	if err := writeHead(w, internal.StatusOK, h); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
+		return
+	}
+	if r.RequestLine.Method == "HEAD" {
+		return
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		slog.Error("error writing the body to the connection", "err", err)
+	}
+}
+
+// WriteTo writes the metrics to w in the Prometheus text format, the
+// series of every metric sorted by their labels.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+
+	m.mu.Lock()
+	requests := make([]requestSeries, 0, len(m.requests))
+	for s := range m.requests {
+		requests = append(requests, s)
+	}
+	slices.SortFunc(requests, func(a, b requestSeries) int {
+		return strings.Compare(a.method+"\x00"+a.route+"\x00"+a.status, b.method+"\x00"+b.route+"\x00"+b.status)
+	})
+	writeMetricHeader(&b, "http_requests_total", "counter", "Number of HTTP requests handled, by method, route and status.")
+	for _, s := range requests {
+		fmt.Fprintf(&b, "http_requests_total{method=%s,route=%s,status=%s} %d\n",
+			labelValue(s.method), labelValue(s.route), labelValue(s.status), m.requests[s])
+	}
+
+	routes := make([]routeSeries, 0, len(m.durations))
+	for s := range m.durations {
+		routes = append(routes, s)
+	}
+	slices.SortFunc(routes, func(a, b routeSeries) int {
+		return strings.Compare(a.method+"\x00"+a.route, b.method+"\x00"+b.route)
+	})
+	writeMetricHeader(&b, "http_request_duration_seconds", "histogram", "Duration of the HTTP requests, by method and route.")
+	for _, s := range routes {
+		h := m.durations[s]
+		labels := "method=" + labelValue(s.method) + ",route=" + labelValue(s.route)
+		var count uint64
+		for i, bound := range m.opts.buckets {
+			count += h.counts[i]
+			fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, formatFloat(bound), count)
+		}
+		count += h.counts[len(m.opts.buckets)]
+		fmt.Fprintf(&b, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, count)
+		fmt.Fprintf(&b, "http_request_duration_seconds_sum{%s} %s\n", labels, formatFloat(h.sum))
+		fmt.Fprintf(&b, "http_request_duration_seconds_count{%s} %d\n", labels, count)
+	}
+	m.mu.Unlock()
+
+	writeMetricHeader(&b, "http_requests_in_flight", "gauge", "Number of HTTP requests being handled.")
+	fmt.Fprintf(&b, "http_requests_in_flight %d\n", m.inFlight.Load())
+	writeMetricHeader(&b, "http_open_connections", "gauge", "Number of open connections.")
+	fmt.Fprintf(&b, "http_open_connections %d\n", m.openConns.Load())
+	writeMetricHeader(&b, "http_received_bytes_total", "counter", "Bytes read from the connections.")
+	fmt.Fprintf(&b, "http_received_bytes_total %d\n", m.bytesIn.Load())
+	writeMetricHeader(&b, "http_sent_bytes_total", "counter", "Bytes written to the connections.")
+	fmt.Fprintf(&b, "http_sent_bytes_total %d\n", m.bytesOut.Load())
+	writeMetricHeader(&b, "http_request_parse_errors_total", "counter", "Number of requests that could not be parsed.")
+	fmt.Fprintf(&b, "http_request_parse_errors_total %d\n", m.parseErrors.Load())
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeMetricHeader(b *strings.Builder, name, typ, help string) {
+	b.WriteString("# HELP " + name + " " + help + "\n")
+	b.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// labelValue quotes v as a label value, escaping backslashes, double
+// quotes and newlines.
+func labelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// targetPath returns the path of the target of r, without its query.
+func targetPath(r *internal.Request) string {
+	path, _, _ := strings.Cut(r.RequestLine.RequestTarget, "?")
+	return path
+}
+
+// instrument returns nc counting its bytes and itself as open until it
+// is closed, by the server or by the handler that hijacked it.
+func (m *Metrics) instrument(nc net.Conn) net.Conn {
+	m.openConns.Add(1)
+	return &meteredConn{Conn: nc, m: m}
+}
+
+// meteredConn is a connection of a server instrumented by [Metrics].
+type meteredConn struct {
+	net.Conn
+	m         *Metrics
+	closeOnce sync.Once
+}
+
+func (c *meteredConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.m.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.m.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+func (c *meteredConn) Close() error {
+	c.closeOnce.Do(func() { c.m.openConns.Add(-1) })
+	return c.Conn.Close()
+}
+
+// CloseWrite closes the write half of the connection if it has one, as
+// the tunnels of the forward proxy do.
+func (c *meteredConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
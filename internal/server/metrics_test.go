@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"httpfromtcp/internal"
+	"net"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsWriteTo(t *testing.T) {
+	m := NewMetrics(WithLatencyBuckets(1, 0.1), WithRoute(func(r *internal.Request) string {
+		return r.GetHeader("X-Route")
+	}))
+	for _, o := range []struct {
+		method, route string
+		status        internal.HTTPStatusCode
+		d             time.Duration
+	}{
+		{"GET", "/users/:id", internal.StatusOK, 50 * time.Millisecond},
+		{"GET", "/users/:id", internal.StatusOK, 100 * time.Millisecond},
+		{"GET", "/users/:id", internal.StatusNotFound, 2 * time.Second},
+		{"BREW", `/a"b\c`, internal.StatusBadRequest, 500 * time.Millisecond},
+	} {
+		r := internal.NewRequest(o.method, "/")
+		r.Headers.Set("X-Route", o.route)
+		m.observe(r, o.status, o.d)
+	}
+	m.inFlight.Add(2)
+
+	var buf bytes.Buffer
+	_, err := m.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, `# HELP http_requests_total Number of HTTP requests handled, by method, route and status.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",route="/users/:id",status="200"} 2
+http_requests_total{method="GET",route="/users/:id",status="404"} 1
+http_requests_total{method="OTHER",route="/a\"b\\c",status="400"} 1
+# HELP http_request_duration_seconds Duration of the HTTP requests, by method and route.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{method="GET",route="/users/:id",le="0.1"} 2
+http_request_duration_seconds_bucket{method="GET",route="/users/:id",le="1"} 2
+http_request_duration_seconds_bucket{method="GET",route="/users/:id",le="+Inf"} 3
+http_request_duration_seconds_sum{method="GET",route="/users/:id"} 2.15
+http_request_duration_seconds_count{method="GET",route="/users/:id"} 3
+http_request_duration_seconds_bucket{method="OTHER",route="/a\"b\\c",le="0.1"} 0
+http_request_duration_seconds_bucket{method="OTHER",route="/a\"b\\c",le="1"} 1
+http_request_duration_seconds_bucket{method="OTHER",route="/a\"b\\c",le="+Inf"} 1
+http_request_duration_seconds_sum{method="OTHER",route="/a\"b\\c"} 0.5
+http_request_duration_seconds_count{method="OTHER",route="/a\"b\\c"} 1
+# HELP http_requests_in_flight Number of HTTP requests being handled.
+# TYPE http_requests_in_flight gauge
+http_requests_in_flight 2
+# HELP http_open_connections Number of open connections.
+# TYPE http_open_connections gauge
+http_open_connections 0
+# HELP http_received_bytes_total Bytes read from the connections.
+# TYPE http_received_bytes_total counter
+http_received_bytes_total 0
+# HELP http_sent_bytes_total Bytes written to the connections.
+# TYPE http_sent_bytes_total counter
+http_sent_bytes_total 0
+# HELP http_request_parse_errors_total Number of requests that could not be parsed.
+# TYPE http_request_parse_errors_total counter
+http_request_parse_errors_total 0
+`, buf.String())
+}
+
+func TestMetricsServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	m := NewMetrics(WithMetricsPath("/-/metrics"))
+	srv := NewServer(WithUnix(path), WithMetrics(m))
+	assert.NoError(t, srv.Serve(func(w *internal.ResponseWriter, r *internal.Request) {
+		writeStatus(w, internal.StatusOK, internal.NewHeaders())
+	}))
+	defer srv.Close()
+
+	request := "GET /a?x=1 HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	resp := roundTrip(t, "unix", path, request)
+	assert.Contains(t, string(resp), "200 OK")
+	roundTrip(t, "unix", path, "GET\r\n\r\n")
+	// an idle connection closed by the client is not a parse error.
+	conn, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	// the connections are counted as closed once the server closed them.
+	var out string
+	assert.Eventually(t, func() bool {
+		out = string(roundTrip(t, "unix", path, "GET /-/metrics HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+		return regexp.MustCompile(`(?m)^http_open_connections 1$`).MatchString(out)
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, out, "Content-Type: text/plain; version=0.0.4; charset=utf-8")
+	assert.Contains(t, out, `http_requests_total{method="GET",route="other",status="200"} 1`+"\n")
+	assert.Contains(t, out, `http_request_duration_seconds_count{method="GET",route="other"} 1`+"\n")
+	assert.Contains(t, out, "http_requests_in_flight 0\n")
+	assert.Contains(t, out, "http_request_parse_errors_total 1\n")
+	assert.NotContains(t, out, "/-/metrics")
+
+	received := regexp.MustCompile(`(?m)^http_received_bytes_total (\d+)$`).FindStringSubmatch(out)
+	if assert.Len(t, received, 2) {
+		n, _ := strconv.Atoi(received[1])
+		assert.GreaterOrEqual(t, n, len(request))
+	}
+	sent := regexp.MustCompile(`(?m)^http_sent_bytes_total (\d+)$`).FindStringSubmatch(out)
+	if assert.Len(t, sent, 2) {
+		n, _ := strconv.Atoi(sent[1])
+		assert.GreaterOrEqual(t, n, len(resp))
+	}
+
+	post := roundTrip(t, "unix", path, "POST /-/metrics HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.Contains(t, string(post), "405 Method Not Allowed")
+}
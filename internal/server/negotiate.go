@@ -0,0 +1,62 @@
+package server
+
+import (
+	"httpfromtcp/internal"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Negotiate returns the media type among offers preferred by the Accept
+// header of r, see [internal.Request.Negotiate]. When none is acceptable
+// a 406 response is written to w and "" is returned.
+func Negotiate(w *internal.ResponseWriter, r *internal.Request, offers ...string) string {
+	mediaType := r.Negotiate(offers...)
+	if mediaType == "" {
+		WriteNotAcceptable(w, offers...)
+	}
+	return mediaType
+}
+
+// Vary returns a [Middleware] adding names to the Vary header of the
+// responses, for handlers whose representation depends on these request
+// headers but that write through helpers such as [WriteJSON].
+func Vary(names ...string) Middleware {
+	return func(next Handler) Handler {
+		return func(w *internal.ResponseWriter, r *internal.Request) {
+			hi := newHeadInterceptor(func(resp *internal.Response) (io.Writer, error) {
+				appendHeader(resp.Headers, "Vary", strings.Join(names, ", "))
+				return w.Writer, writeHead(w.Writer, resp.ResponseLine.StatusCode, resp.Headers)
+			})
+			next(internal.NewResponseWriter(&hijackInterceptor{headInterceptor: hi, w: w}), r)
+		}
+	}
+}
+
+// WriteNotAcceptable writes a 406 response whose body lists the
+// representations available, as [RFC 9110 Section 15.5.7] suggests.
+//
+// [RFC 9110 Section 15.5.7]: https://www.rfc-editor.org/rfc/rfc9110#name-406-not-acceptable
+func WriteNotAcceptable(w *internal.ResponseWriter, offers ...string) {
+	code := internal.StatusNotAcceptable
+	var b strings.Builder
+	b.WriteString(strconv.Itoa(int(code)) + " " + internal.StatusText(code) + "\n\nAvailable representations:\n")
+	for _, offer := range offers {
+		b.WriteString("- " + offer + "\n")
+	}
+	body := []byte(b.String())
+
+	h := internal.NewHeaders()
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Vary", "Accept")
+	h.Set("Connection", "close")
+	if err := writeHead(w.Writer, code, h); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
+		return
+	}
+	if _, err := w.Write(body); err != nil {
+		slog.Error("error writing the body to the connection", "err", err)
+	}
+}
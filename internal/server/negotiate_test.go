@@ -0,0 +1,48 @@
+package server
+
+import (
+	"httpfromtcp/internal"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateNotAcceptable(t *testing.T) {
+	var got string
+	h := func(w *internal.ResponseWriter, r *internal.Request) {
+		if got = Negotiate(w, r, "text/html", "application/json"); got == "" {
+			return
+		}
+		writeStatus(w, internal.StatusOK, internal.NewHeaders())
+	}
+
+	r := internal.NewRequest("GET", "/")
+	r.Headers.Set("Accept", "application/json")
+	resp := proxyRequest(t, h, r)
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "application/json", got)
+
+	r.Headers.Set("Accept", "image/png")
+	resp = proxyRequest(t, h, r)
+	assert.Equal(t, internal.StatusNotAcceptable, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "Accept", resp.GetHeader("Vary"))
+	assert.Contains(t, string(resp.Body), "- text/html\n- application/json\n")
+	assert.Empty(t, got)
+}
+
+func TestVary(t *testing.T) {
+	h := Vary("Accept")(func(w *internal.ResponseWriter, r *internal.Request) {
+		_ = WriteJSON(w, internal.StatusOK, map[string]string{})
+	})
+	resp := proxyRequest(t, h, internal.NewRequest("GET", "/"))
+	assert.Equal(t, "Accept", resp.GetHeader("Vary"))
+	assert.Equal(t, "{}\n", string(resp.Body))
+
+	h = Vary("Accept", "Accept-Language")(func(w *internal.ResponseWriter, r *internal.Request) {
+		hs := internal.NewHeaders()
+		hs.Set("Vary", "Origin")
+		writeStatus(w, internal.StatusOK, hs)
+	})
+	resp = proxyRequest(t, h, internal.NewRequest("GET", "/"))
+	assert.Equal(t, "Origin, Accept, Accept-Language", resp.GetHeader("Vary"))
+}
@@ -0,0 +1,479 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// httpBufferSize is the size of the body a [net/http] handler may write
+// before its response is sent chunked, the same as net/http buffers.
+const httpBufferSize = 2048
+
+// FromHTTPHandler returns a [Handler] running the [net/http] handler h.
+//
+// The request passed to h has the context of r. Its response is framed
+// as net/http frames it: a body written at once gets a Content-Length,
+// otherwise it is sent chunked, and a missing Content-Type is sniffed
+// with [http.DetectContentType]. The response writer implements
+// [http.Flusher] and [http.Hijacker], through [http.ResponseController]
+// too. Trailers are not supported.
+func FromHTTPHandler(h http.Handler) Handler {
+	return func(w *internal.ResponseWriter, r *internal.Request) {
+		req, err := toHTTPRequest(r)
+		if err != nil {
+			slog.Error("error converting the request", "err", err)
+			writeStatus(w, internal.StatusBadRequest, internal.NewHeaders())
+			return
+		}
+		hw := &httpResponseWriter{rw: w, req: req, header: http.Header{}}
+		h.ServeHTTP(hw, req)
+		if err := hw.finish(); err != nil {
+			slog.Error("error writing the response", "err", err)
+		}
+	}
+}
+
+// ToHTTPHandler returns an [http.Handler] running h.
+//
+// The request passed to h has its body read in full. The framing
+// headers h writes are left to net/http, which decodes a chunked body
+// and keeps the connection alive regardless of Connection: close. The
+// writer of h is flushed through [http.ResponseController] and can be
+// hijacked, for a WebSocket [Upgrade] to work.
+func ToHTTPHandler(h Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, err := fromHTTPRequest(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hc := &httpConnWriter{w: w, rc: http.NewResponseController(w)}
+		hc.hi = newHeadInterceptor(hc.onHead)
+		h(internal.NewResponseWriter(hc), r)
+	})
+}
+
+// FromHTTPMiddleware returns a [Middleware] wrapping handlers with the
+// [net/http] middleware mw.
+func FromHTTPMiddleware(mw func(http.Handler) http.Handler) Middleware {
+	return func(next Handler) Handler {
+		return FromHTTPHandler(mw(ToHTTPHandler(next)))
+	}
+}
+
+// ToHTTPMiddleware returns a [net/http] middleware wrapping handlers
+// with m.
+func ToHTTPMiddleware(m Middleware) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return ToHTTPHandler(m(FromHTTPHandler(next)))
+	}
+}
+
+// toHTTPRequest converts r the way the net/http server parses requests:
+// the Host header moves to Host and the target is kept in RequestURI.
+func toHTTPRequest(r *internal.Request) (*http.Request, error) {
+	target := r.RequestLine.RequestTarget
+	var u *url.URL
+	if r.RequestLine.Method == "CONNECT" && !strings.HasPrefix(target, "/") {
+		u = &url.URL{Host: target}
+	} else {
+		var err error
+		if u, err = url.ParseRequestURI(target); err != nil {
+			return nil, err
+		}
+	}
+
+	header := http.Header{}
+	for k := range r.Headers.HeadersMap {
+		for _, v := range r.Headers.Values(k) {
+			header.Add(k, v)
+		}
+	}
+	host := header.Get("Host")
+	if host == "" {
+		host = u.Host
+	}
+	header.Del("Host")
+	// the body has been decoded.
+	header.Del("Transfer-Encoding")
+
+	var body io.ReadCloser = http.NoBody
+	if len(r.Body) > 0 {
+		body = io.NopCloser(bytes.NewReader(r.Body))
+	}
+	req := &http.Request{
+		Method:        r.RequestLine.Method,
+		URL:           u,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: int64(len(r.Body)),
+		Host:          host,
+		RemoteAddr:    r.RemoteAddr,
+		RequestURI:    target,
+	}
+	return req.WithContext(r.Context()), nil
+}
+
+// fromHTTPRequest converts req, reading its body.
+func fromHTTPRequest(req *http.Request) (*internal.Request, error) {
+	target := req.RequestURI
+	if target == "" {
+		target = req.URL.RequestURI()
+	}
+	r := internal.NewRequest(req.Method, target)
+	for k, vs := range req.Header {
+		for _, v := range vs {
+			r.Headers.Add(k, v)
+		}
+	}
+	if req.Host != "" {
+		r.Headers.Set("Host", req.Host)
+	}
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = b
+	}
+	r.ContentLength = len(r.Body)
+	// a chunked body has been decoded and is now of known length.
+	if len(req.TransferEncoding) > 0 {
+		r.Headers.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+	r.RemoteAddr = req.RemoteAddr
+	return r.WithContext(req.Context()), nil
+}
+
+// httpResponseWriter is the [http.ResponseWriter] of FromHTTPHandler.
+// Like the one of net/http, it buffers the body until it exceeds
+// httpBufferSize, is flushed, or the handler returns, to frame the
+// response with a Content-Length when it can.
+type httpResponseWriter struct {
+	rw     *internal.ResponseWriter
+	req    *http.Request
+	header http.Header
+	// sent is the header as it was when the status was written.
+	sent        http.Header
+	status      int
+	wroteHeader bool
+	headSent    bool
+	buf         []byte
+	// written counts the body bytes, which are not sent for HEAD.
+	written  int
+	body     io.Writer
+	chunked  io.WriteCloser
+	hijacked bool
+}
+
+func (hw *httpResponseWriter) Header() http.Header {
+	return hw.header
+}
+
+// WriteHeader sends an informational status at once, as net/http does,
+// other than 101 Switching Protocols which is final.
+func (hw *httpResponseWriter) WriteHeader(code int) {
+	if hw.hijacked || hw.wroteHeader {
+		return
+	}
+	if code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols {
+		if err := writeHead(hw.rw, internal.HTTPStatusCode(code), toHeaders(hw.header)); err != nil {
+			slog.Error("error writing the informational response", "err", err)
+			return
+		}
+		if err := hw.rw.Flush(); err != nil {
+			slog.Error("error flushing the informational response", "err", err)
+		}
+		return
+	}
+	hw.status = code
+	hw.sent = hw.header.Clone()
+	hw.wroteHeader = true
+}
+
+func (hw *httpResponseWriter) Write(p []byte) (int, error) {
+	if hw.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !bodyAllowedForStatus(hw.status) {
+		return 0, http.ErrBodyNotAllowed
+	}
+	hw.written += len(p)
+	if hw.headSent {
+		if hw.req.Method == "HEAD" {
+			return len(p), nil
+		}
+		return hw.body.Write(p)
+	}
+	hw.buf = append(hw.buf, p...)
+	if len(hw.buf) > httpBufferSize {
+		if err := hw.sendHead(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush implements [http.Flusher].
+func (hw *httpResponseWriter) Flush() {
+	if err := hw.FlushError(); err != nil {
+		slog.Error("error flushing the response", "err", err)
+	}
+}
+
+// FlushError sends the response written so far, it is the flush of
+// [http.ResponseController].
+func (hw *httpResponseWriter) FlushError() error {
+	if hw.hijacked {
+		return http.ErrHijacked
+	}
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.headSent {
+		if err := hw.sendHead(false); err != nil {
+			return err
+		}
+	}
+	return hw.rw.Flush()
+}
+
+// Hijack implements [http.Hijacker], the status written and not sent
+// yet is sent first.
+func (hw *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hw.hijacked {
+		return nil, nil, http.ErrHijacked
+	}
+	if !hw.rw.Hijackable() {
+		return nil, nil, internal.ErrNotHijackable
+	}
+	if hw.wroteHeader && !hw.headSent {
+		if err := hw.sendHead(false); err != nil {
+			return nil, nil, err
+		}
+	}
+	nc, br, err := hw.rw.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	hw.hijacked = true
+	return nc, bufio.NewReadWriter(br, bufio.NewWriter(nc)), nil
+}
+
+// sendHead writes the head and the buffered body. Once the handler
+// returned, final, the length of the body is known.
+func (hw *httpResponseWriter) sendHead(final bool) error {
+	hw.headSent = true
+	h := toHeaders(hw.sent)
+	allowed := bodyAllowedForStatus(hw.status)
+	if allowed && h.Get("Content-Type") == "" && h.Get("Content-Encoding") == "" && len(hw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(hw.buf))
+	}
+	hw.body = hw.rw
+	switch {
+	case !allowed || h.Get("Content-Length") != "" || h.Get("Transfer-Encoding") != "":
+	case final && (hw.req.Method != "HEAD" || hw.written > 0):
+		h.Set("Content-Length", strconv.Itoa(hw.written))
+	case hw.req.Method != "HEAD":
+		h.Set("Transfer-Encoding", "chunked")
+		hw.chunked = internal.NewChunkedWriter(hw.rw)
+		hw.body = hw.chunked
+	}
+	// the server closes the connection after the response.
+	h.Set("Connection", "close")
+
+	if err := writeHead(hw.rw, internal.HTTPStatusCode(hw.status), h); err != nil {
+		return err
+	}
+	// the body of a HEAD response is only kept to sniff its type.
+	if len(hw.buf) > 0 && hw.req.Method != "HEAD" {
+		if _, err := hw.body.Write(hw.buf); err != nil {
+			return err
+		}
+	}
+	hw.buf = nil
+	return nil
+}
+
+// finish sends the response once the handler returned.
+func (hw *httpResponseWriter) finish() error {
+	if hw.hijacked {
+		return nil
+	}
+	if !hw.wroteHeader {
+		hw.WriteHeader(http.StatusOK)
+	}
+	if !hw.headSent {
+		if err := hw.sendHead(true); err != nil {
+			return err
+		}
+	}
+	if hw.chunked != nil {
+		return hw.chunked.Close()
+	}
+	return nil
+}
+
+// bodyAllowedForStatus reports whether a response of status may have a
+// body, see RFC 9110 Section 6.4.1.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// toHeaders converts the header of a net/http response.
+func toHeaders(header http.Header) internal.HTTPHeaders {
+	h := internal.NewHeaders()
+	for k, vs := range header {
+		for _, v := range vs {
+			h.Add(k, v)
+		}
+	}
+	return h
+}
+
+// httpConnWriter is the writer of the [internal.ResponseWriter] of
+// ToHTTPHandler. It passes the head the handler writes on to the
+// [http.ResponseWriter] and decodes the body from its framing.
+type httpConnWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+	hi *headInterceptor
+	// upgrade is the head of a 101 response, which is written to the
+	// connection once it is hijacked rather than through net/http.
+	upgrade *internal.Response
+	pending bytes.Buffer
+}
+
+func (hc *httpConnWriter) Write(p []byte) (int, error) {
+	return hc.hi.Write(p)
+}
+
+func (hc *httpConnWriter) onHead(resp *internal.Response) (io.Writer, error) {
+	if resp.ResponseLine.StatusCode == internal.StatusSwitchingProtocols {
+		hc.upgrade = resp
+		return &hc.pending, nil
+	}
+	header := hc.w.Header()
+	for k := range resp.Headers.HeadersMap {
+		for _, v := range resp.Headers.Values(k) {
+			header.Add(k, v)
+		}
+	}
+	chunked := header.Get("Transfer-Encoding") != ""
+	// net/http frames the body and manages the connection.
+	header.Del("Transfer-Encoding")
+	header.Del("Connection")
+	hc.w.WriteHeader(int(resp.ResponseLine.StatusCode))
+	if chunked {
+		return &dechunkWriter{w: hc.w}, nil
+	}
+	return hc.w, nil
+}
+
+// Flush implements [internal.Flusher].
+func (hc *httpConnWriter) Flush() error {
+	if !hc.hi.wroteHead() || hc.upgrade != nil {
+		return nil
+	}
+	return hc.rc.Flush()
+}
+
+// Hijack implements [internal.Hijacker].
+func (hc *httpConnWriter) Hijack() (net.Conn, *bufio.Reader, error) {
+	nc, brw, err := hc.rc.Hijack()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil, nil, internal.ErrNotHijackable
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if hc.upgrade != nil {
+		if err := writeHead(nc, hc.upgrade.ResponseLine.StatusCode, hc.upgrade.Headers); err != nil {
+			_ = nc.Close()
+			return nil, nil, err
+		}
+		if _, err := hc.pending.WriteTo(nc); err != nil {
+			_ = nc.Close()
+			return nil, nil, err
+		}
+	}
+	return nc, brw.Reader, nil
+}
+
+// dechunkWriter writes the data of the chunked body written to it to w,
+// dropping the chunk framing and the trailer section.
+type dechunkWriter struct {
+	w   io.Writer
+	buf []byte
+	// remaining is the size of the chunk data not written yet.
+	remaining int64
+	// crlf is set once a chunk data is written, before its CRLF.
+	crlf bool
+	done bool
+}
+
+func (d *dechunkWriter) Write(p []byte) (int, error) {
+	if d.done {
+		return len(p), nil
+	}
+	d.buf = append(d.buf, p...)
+	for len(d.buf) > 0 {
+		if d.remaining > 0 {
+			n := min(d.remaining, int64(len(d.buf)))
+			if _, err := d.w.Write(d.buf[:n]); err != nil {
+				return 0, err
+			}
+			d.buf = d.buf[n:]
+			d.remaining -= n
+			d.crlf = d.remaining == 0
+			continue
+		}
+		if d.crlf {
+			if len(d.buf) < 2 {
+				break
+			}
+			d.buf = d.buf[2:]
+			d.crlf = false
+			continue
+		}
+		end := bytes.Index(d.buf, []byte("\r\n"))
+		if end == -1 {
+			break
+		}
+		line, _, _ := strings.Cut(string(d.buf[:end]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("invalid chunk size %q", line)
+		}
+		d.buf = d.buf[end+2:]
+		if size == 0 {
+			d.done = true
+			d.buf = nil
+			break
+		}
+		d.remaining = size
+	}
+	return len(p), nil
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// roundTrip sends the raw request req on a new connection and returns
+// the bytes received until the server closes it.
+func roundTrip(t *testing.T, network, addr, req string) []byte {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, req)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(conn)
+	assert.NoError(t, err)
+	return b
+}
+
+// serveUnix serves h on a unix socket and returns its path.
+func serveUnix(t *testing.T, h Handler) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "http.sock")
+	srv := NewServer(WithUnix(path))
+	assert.NoError(t, srv.Serve(h))
+	t.Cleanup(func() { _ = srv.Close() })
+	return path
+}
+
+// assertSameResponse compares the wire output of both stacks, parsed
+// since the order of the headers differs, ignoring the headers in skip.
+func assertSameResponse(t *testing.T, method string, expected, actual []byte, skip ...string) {
+	t.Helper()
+	want, err := internal.ReadResponse(bufio.NewReader(bytes.NewReader(expected)), method)
+	if !assert.NoError(t, err, "net/http: %q", expected) {
+		return
+	}
+	got, err := internal.ReadResponse(bufio.NewReader(bytes.NewReader(actual)), method)
+	if !assert.NoError(t, err, "server: %q", actual) {
+		return
+	}
+	for _, name := range append(skip, "Date") {
+		want.Headers.Delete(name)
+		got.Headers.Delete(name)
+	}
+	assert.Equal(t, want.ResponseLine.StatusCode, got.ResponseLine.StatusCode)
+	assert.Equal(t, want.Headers, got.Headers)
+	assert.Equal(t, string(want.Body), string(got.Body))
+}
+
+func TestFromHTTPHandlerConformance(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request string
+		handler http.HandlerFunc
+	}{
+		{
+			name:    "small body gets a content-length and a sniffed type",
+			request: "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "<html><body>hello</body></html>")
+			},
+		},
+		{
+			name:    "status, headers and cookies",
+			request: "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+				http.SetCookie(w, &http.Cookie{Name: "b", Value: "2", HttpOnly: true})
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Add("Vary", "Accept")
+				w.Header().Add("Vary", "Cookie")
+				w.WriteHeader(http.StatusCreated)
+				fmt.Fprint(w, `{"ok":true}`)
+				w.Header().Set("X-Late", "ignored")
+			},
+		},
+		{
+			name:    "large body is chunked",
+			request: "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i < 100; i++ {
+					fmt.Fprintf(w, "line %03d %s\n", i, strings.Repeat("x", 40))
+				}
+			},
+		},
+		{
+			name:    "flushed body is chunked",
+			request: "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "first ")
+				w.(http.Flusher).Flush()
+				fmt.Fprint(w, "second")
+			},
+		},
+		{
+			name:    "no content",
+			request: "DELETE /item HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+		{
+			name:    "empty body",
+			request: "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+		},
+		{
+			name:    "head keeps the content-length",
+			request: "HEAD / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "hello")
+			},
+		},
+		{
+			name:    "error",
+			request: "GET /missing HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "not here", http.StatusNotFound)
+			},
+		},
+		{
+			name:    "request is converted",
+			request: "POST /echo?a=1&b=2 HTTP/1.1\r\nHost: example.com:8080\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				assert.NoError(t, err)
+				fmt.Fprintf(w, "%s %s %s %s %q %q %s",
+					r.Method, r.Host, r.RequestURI, r.URL.Path, r.URL.Query().Get("b"),
+					r.Header.Get("Content-Type"), body)
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			hs := httptest.NewServer(tc.handler)
+			defer hs.Close()
+			expected := roundTrip(t, "tcp", hs.Listener.Addr().String(), tc.request)
+
+			path := serveUnix(t, FromHTTPHandler(tc.handler))
+			actual := roundTrip(t, "unix", path, tc.request)
+
+			method, _, _ := strings.Cut(tc.request, " ")
+			assertSameResponse(t, method, expected, actual)
+		})
+	}
+}
+
+func TestToHTTPHandlerConformance(t *testing.T) {
+	testCases := []struct {
+		name    string
+		request string
+		handler Handler
+	}{
+		{
+			name:    "status body",
+			request: "GET /missing HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w *internal.ResponseWriter, r *internal.Request) {
+				writeStatus(w, internal.StatusNotFound, internal.NewHeaders())
+			},
+		},
+		{
+			name:    "chunked body and cookies",
+			request: "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n",
+			handler: func(w *internal.ResponseWriter, r *internal.Request) {
+				assert.NoError(t, w.AddCookie(&internal.Cookie{Name: "a", Value: "1"}))
+				assert.NoError(t, w.AddCookie(&internal.Cookie{Name: "b", Value: "2"}))
+				h := internal.NewHeaders()
+				h.Set("Content-Type", "text/plain")
+				h.Set("Transfer-Encoding", "chunked")
+				assert.NoError(t, w.WriteStatusLine(internal.StatusOK))
+				assert.NoError(t, w.WriteHeaders(h))
+				for _, s := range []string{"first ", "second ", "third"} {
+					_, err := w.WriteChunkedBody([]byte(s))
+					assert.NoError(t, err)
+					assert.NoError(t, w.Flush())
+				}
+				_, err := w.WriteChunkedBodyDone()
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:    "request is converted",
+			request: "PUT /echo?a=1 HTTP/1.1\r\nHost: example.com\r\nX-Custom: v\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello",
+			handler: func(w *internal.ResponseWriter, r *internal.Request) {
+				body := []byte(fmt.Sprintf("%s %s %s %s %d %s",
+					r.RequestLine.Method, r.RequestLine.RequestTarget, r.GetHeader("Host"),
+					r.GetHeader("X-Custom"), r.ContentLength, r.Body))
+				h := internal.GetDefaultHeaders(len(body))
+				assert.NoError(t, w.WriteStatusLine(internal.StatusOK))
+				assert.NoError(t, w.WriteHeaders(h))
+				_, err := w.Write(body)
+				assert.NoError(t, err)
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := serveUnix(t, tc.handler)
+			expected := roundTrip(t, "unix", path, tc.request)
+
+			hs := httptest.NewServer(ToHTTPHandler(tc.handler))
+			defer hs.Close()
+			actual := roundTrip(t, "tcp", hs.Listener.Addr().String(), tc.request)
+
+			// net/http frames the body and manages the connection.
+			method, _, _ := strings.Cut(tc.request, " ")
+			assertSameResponse(t, method, expected, actual, "Content-Length", "Transfer-Encoding", "Connection")
+		})
+	}
+}
+
+func TestHTTPMiddleware(t *testing.T) {
+	header := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Wrapped", r.URL.Path)
+			next.ServeHTTP(w, r)
+		})
+	}
+	h := FromHTTPMiddleware(header)(func(w *internal.ResponseWriter, r *internal.Request) {
+		writeStatus(w, internal.StatusOK, internal.NewHeaders())
+	})
+	resp := proxyRequest(t, h, internal.NewRequest("GET", "/a"))
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "/a", resp.Headers.Get("X-Wrapped"))
+	assert.Equal(t, "200 OK\n", string(resp.Body))
+
+	hs := httptest.NewServer(ToHTTPMiddleware(Timeout(time.Second))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := r.Context().Deadline()
+		fmt.Fprint(w, ok)
+	})))
+	defer hs.Close()
+	res, err := http.Get(hs.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "true", string(body))
+}
+
+func TestToHTTPHandlerWebSocket(t *testing.T) {
+	hs := httptest.NewServer(ToHTTPHandler(func(w *internal.ResponseWriter, r *internal.Request) {
+		ws, err := Upgrade(w, r)
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer ws.Close(CloseNormal, "")
+		typ, msg, err := ws.ReadMessage()
+		assert.NoError(t, err)
+		assert.NoError(t, ws.WriteMessage(typ, msg))
+	}))
+	defer hs.Close()
+
+	conn, err := net.Dial("tcp", hs.Listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(websocketRequest().String()))
+	assert.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := internal.ReadResponseHead(br)
+	assert.NoError(t, err)
+	assert.Equal(t, internal.StatusSwitchingProtocols, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Headers.Get("Sec-WebSocket-Accept"))
+
+	assert.NoError(t, writeFrame(conn, true, opText, testMask, []byte("hi")))
+	f, err := readFrame(br, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, opText, f.opcode)
+	assert.Equal(t, "hi", string(f.payload))
+}
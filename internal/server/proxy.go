@@ -0,0 +1,430 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal"
+	"httpfromtcp/internal/client"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are the hop-by-hop fields that apply to a single connection
+// and are never forwarded, see [RFC 9110 Section 7.6.1].
+//
+// [RFC 9110 Section 7.6.1]: https://www.rfc-editor.org/rfc/rfc9110#name-connection
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type ProxyOptions struct {
+	stripPrefix    string
+	client         *client.Client
+	balancer       Balancer
+	healthPath     string
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+	maxFails       int
+	failTimeout    time.Duration
+}
+
+// ReverseProxy forwards requests to one of its upstream servers and
+// streams their responses back to the client.
+type ReverseProxy struct {
+	backends []*Backend
+	opts     *ProxyOptions
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func DefaultProxyOptions() *ProxyOptions {
+	return &ProxyOptions{
+		// a streamed response may take arbitrarily long.
+		client:        client.NewClient(client.WithTimeout(0)),
+		balancer:      RoundRobin(),
+		healthTimeout: 5 * time.Second,
+		maxFails:      3,
+		failTimeout:   30 * time.Second,
+	}
+}
+
+type ProxyOption func(*ProxyOptions)
+
+// WithStripPrefix removes prefix from the request-target before it is
+// joined with the upstream path.
+func WithStripPrefix(prefix string) ProxyOption {
+	return func(opts *ProxyOptions) {
+		opts.stripPrefix = prefix
+	}
+}
+
+// WithProxyClient sets the client used to reach the upstream.
+func WithProxyClient(c *client.Client) ProxyOption {
+	return func(opts *ProxyOptions) {
+		opts.client = c
+	}
+}
+
+// WithBalancer sets the strategy picking the upstream of a request,
+// [RoundRobin] by default.
+func WithBalancer(b Balancer) ProxyOption {
+	return func(opts *ProxyOptions) {
+		opts.balancer = b
+	}
+}
+
+// WithHealthCheck sends a GET request for path to every upstream each
+// interval. An upstream that does not answer with a 2xx or 3xx status
+// within timeout receives no requests until it passes a check again.
+func WithHealthCheck(path string, interval, timeout time.Duration) ProxyOption {
+	return func(opts *ProxyOptions) {
+		opts.healthPath = path
+		opts.healthInterval = interval
+		opts.healthTimeout = timeout
+	}
+}
+
+// WithPassiveEjection ejects an upstream for d after maxFails consecutive
+// requests could not be sent to it, or until it passes a health check.
+// The requests cancelled, as when their client went away, are not
+// counted but the ones past their deadline, as set by [Timeout], are.
+// A maxFails of 0 disables the ejection.
+func WithPassiveEjection(maxFails int, d time.Duration) ProxyOption {
+	return func(opts *ProxyOptions) {
+		opts.maxFails = maxFails
+		opts.failTimeout = d
+	}
+}
+
+// NewReverseProxy creates a new ReverseProxy forwarding to the upstream
+// URL, e.g. "https://httpbin.org/", with options provided.
+func NewReverseProxy(upstream string, opts ...ProxyOption) (*ReverseProxy, error) {
+	return NewBalancedProxy([]string{upstream}, opts...)
+}
+
+// NewBalancedProxy creates a new ReverseProxy balancing the requests
+// across the upstream URLs with options provided. The health checks,
+// if any, run until [ReverseProxy.Close] is called.
+func NewBalancedProxy(upstreams []string, opts ...ProxyOption) (*ReverseProxy, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("no upstream")
+	}
+	p := &ReverseProxy{
+		opts: DefaultProxyOptions(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	for _, upstream := range upstreams {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid upstream %q", upstream)
+		}
+		p.backends = append(p.backends, newBackend(u))
+	}
+	for _, opt := range opts {
+		opt(p.opts)
+	}
+
+	if p.opts.healthPath != "" && p.opts.healthInterval > 0 {
+		go p.healthCheckLoop()
+	} else {
+		close(p.done)
+	}
+	return p, nil
+}
+
+// Backends returns the upstreams of the proxy.
+func (p *ReverseProxy) Backends() []*Backend {
+	return p.backends
+}
+
+// Close stops the health checks.
+func (p *ReverseProxy) Close() error {
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+	<-p.done
+	return nil
+}
+
+// Handle is the [Handler] forwarding r to the upstream picked by the
+// balancer, answering 503 if none is available.
+//
+// The method, the end-to-end headers and the body of r are forwarded
+// together with the Forwarded and X-Forwarded-* headers. The status and
+// the end-to-end headers of the upstream response are relayed and its
+// body is streamed, using the chunked transfer coding unless the upstream
+// declared a Content-Length.
+func (p *ReverseProxy) Handle(w *internal.ResponseWriter, r *internal.Request) {
+	b := p.opts.balancer.Next(p.backends, r)
+	if b == nil {
+		writeProxyError(w, internal.StatusServiceUnavailable, errors.New("no upstream available"))
+		return
+	}
+	b.active.Add(1)
+	defer b.active.Add(-1)
+
+	out, err := p.outgoingRequest(b.url, r)
+	if err != nil {
+		writeProxyError(w, internal.StatusBadRequest, err)
+		return
+	}
+
+	resp, body, err := p.opts.client.Stream(r.Context(), out)
+	if err != nil {
+		// a request abandoned by its client says nothing of the upstream,
+		// one past its deadline waited on an upstream too slow to answer.
+		if !errors.Is(r.Context().Err(), context.Canceled) {
+			b.failed(p.opts.maxFails, p.opts.failTimeout)
+		}
+		writeUpstreamError(w, err)
+		return
+	}
+	defer func() {
+		_ = body.Close()
+	}()
+	b.succeeded()
+	relayResponse(w, r, resp, body)
+}
+
+// relayResponse writes the status and the end-to-end headers of the
+// upstream response resp to w and streams its body, using the chunked
+// transfer coding unless the upstream declared a Content-Length.
+func relayResponse(w *internal.ResponseWriter, r *internal.Request, resp *internal.Response, body io.Reader) {
+	sc := resp.ResponseLine.StatusCode
+	noBody := r.RequestLine.Method == "HEAD" || sc < 200 || sc == internal.StatusNoContent || sc == internal.StatusNotModified
+
+	hdr := internal.NewHeaders()
+	copyHeaders(hdr, resp.Headers)
+	hdr.Set("Connection", "close")
+	chunked := !noBody && (resp.GetHeader("Content-Length") == "" || resp.GetHeader("Transfer-Encoding") != "")
+	if chunked {
+		hdr.Delete("Content-Length")
+		hdr.Set("Transfer-Encoding", "chunked")
+	}
+
+	if err := w.WriteStatusLine(sc); err != nil {
+		slog.Error("error writing the status-line to the connection", "err", err)
+		return
+	}
+	if err := w.WriteHeaders(hdr); err != nil {
+		slog.Error("error writing the headers to the connection", "err", err)
+		return
+	}
+	if noBody {
+		return
+	}
+
+	var dst io.Writer = w
+	if chunked {
+		cw := internal.NewChunkedWriter(w)
+		defer func() {
+			if err := cw.Close(); err != nil {
+				slog.Error("error writing the end of chunked body to the connection", "err", err)
+			}
+		}()
+		// a body of unknown length may be a stream, sent as it arrives.
+		dst = flushingWriter{w: cw, f: w}
+	}
+	if _, err := io.Copy(dst, body); err != nil {
+		slog.Error("error streaming the upstream body", "err", err)
+	}
+}
+
+// flushingWriter flushes f after every write to w.
+type flushingWriter struct {
+	w io.Writer
+	f internal.Flusher
+}
+
+func (fw flushingWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, fw.f.Flush()
+}
+
+// outgoingRequest builds the request sent to upstream for r.
+func (p *ReverseProxy) outgoingRequest(upstream *url.URL, r *internal.Request) (*internal.Request, error) {
+	in, err := url.ParseRequestURI(r.RequestLine.RequestTarget)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.TrimPrefix(in.Path, p.opts.stripPrefix)
+	target := *upstream
+	target.Path = singleJoiningSlash(upstream.Path, path)
+	target.RawPath = ""
+	target.RawQuery = in.RawQuery
+	if upstream.RawQuery != "" && in.RawQuery != "" {
+		target.RawQuery = upstream.RawQuery + "&" + in.RawQuery
+	} else if upstream.RawQuery != "" {
+		target.RawQuery = upstream.RawQuery
+	}
+
+	out := internal.NewRequest(r.RequestLine.Method, target.String())
+	copyHeaders(out.Headers, r.Headers)
+	out.Headers.Delete("Host")
+	addForwardedHeaders(out.Headers, r)
+	setRequestIDHeader(r.Context(), out.Headers)
+	out.Body = r.Body
+	return out, nil
+}
+
+// healthCheckLoop checks every upstream each health check interval
+// until the proxy is closed.
+func (p *ReverseProxy) healthCheckLoop() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.opts.healthInterval)
+	defer ticker.Stop()
+	for {
+		p.checkHealth()
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth checks the upstreams concurrently and waits for the results.
+func (p *ReverseProxy) checkHealth() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok := p.probe(b)
+			if ok == b.unhealthy.Load() {
+				slog.Info("upstream health changed", "upstream", b.url.String(), "healthy", ok)
+			}
+			b.setHealthy(ok)
+		}()
+	}
+	wg.Wait()
+}
+
+// probe reports whether the health check path of b answers with a 2xx
+// or 3xx status.
+func (p *ReverseProxy) probe(b *Backend) bool {
+	target := *b.url
+	target.Path = singleJoiningSlash(b.url.Path, p.opts.healthPath)
+	target.RawQuery = ""
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.opts.healthTimeout)
+	defer cancel()
+	resp, err := p.opts.client.DoContext(ctx, internal.NewRequest("GET", target.String()))
+	if err != nil {
+		return false
+	}
+	return resp.ResponseLine.StatusCode >= 200 && resp.ResponseLine.StatusCode < 400
+}
+
+// copyHeaders copies the end-to-end headers of src to dst, dropping the
+// hop-by-hop headers and those listed in the Connection header.
+func copyHeaders(dst, src internal.HTTPHeaders) {
+	for k, v := range src.HeadersMap {
+		dst.Set(k, v)
+	}
+	for _, name := range strings.Split(src.Get("Connection"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			dst.Delete(name)
+		}
+	}
+	for _, name := range hopHeaders {
+		dst.Delete(name)
+	}
+}
+
+// addForwardedHeaders records the client and the original host in the
+// Forwarded header of [RFC 7239] and the de facto X-Forwarded-* headers,
+// appending to the values set by previous proxies.
+//
+// [RFC 7239]: https://datatracker.ietf.org/doc/html/rfc7239
+func addForwardedHeaders(h internal.HTTPHeaders, r *internal.Request) {
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = ""
+	}
+	host := r.GetHeader("Host")
+
+	forFor := "unknown"
+	if clientIP != "" {
+		forFor = clientIP
+		if strings.Contains(clientIP, ":") {
+			forFor = `"[` + clientIP + `]"`
+		}
+		appendHeader(h, "X-Forwarded-For", clientIP)
+	}
+	forwarded := "for=" + forFor + ";proto=http"
+	if host != "" {
+		forwarded += ";host=" + quoteForwarded(host)
+		h.Set("X-Forwarded-Host", host)
+	}
+	appendHeader(h, "Forwarded", forwarded)
+	h.Set("X-Forwarded-Proto", "http")
+}
+
+// quoteForwarded quotes a Forwarded parameter value unless it is a token.
+func quoteForwarded(v string) string {
+	if strings.ContainsFunc(v, func(c rune) bool {
+		isAlphaNum := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+		return !isAlphaNum && !strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+	}) {
+		return `"` + strings.ReplaceAll(v, `"`, `\"`) + `"`
+	}
+	return v
+}
+
+// appendHeader appends v to the comma separated list of the header name.
+func appendHeader(h internal.HTTPHeaders, name, v string) {
+	if prior := h.Get(name); prior != "" {
+		v = prior + ", " + v
+	}
+	h.Set(name, v)
+}
+
+func singleJoiningSlash(a, b string) string {
+	switch aslash, bslash := strings.HasSuffix(a, "/"), strings.HasPrefix(b, "/"); {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// writeUpstreamError answers 504 if the upstream timed out and 502 if it
+// could not be reached otherwise.
+func writeUpstreamError(w *internal.ResponseWriter, err error) {
+	code := internal.StatusBadGateway
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = internal.StatusGatewayTimeout
+	}
+	writeProxyError(w, code, err)
+}
+
+// writeProxyError answers with code when the request cannot be proxied.
+func writeProxyError(w *internal.ResponseWriter, code internal.HTTPStatusCode, err error) {
+	slog.Error("error proxying the request", "err", err)
+	writeStatus(w, code, internal.NewHeaders())
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// standInUpstream serves a single connection, hands the received request
+// to the returned channel and replies with the raw response.
+func standInUpstream(t *testing.T, response string) (string, <-chan *internal.Request) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = ln.Close() })
+
+	received := make(chan *internal.Request, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r, err := internal.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		received <- r
+		_, _ = io.WriteString(conn, response)
+	}()
+	return "http://" + ln.Addr().String(), received
+}
+
+// proxyRequest passes r to h and parses the response it writes.
+func proxyRequest(t *testing.T, h Handler, r *internal.Request) *internal.Response {
+	t.Helper()
+	var buf bytes.Buffer
+	h(internal.NewResponseWriter(&buf), r)
+	resp, err := internal.ReadResponse(bufio.NewReader(&buf), r.RequestLine.Method)
+	assert.NoError(t, err)
+	return resp
+}
+
+func TestReverseProxy(t *testing.T) {
+	testCases := []struct {
+		name        string
+		method      string
+		target      string
+		body        string
+		response    string
+		opts        []ProxyOption
+		upstreamURI string
+		status      internal.HTTPStatusCode
+		expected    string
+		chunked     bool
+	}{
+		{
+			name:        "content-length body is passed through",
+			method:      "GET",
+			target:      "/get?a=1",
+			response:    "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nX-Upstream: yes\r\n\r\nhello",
+			upstreamURI: "/get?a=1",
+			status:      internal.StatusOK,
+			expected:    "hello",
+		},
+		{
+			name:        "close-delimited body is chunked",
+			method:      "GET",
+			target:      "/stream",
+			response:    "HTTP/1.1 200 OK\r\nX-Upstream: yes\r\n\r\nstreamed body",
+			upstreamURI: "/stream",
+			status:      internal.StatusOK,
+			expected:    "streamed body",
+			chunked:     true,
+		},
+		{
+			name:        "upstream status is relayed",
+			method:      "POST",
+			target:      "/httpbin/status/418",
+			body:        "payload",
+			response:    "HTTP/1.1 418 I'm a teapot\r\nContent-Length: 3\r\nX-Upstream: yes\r\n\r\ntea",
+			opts:        []ProxyOption{WithStripPrefix("/httpbin")},
+			upstreamURI: "/status/418",
+			status:      418,
+			expected:    "tea",
+		},
+		{
+			name:        "head response has no body",
+			method:      "HEAD",
+			target:      "/",
+			response:    "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nX-Upstream: yes\r\n\r\n",
+			upstreamURI: "/",
+			status:      internal.StatusOK,
+			expected:    "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			upstream, received := standInUpstream(t, tc.response)
+			p, err := NewReverseProxy(upstream, tc.opts...)
+			assert.NoError(t, err)
+
+			r := internal.NewRequest(tc.method, tc.target)
+			r.Headers.Set("Host", "example.com")
+			r.Headers.Set("Connection", "keep-alive, X-Hop")
+			r.Headers.Set("X-Hop", "secret")
+			r.Headers.Set("Accept", "*/*")
+			r.Body = []byte(tc.body)
+			r.RemoteAddr = "192.0.2.1:5000"
+
+			resp := proxyRequest(t, p.Handle, r)
+			assert.Equal(t, tc.status, resp.ResponseLine.StatusCode)
+			assert.Equal(t, "yes", resp.GetHeader("X-Upstream"))
+			assert.Equal(t, tc.expected, string(resp.Body))
+			assert.Equal(t, tc.chunked, resp.GetHeader("Transfer-Encoding") == "chunked")
+
+			out := <-received
+			assert.Equal(t, tc.method, out.RequestLine.Method)
+			assert.Equal(t, tc.upstreamURI, out.RequestLine.RequestTarget)
+			assert.Equal(t, tc.body, string(out.Body))
+			assert.Equal(t, "*/*", out.GetHeader("Accept"))
+			assert.Empty(t, out.GetHeader("X-Hop"))
+			assert.NotEqual(t, "example.com", out.GetHeader("Host"))
+			assert.Equal(t, "192.0.2.1", out.GetHeader("X-Forwarded-For"))
+			assert.Equal(t, "example.com", out.GetHeader("X-Forwarded-Host"))
+			assert.Equal(t, "http", out.GetHeader("X-Forwarded-Proto"))
+			assert.Equal(t, "for=192.0.2.1;proto=http;host=example.com", out.GetHeader("Forwarded"))
+		})
+	}
+}
+
+func TestReverseProxyAppendsForwarded(t *testing.T) {
+	upstream, received := standInUpstream(t, "HTTP/1.1 204 No Content\r\n\r\n")
+	p, err := NewReverseProxy(upstream)
+	assert.NoError(t, err)
+
+	r := internal.NewRequest("GET", "/")
+	r.Headers.Set("Host", "localhost:42069")
+	r.Headers.Set("X-Forwarded-For", "198.51.100.7")
+	r.Headers.Set("Forwarded", "for=198.51.100.7")
+	r.RemoteAddr = "[2001:db8::1]:5000"
+
+	resp := proxyRequest(t, p.Handle, r)
+	assert.Equal(t, internal.StatusNoContent, resp.ResponseLine.StatusCode)
+	assert.Empty(t, resp.GetHeader("Transfer-Encoding"))
+
+	out := <-received
+	assert.Equal(t, "198.51.100.7, 2001:db8::1", out.GetHeader("X-Forwarded-For"))
+	assert.Equal(t, `for=198.51.100.7, for="[2001:db8::1]";proto=http;host="localhost:42069"`, out.GetHeader("Forwarded"))
+}
+
+func TestReverseProxyUnreachableUpstream(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+	assert.NoError(t, ln.Close())
+
+	p, err := NewReverseProxy("http://" + addr)
+	assert.NoError(t, err)
+
+	resp := proxyRequest(t, p.Handle, internal.NewRequest("GET", "/"))
+	assert.Equal(t, internal.StatusBadGateway, resp.ResponseLine.StatusCode)
+}
+
+func TestNewReverseProxyInvalidUpstream(t *testing.T) {
+	for _, upstream := range []string{"", "localhost:8080", "ftp://example.com", "http://"} {
+		_, err := NewReverseProxy(upstream)
+		assert.Error(t, err, upstream)
+	}
+}
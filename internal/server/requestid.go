@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"httpfromtcp/internal"
+	"io"
+	"strings"
+)
+
+// maxRequestIDLength is the length of the longest request ID accepted
+// from a client.
+const maxRequestIDLength = 128
+
+// RequestIDOptions configures [RequestID].
+type RequestIDOptions struct {
+	header   string
+	generate func() string
+}
+
+// DefaultRequestIDOptions returns the default options of [RequestID]:
+// the ID is read from and echoed in X-Request-Id and generated as 32
+// random hexadecimal digits.
+func DefaultRequestIDOptions() *RequestIDOptions {
+	return &RequestIDOptions{
+		header:   "X-Request-Id",
+		generate: newRequestID,
+	}
+}
+
+type RequestIDOption func(*RequestIDOptions)
+
+// WithRequestIDHeader sets the header the request ID is read from,
+// echoed in and forwarded in.
+func WithRequestIDHeader(name string) RequestIDOption {
+	return func(opts *RequestIDOptions) {
+		opts.header = name
+	}
+}
+
+// WithRequestIDGenerator sets the function generating the ID of the
+// requests that do not have one.
+func WithRequestIDGenerator(generate func() string) RequestIDOption {
+	return func(opts *RequestIDOptions) {
+		opts.generate = generate
+	}
+}
+
+// requestIDContextKey is the key of the [requestID] in the context of
+// a request.
+type requestIDContextKey struct{}
+
+// requestID is the ID of a request and the header it goes in.
+type requestID struct {
+	header, id string
+}
+
+// RequestIDFromContext returns the request ID set by [RequestID] in ctx,
+// or "" if there is none.
+func RequestIDFromContext(ctx context.Context) string {
+	rid, _ := ctx.Value(requestIDContextKey{}).(requestID)
+	return rid.id
+}
+
+// RequestID returns a [Middleware] giving every request an ID, stored
+// in its context for [RequestIDFromContext], echoed in the response and
+// forwarded to upstreams by [ReverseProxy].
+//
+// The ID is the one of the request header when it is at most 128
+// visible ASCII characters long, else the trace-id of a valid W3C
+// [traceparent] header, else a generated one.
+//
+// [traceparent]: https://www.w3.org/TR/trace-context/#traceparent-header
+func RequestID(opts ...RequestIDOption) Middleware {
+	o := DefaultRequestIDOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+	return func(next Handler) Handler {
+		return func(w *internal.ResponseWriter, r *internal.Request) {
+			id := r.GetHeader(o.header)
+			if !validRequestID(id) {
+				var ok bool
+				if id, ok = traceID(r.GetHeader("Traceparent")); !ok {
+					id = o.generate()
+				}
+			}
+			r = r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, requestID{header: o.header, id: id}))
+
+			hi := newHeadInterceptor(func(resp *internal.Response) (io.Writer, error) {
+				resp.Headers.Set(o.header, id)
+				return w.Writer, writeHead(w.Writer, resp.ResponseLine.StatusCode, resp.Headers)
+			})
+			next(internal.NewResponseWriter(&hijackInterceptor{headInterceptor: hi, w: w}), r)
+		}
+	}
+}
+
+// setRequestIDHeader sets the request ID of ctx in h, in the header it
+// was read from.
+func setRequestIDHeader(ctx context.Context, h internal.HTTPHeaders) {
+	if rid, ok := ctx.Value(requestIDContextKey{}).(requestID); ok {
+		h.Set(rid.header, rid.id)
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// traceID returns the trace-id of a traceparent header value, reports
+// false if it is not valid.
+//
+//	traceparent = version "-" trace-id "-" parent-id "-" trace-flags
+func traceID(traceparent string) (string, bool) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return "", false
+	}
+	version, trace, parent, flags := parts[0], parts[1], parts[2], parts[3]
+	// version 00 has exactly four fields, later ones may add more.
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return "", false
+	}
+	if !isLowerHex(trace, 32) || !isLowerHex(parent, 16) || !isLowerHex(flags, 2) {
+		return "", false
+	}
+	if strings.Trim(trace, "0") == "" || strings.Trim(parent, "0") == "" {
+		return "", false
+	}
+	return trace, true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !(s[i] >= '0' && s[i] <= '9' || s[i] >= 'a' && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns 128 random bits as 32 hexadecimal digits, the
+// format of a trace-id.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"httpfromtcp/internal"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	testCases := []struct {
+		name     string
+		headers  map[string]string
+		opts     []RequestIDOption
+		expected string
+	}{
+		{
+			name:     "generated",
+			expected: "generated",
+		},
+		{
+			name:     "incoming",
+			headers:  map[string]string{"X-Request-Id": "abc-123"},
+			expected: "abc-123",
+		},
+		{
+			name: "incoming wins over traceparent",
+			headers: map[string]string{
+				"X-Request-Id": "abc-123",
+				"Traceparent":  "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			},
+			expected: "abc-123",
+		},
+		{
+			name:     "traceparent",
+			headers:  map[string]string{"Traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			expected: "4bf92f3577b34da6a3ce929d0e0e4736",
+		},
+		{
+			name:     "invalid incoming",
+			headers:  map[string]string{"X-Request-Id": "has space"},
+			expected: "generated",
+		},
+		{
+			name:     "too long incoming",
+			headers:  map[string]string{"X-Request-Id": strings.Repeat("a", 129)},
+			expected: "generated",
+		},
+		{
+			name:     "invalid traceparent",
+			headers:  map[string]string{"Traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+			expected: "generated",
+		},
+		{
+			name:     "custom header",
+			headers:  map[string]string{"X-Request-Id": "ignored", "X-Correlation-Id": "corr"},
+			opts:     []RequestIDOption{WithRequestIDHeader("X-Correlation-Id")},
+			expected: "corr",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := append([]RequestIDOption{WithRequestIDGenerator(func() string { return "generated" })}, tc.opts...)
+			r := internal.NewRequest("GET", "/")
+			for k, v := range tc.headers {
+				r.Headers.Set(k, v)
+			}
+			var got string
+			resp := proxyRequest(t, RequestID(opts...)(func(w *internal.ResponseWriter, r *internal.Request) {
+				got = RequestIDFromContext(r.Context())
+				writeStatus(w, internal.StatusOK, internal.NewHeaders())
+			}), r)
+			assert.Equal(t, tc.expected, got)
+
+			header := "X-Request-Id"
+			if len(tc.opts) > 0 {
+				header = "X-Correlation-Id"
+			}
+			assert.Equal(t, tc.expected, resp.Headers.Get(header))
+		})
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	testCases := []struct {
+		traceparent string
+		expected    string
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", "4bf92f3577b34da6a3ce929d0e0e4736"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", ""},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", ""},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", ""},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", ""},
+		{"00-4bf92f3577b34da6-00f067aa0ba902b7-01", ""},
+		{"", ""},
+	}
+	for _, tc := range testCases {
+		id, ok := traceID(tc.traceparent)
+		assert.Equal(t, tc.expected, id, tc.traceparent)
+		assert.Equal(t, tc.expected != "", ok, tc.traceparent)
+	}
+	assert.Len(t, newRequestID(), 32)
+	assert.NotEqual(t, newRequestID(), newRequestID())
+}
+
+func TestRequestIDForwarded(t *testing.T) {
+	upstream, received := standInUpstream(t, "HTTP/1.1 204 No Content\r\n\r\n")
+	p, err := NewReverseProxy(upstream)
+	assert.NoError(t, err)
+
+	r := internal.NewRequest("GET", "/")
+	r.Headers.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	resp := proxyRequest(t, RequestID()(p.Handle), r)
+	assert.Equal(t, internal.StatusNoContent, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", resp.Headers.Get("X-Request-Id"))
+
+	out := <-received
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", out.GetHeader("X-Request-Id"))
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", out.GetHeader("Traceparent"))
+}
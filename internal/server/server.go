@@ -1,15 +1,27 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"httpfromtcp/internal"
 	"io"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"sync/atomic"
+	"time"
 )
 
 type Handler func(w *internal.ResponseWriter, r *internal.Request)
 
+// Middleware wraps a [Handler] to act on the requests before it
+// and on the responses it writes.
+type Middleware func(Handler) Handler
+
 type HandlerError struct {
 	StatusCode internal.HTTPStatusCode
 	Message    string
@@ -29,13 +41,30 @@ func Must[T any](x T, err error) T {
 type TransportProtocol string
 
 const (
-	PROTO_UDP TransportProtocol = "udp"
-	PROTO_TCP TransportProtocol = "tcp"
+	PROTO_UDP  TransportProtocol = "udp"
+	PROTO_TCP  TransportProtocol = "tcp"
+	PROTO_UNIX TransportProtocol = "unix"
 )
 
+// defaultWriteBufferSize is the size of the buffer of the response
+// writers unless overridden with [WithWriteBufferSize].
+const defaultWriteBufferSize = 4096
+
+// defaultMaxBodySize is the size of the largest request body read
+// unless overridden with [WithMaxRequestBodySize].
+const defaultMaxBodySize = 32 << 20
+
+// defaultSocketPerm is the file mode applied to unix socket files
+// unless overridden with [WithSocketPerm].
+const defaultSocketPerm os.FileMode = 0660
+
 type ServerOptions struct {
-	proto TransportProtocol
-	addr  string
+	proto           TransportProtocol
+	addr            string
+	socketPerm      os.FileMode
+	writeBufferSize int
+	maxBodySize     int64
+	metrics         *Metrics
 }
 
 type Server struct {
@@ -43,12 +72,18 @@ type Server struct {
 	listener net.Listener
 	handler  func(w *internal.ResponseWriter, r *internal.Request)
 	doneCh   chan bool
+	// ctx is the parent of the request contexts, cancelled by Close.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func DefaultServerOptions() *ServerOptions {
 	return &ServerOptions{
-		proto: PROTO_TCP,
-		addr:  ":42069",
+		proto:           PROTO_TCP,
+		addr:            ":42069",
+		socketPerm:      defaultSocketPerm,
+		writeBufferSize: defaultWriteBufferSize,
+		maxBodySize:     defaultMaxBodySize,
 	}
 }
 
@@ -66,6 +101,50 @@ func WithUDP() ServerOption {
 	}
 }
 
+// WithUnix serves over a unix domain socket created at path.
+func WithUnix(path string) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.proto = PROTO_UNIX
+		opts.addr = path
+	}
+}
+
+// WithSocketPerm sets the file mode of the unix socket file.
+// It has no effect for the other transport protocols.
+func WithSocketPerm(perm os.FileMode) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.socketPerm = perm
+	}
+}
+
+// WithWriteBufferSize sets the size of the buffer of the response
+// writers handed to the handler, 0 disables buffering. The buffered
+// bytes are sent when the handler calls [internal.ResponseWriter.Flush]
+// and when it returns.
+func WithWriteBufferSize(n int) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.writeBufferSize = n
+	}
+}
+
+// WithMaxRequestBodySize sets the size of the largest request body the
+// server reads, 32MiB by default and 0 for no limit. The body of a
+// request is read into memory before the handler is called, larger ones
+// are answered with 413 Content Too Large without being read.
+func WithMaxRequestBodySize(n int64) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.maxBodySize = n
+	}
+}
+
+// WithMetrics instruments the server with m, which also serves the
+// metrics on their path in front of the handler.
+func WithMetrics(m *Metrics) ServerOption {
+	return func(opts *ServerOptions) {
+		opts.metrics = m
+	}
+}
+
 func WithAddr(addr string) ServerOption {
 	return func(opts *ServerOptions) {
 		opts.addr = addr
@@ -80,11 +159,14 @@ func NewServer(opts ...ServerOption) *Server {
 	for _, opt := range opts {
 		opt(o)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		opts:     o,
 		listener: nil,
 		handler:  nil,
 		doneCh:   make(chan bool),
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 }
 
@@ -94,15 +176,25 @@ func (s *Server) Address() string {
 
 func (s *Server) Serve(hf Handler) error {
 	s.handler = hf
+	if s.opts.metrics != nil {
+		s.handler = s.opts.metrics.Middleware(hf)
+	}
+	slog.Info("starting the server", "proto", string(s.opts.proto), "addr", s.opts.addr)
 	switch s.opts.proto {
 	case PROTO_TCP:
-		fmt.Println("starting tcp server")
 		var err error
 		s.listener, err = net.Listen(string(s.opts.proto), s.opts.addr)
 		if err != nil {
 			return err
 		}
 		go s.TCPlisten()
+	case PROTO_UNIX:
+		var err error
+		s.listener, err = listenUnix(s.opts.addr, s.opts.socketPerm)
+		if err != nil {
+			return err
+		}
+		go s.acceptLoop()
 	case PROTO_UDP:
 		s.listener = nil
 		go s.UDPlisten()
@@ -111,70 +203,212 @@ func (s *Server) Serve(hf Handler) error {
 }
 
 func (s *Server) TCPlisten() {
-	defer func() {
-		if err := s.listener.Close(); err != nil {
-			log.Printf("error closing the listener: %v", err)
-		}
-	}()
+	s.acceptLoop()
+}
+
+// acceptLoop accepts connections from the stream listener until
+// it is closed by [Server.Close].
+func (s *Server) acceptLoop() {
 	for {
-		conn := Must(s.listener.Accept())
-		fmt.Printf("accepted the TCP connection from: %d", conn.RemoteAddr())
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("error accepting the connection", "err", err)
+			continue
+		}
+		slog.Debug("accepted the connection", "remote_addr", conn.RemoteAddr().String())
 
 		go s.handleConn(conn)
 	}
 
 }
 
-func (s *Server) UDPlisten() {
+// listenUnix creates the unix socket at path and applies perm to the
+// socket file. A stale socket file left behind by a crashed process is
+// removed first, while a socket that still accepts connections is
+// reported as in use.
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen(string(PROTO_UNIX), path)
+	if err != nil {
+		return nil, err
+	}
+	// remove the socket file once the listener is closed.
+	ln.(*net.UnixListener).SetUnlinkOnClose(true)
+	if err := os.Chmod(path, perm); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// removeStaleSocket removes the socket file at path if no process
+// is listening on it anymore, returns error if the path is not a
+// socket or the socket is still in use.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("%s already exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout(string(PROTO_UNIX), path, time.Second)
+	if err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("socket %s is already in use", path)
+	}
+	return os.Remove(path)
+}
 
-	fmt.Println("starting udp server")
+func (s *Server) UDPlisten() {
 	addr, err := net.ResolveUDPAddr(string(s.opts.proto), s.opts.addr)
 	if err != nil {
-		log.Println(err)
+		slog.Error("error resolving the udp address", "err", err)
 		return
 	}
 	conn, err := net.ListenUDP(string(s.opts.proto), addr)
 	if err != nil {
-		log.Println(err)
+		slog.Error("error listening on udp", "err", err)
 		return
 	}
 	go s.handleConn(conn)
 }
 
-func (s *Server) handleConn(rwc io.ReadWriteCloser) {
-
-	log.Println("hanlding connection")
+func (s *Server) handleConn(nc net.Conn) {
+	// datagrams of other clients must not be read in the background.
+	_, udp := nc.(*net.UDPConn)
+	if s.opts.metrics != nil {
+		nc = s.opts.metrics.instrument(nc)
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	c := &conn{nc: nc, br: bufio.NewReader(nc), cancel: cancel}
 	defer func() {
-		if err := rwc.Close(); err != nil {
-			log.Printf("error closing the connection: %v", err)
+		// a hijacked connection belongs to the handler.
+		if c.hijacked {
+			return
+		}
+		if err := nc.Close(); err != nil {
+			slog.Error("error closing the connection", "err", err)
 		}
 	}()
 
 	// parse the request from the connection.
-	msg, err := internal.MessageFromReader(rwc)
+	r, err := internal.ReadRequestLimit(c.br, s.opts.maxBodySize)
+	if errors.Is(err, internal.ErrBodyTooLarge) {
+		writeStatus(internal.NewResponseWriter(c), internal.StatusRequestTooLarge, internal.NewHeaders())
+		return
+	}
 	if err != nil {
-		log.Printf("error parsing request: %v", err)
+		if !errors.Is(err, io.EOF) {
+			slog.Warn("error parsing the request", "err", err)
+			if s.opts.metrics != nil {
+				s.opts.metrics.parseErrors.Add(1)
+			}
+		}
 		return
 	}
-	r, ok := msg.(*internal.Request)
-	if !ok {
-		log.Println("error converting http message to request")
+	if nc.RemoteAddr() != nil {
+		r.RemoteAddr = nc.RemoteAddr().String()
+	}
+	if !udp {
+		c.startBackgroundRead()
+	}
+
+	responseWriter := internal.NewResponseWriter(c)
+	if s.opts.writeBufferSize > 0 {
+		responseWriter = internal.NewBufferedResponseWriter(c, s.opts.writeBufferSize)
+	}
+
+	s.handler(responseWriter, r.WithContext(ctx))
+	if c.hijacked {
 		return
 	}
+	if err := responseWriter.Flush(); err != nil {
+		slog.Error("error flushing the response", "err", err)
+	}
 
-	responseWriter := internal.NewResponseWriter(rwc)
+}
 
-	s.handler(responseWriter, r)
+// conn is the connection a request was read from, handed to the handler
+// as the writer of its [internal.ResponseWriter]. It implements
+// [internal.Hijacker].
+type conn struct {
+	nc net.Conn
+	// br is the reader the request was parsed from, it may hold the
+	// bytes the client sent after the request.
+	br       *bufio.Reader
+	hijacked bool
+	// cancel cancels the context of the request.
+	cancel   context.CancelFunc
+	bgDone   chan struct{}
+	aborting atomic.Bool
+}
 
+func (c *conn) Write(p []byte) (int, error) {
+	if c.hijacked {
+		return 0, internal.ErrHijacked
+	}
+	return c.nc.Write(p)
 }
 
-func (s *Server) Close() error {
-	return nil
+// Hijack hands the connection over to the caller, handleConn no longer
+// writes to it nor closes it.
+func (c *conn) Hijack() (net.Conn, *bufio.Reader, error) {
+	if c.hijacked {
+		return nil, nil, internal.ErrHijacked
+	}
+	c.abortBackgroundRead()
+	c.hijacked = true
+	return c.nc, c.br, nil
+}
 
+// startBackgroundRead waits for the client to close the connection while
+// the handler runs and cancels the context of the request when it does.
+// Bytes the client sends meanwhile stay in br, which stops the watch.
+func (c *conn) startBackgroundRead() {
+	c.bgDone = make(chan struct{})
+	go func() {
+		defer close(c.bgDone)
+		if _, err := c.br.Peek(1); err != nil && !c.aborting.Load() {
+			c.cancel()
+		}
+	}()
+}
+
+// abortBackgroundRead stops the background read, before handing the
+// reader over to the handler.
+func (c *conn) abortBackgroundRead() {
+	if c.bgDone == nil {
+		return
+	}
+	c.aborting.Store(true)
+	_ = c.nc.SetReadDeadline(time.Unix(1, 0))
+	<-c.bgDone
+	_ = c.nc.SetReadDeadline(time.Time{})
+	c.bgDone = nil
+}
+
+// Close stops accepting new connections and cancels the context of the
+// requests being handled. For unix sockets the socket file is removed
+// as well.
+func (s *Server) Close() error {
+	s.cancel()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
 }
 
 func (s *Server) Done() {
-	fmt.Printf("Sending True to listener to signal end of life\n")
+	slog.Debug("signalling the end of life to the listener")
 	s.doneCh <- true
-	fmt.Printf("already sent\n")
 }
@@ -1,7 +1,15 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -21,6 +29,10 @@ func TestDefaultServerOptions(t *testing.T) {
 			name: "udp",
 			opt:  WithUDP(),
 		},
+		{
+			name: "unix",
+			opt:  WithUnix(filepath.Join(t.TempDir(), "http.sock")),
+		},
 	}
 
 	for _, tc := range testCases {
@@ -32,3 +44,221 @@ func TestDefaultServerOptions(t *testing.T) {
 	}
 
 }
+
+func TestUnixServer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	srv := NewServer(WithUnix(path), WithSocketPerm(0600))
+	err := srv.Serve(func(w *internal.ResponseWriter, r *internal.Request) {
+		body := []byte(r.RequestLine.RequestTarget)
+		_ = w.WriteStatusLine(internal.StatusOK)
+		_ = w.WriteHeaders(internal.GetDefaultHeaders(len(body)))
+		_, _ = w.Write(body)
+	})
+	assert.NoError(t, err)
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	conn, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /unix HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.NoError(t, err)
+
+	msg, err := internal.MessageFromReader(conn)
+	assert.NoError(t, err)
+	resp, ok := msg.(*internal.Response)
+	assert.True(t, ok)
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.Equal(t, []byte("/unix"), resp.Body)
+
+	assert.NoError(t, srv.Close())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMaxBodySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	srv := NewServer(WithUnix(path), WithMaxRequestBodySize(5))
+	var called int
+	assert.NoError(t, srv.Serve(func(w *internal.ResponseWriter, r *internal.Request) {
+		called++
+		writeStatus(w, internal.StatusOK, internal.NewHeaders())
+	}))
+	defer srv.Close()
+
+	resp := roundTrip(t, "unix", path, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 5\r\n\r\nhello")
+	assert.Contains(t, string(resp), "200 OK")
+	// the body announced is never read.
+	resp = roundTrip(t, "unix", path, "POST / HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10000000000\r\n\r\n")
+	assert.Contains(t, string(resp), "413 Content Too Large")
+	resp = roundTrip(t, "unix", path, "POST / HTTP/1.1\r\nHost: localhost\r\nTransfer-Encoding: chunked\r\n\r\n6\r\nhello!\r\n0\r\n\r\n")
+	assert.Contains(t, string(resp), "413 Content Too Large")
+	assert.Equal(t, 1, called)
+}
+
+func TestUnixSocketFile(t *testing.T) {
+	testCases := []struct {
+		name    string
+		setup   func(t *testing.T, path string)
+		wantErr bool
+	}{
+		{
+			name: "stale socket is removed",
+			setup: func(t *testing.T, path string) {
+				ln, err := net.Listen("unix", path)
+				assert.NoError(t, err)
+				ln.(*net.UnixListener).SetUnlinkOnClose(false)
+				assert.NoError(t, ln.Close())
+			},
+		},
+		{
+			name: "socket in use",
+			setup: func(t *testing.T, path string) {
+				ln, err := net.Listen("unix", path)
+				assert.NoError(t, err)
+				t.Cleanup(func() { _ = ln.Close() })
+			},
+			wantErr: true,
+		},
+		{
+			name: "regular file",
+			setup: func(t *testing.T, path string) {
+				assert.NoError(t, os.WriteFile(path, []byte("not a socket"), 0600))
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "http.sock")
+			tc.setup(t, path)
+			srv := NewServer(WithUnix(path))
+			err := srv.Serve(nil)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, srv.Close())
+		})
+	}
+}
+
+func TestHijack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	srv := NewServer(WithUnix(path))
+	errs := make(chan error, 2)
+	err := srv.Serve(func(w *internal.ResponseWriter, r *internal.Request) {
+		nc, br, err := w.Hijack()
+		if err != nil {
+			errs <- err
+			return
+		}
+		_, err = w.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
+		errs <- err
+		_, _, err = w.Hijack()
+		errs <- err
+
+		// the connection outlives the handler.
+		go func() {
+			defer nc.Close()
+			_, _ = io.WriteString(nc, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\n\r\n")
+			_, _ = io.Copy(nc, br)
+		}()
+	})
+	assert.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the first message is sent along with the request.
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\nping")
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, <-errs, internal.ErrHijacked)
+	assert.ErrorIs(t, <-errs, internal.ErrHijacked)
+
+	br := bufio.NewReader(conn)
+	resp, err := internal.ReadResponseHead(br)
+	assert.NoError(t, err)
+	assert.Equal(t, internal.StatusSwitchingProtocols, resp.ResponseLine.StatusCode)
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(br, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+	_, err = io.WriteString(conn, "pong")
+	assert.NoError(t, err)
+	_, err = io.ReadFull(br, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+
+	_, _, err = internal.NewResponseWriter(io.Discard).Hijack()
+	assert.ErrorIs(t, err, internal.ErrNotHijackable)
+}
+
+func TestRequestContext(t *testing.T) {
+	testCases := []struct {
+		name     string
+		cancel   func(srv *Server, conn net.Conn)
+		expected error
+	}{
+		{
+			name:     "client closes the connection",
+			cancel:   func(srv *Server, conn net.Conn) { _ = conn.Close() },
+			expected: context.Canceled,
+		},
+		{
+			name:     "server is closed",
+			cancel:   func(srv *Server, conn net.Conn) { _ = srv.Close() },
+			expected: context.Canceled,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "http.sock")
+			srv := NewServer(WithUnix(path))
+			started := make(chan struct{})
+			done := make(chan error, 1)
+			err := srv.Serve(func(w *internal.ResponseWriter, r *internal.Request) {
+				close(started)
+				select {
+				case <-r.Context().Done():
+					done <- r.Context().Err()
+				case <-time.After(5 * time.Second):
+					done <- nil
+				}
+			})
+			assert.NoError(t, err)
+			defer srv.Close()
+
+			conn, err := net.Dial("unix", path)
+			assert.NoError(t, err)
+			defer conn.Close()
+			_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+			assert.NoError(t, err)
+
+			<-started
+			tc.cancel(srv, conn)
+			assert.ErrorIs(t, <-done, tc.expected)
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	var err error
+	h := Timeout(10 * time.Millisecond)(func(w *internal.ResponseWriter, r *internal.Request) {
+		<-r.Context().Done()
+		err = r.Context().Err()
+		writeStatus(w, internal.StatusGatewayTimeout, internal.NewHeaders())
+	})
+	resp := proxyRequest(t, h, internal.NewRequest("GET", "/slow"))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, internal.StatusGatewayTimeout, resp.ResponseLine.StatusCode)
+}
@@ -0,0 +1,411 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxCookieSize is the size of a cookie browsers are required to keep,
+// see RFC 6265 Section 6.1.
+const maxCookieSize = 4096
+
+var (
+	errInvalidSessionCookie = errors.New("invalid session cookie")
+	errExpiredSessionCookie = errors.New("expired session cookie")
+)
+
+// SessionOptions configures a [SessionManager].
+type SessionOptions struct {
+	cookie        internal.Cookie
+	ttl           time.Duration
+	store         SessionStore
+	encryptionKey []byte
+	now           func() time.Time
+}
+
+// DefaultSessionOptions returns the default options of a
+// [SessionManager]: sessions live 24 hours in an HttpOnly, SameSite=Lax
+// cookie named "session" holding their values.
+func DefaultSessionOptions() *SessionOptions {
+	return &SessionOptions{
+		cookie: internal.Cookie{
+			Name:     "session",
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: internal.SameSiteLax,
+		},
+		ttl: 24 * time.Hour,
+		now: time.Now,
+	}
+}
+
+type SessionOption func(*SessionOptions)
+
+// WithSessionCookie sets the name and the Domain, Path, Secure, HttpOnly,
+// SameSite and Partitioned attributes of the session cookie from c.
+func WithSessionCookie(c internal.Cookie) SessionOption {
+	return func(opts *SessionOptions) {
+		opts.cookie = internal.Cookie{
+			Name:        c.Name,
+			Domain:      c.Domain,
+			Path:        c.Path,
+			Secure:      c.Secure,
+			HttpOnly:    c.HttpOnly,
+			SameSite:    c.SameSite,
+			Partitioned: c.Partitioned,
+		}
+	}
+}
+
+// WithSessionTTL sets how long a session lives after it was last saved.
+func WithSessionTTL(d time.Duration) SessionOption {
+	return func(opts *SessionOptions) {
+		opts.ttl = d
+	}
+}
+
+// WithSessionStore keeps the values of the sessions in store, the cookie
+// only holding the signed session ID.
+func WithSessionStore(store SessionStore) SessionOption {
+	return func(opts *SessionOptions) {
+		opts.store = store
+	}
+}
+
+// WithEncryptionKey encrypts the session cookie with AES-GCM, the key
+// being 16, 24 or 32 bytes long.
+func WithEncryptionKey(key []byte) SessionOption {
+	return func(opts *SessionOptions) {
+		opts.encryptionKey = key
+	}
+}
+
+// SessionManager loads the session of every request from a signed
+// cookie and saves it when the handler writes the response head.
+//
+// Without a [SessionStore] the values are kept in the cookie itself and
+// must be types registered with [gob.Register] unless they are basic
+// types.
+type SessionManager struct {
+	opts    *SessionOptions
+	hashKey []byte
+	aead    cipher.AEAD
+}
+
+// sessionContextKey is the key of the session of a [SessionManager] in
+// the context of a request.
+type sessionContextKey struct {
+	m *SessionManager
+}
+
+// NewSessionManager creates a [SessionManager] signing its cookies with
+// HMAC-SHA256 under hashKey, which must have at least 32 bytes.
+func NewSessionManager(hashKey []byte, opts ...SessionOption) (*SessionManager, error) {
+	o := DefaultSessionOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+	if len(hashKey) < 32 {
+		return nil, errors.New("session hash key must have at least 32 bytes")
+	}
+	if err := o.cookie.Valid(); err != nil {
+		return nil, err
+	}
+	m := &SessionManager{opts: o, hashKey: hashKey}
+	if o.encryptionKey != nil {
+		block, err := aes.NewCipher(o.encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		if m.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Session is the session of a request. It is safe for concurrent use.
+type Session struct {
+	mu        sync.Mutex
+	id        string
+	oldID     string
+	values    map[string]any
+	isNew     bool
+	modified  bool
+	destroyed bool
+}
+
+// ID returns the session ID.
+func (s *Session) ID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// Get returns the value of key, reports false if it is not set.
+func (s *Session) Get(key string) (any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set sets the value of key.
+func (s *Session) Set(key string, v any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = v
+	s.modified = true
+}
+
+// Delete removes key from the session.
+func (s *Session) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+	s.modified = true
+}
+
+// RenewID gives the session a new ID, keeping its values. It must be
+// called when the privileges of the session change, such as on login,
+// to prevent session fixation.
+func (s *Session) RenewID() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.oldID == "" && !s.isNew {
+		s.oldID = s.id
+	}
+	s.id = newSessionID()
+	s.modified = true
+}
+
+// Destroy removes the values of the session and expires its cookie.
+func (s *Session) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values = map[string]any{}
+	s.destroyed = true
+	s.modified = true
+}
+
+// SessionValue returns the value of key as a T, reports false if it is
+// not set or has another type.
+func SessionValue[T any](s *Session, key string) (T, bool) {
+	v, ok := s.Get(key)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Session returns the session of r, or nil if r is not handled by the
+// middleware of m.
+func (m *SessionManager) Session(r *internal.Request) *Session {
+	s, _ := r.Context().Value(sessionContextKey{m}).(*Session)
+	return s
+}
+
+// Middleware returns a [Handler] loading the session of r before
+// passing it to next. The session is saved and its cookie set when next
+// writes the response head, changes made after that are only kept by a
+// [SessionStore] for sessions that already had a cookie.
+func (m *SessionManager) Middleware(next Handler) Handler {
+	return func(w *internal.ResponseWriter, r *internal.Request) {
+		s := m.load(r)
+		r = r.WithContext(context.WithValue(r.Context(), sessionContextKey{m}, s))
+
+		hi := newHeadInterceptor(func(resp *internal.Response) (io.Writer, error) {
+			c, err := m.save(s)
+			if err != nil {
+				slog.Error("error saving the session", "err", err)
+			} else if c != nil {
+				resp.Headers.Add("Set-Cookie", c.String())
+				appendHeader(resp.Headers, "Cache-Control", `no-cache="Set-Cookie"`)
+			}
+			return w.Writer, writeHead(w.Writer, resp.ResponseLine.StatusCode, resp.Headers)
+		})
+		next(internal.NewResponseWriter(&hijackInterceptor{headInterceptor: hi, w: w}), r)
+
+		s.mu.Lock()
+		late := s.modified && !s.isNew && m.opts.store != nil
+		s.mu.Unlock()
+		if late {
+			if _, err := m.save(s); err != nil {
+				slog.Error("error saving the session", "err", err)
+			}
+		}
+	}
+}
+
+// sessionPayload is the content of a session cookie.
+type sessionPayload struct {
+	ID     string
+	Values map[string]any
+}
+
+// load returns the session of the cookie of r, or a new empty session.
+func (m *SessionManager) load(r *internal.Request) *Session {
+	if v, ok := r.Cookie(m.opts.cookie.Name); ok {
+		data, err := m.decode(v)
+		if err == nil {
+			if s, ok := m.loadPayload(data); ok {
+				return s
+			}
+		} else if !errors.Is(err, errExpiredSessionCookie) {
+			slog.Error("error reading the session cookie", "err", err)
+		}
+	}
+	return &Session{id: newSessionID(), values: map[string]any{}, isNew: true}
+}
+
+func (m *SessionManager) loadPayload(data []byte) (*Session, bool) {
+	if m.opts.store != nil {
+		values, ok := m.opts.store.Load(string(data))
+		if !ok {
+			return nil, false
+		}
+		return &Session{id: string(data), values: values}, true
+	}
+	var p sessionPayload
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p); err != nil {
+		return nil, false
+	}
+	if p.Values == nil {
+		p.Values = map[string]any{}
+	}
+	return &Session{id: p.ID, values: p.Values}, true
+}
+
+// save stores a modified session, returns the cookie to send or nil if
+// the cookie does not change.
+func (m *SessionManager) save(s *Session) (*internal.Cookie, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.modified {
+		return nil, nil
+	}
+	s.modified = false
+	c := m.opts.cookie
+
+	if s.destroyed {
+		if m.opts.store != nil {
+			if err := m.opts.store.Delete(s.id); err != nil {
+				return nil, err
+			}
+		}
+		if s.isNew {
+			return nil, nil
+		}
+		c.MaxAge = -1
+		return &c, nil
+	}
+
+	var data []byte
+	if m.opts.store != nil {
+		if s.oldID != "" {
+			if err := m.opts.store.Delete(s.oldID); err != nil {
+				return nil, err
+			}
+			s.oldID = ""
+		}
+		if err := m.opts.store.Save(s.id, s.values, m.opts.ttl); err != nil {
+			return nil, err
+		}
+		data = []byte(s.id)
+	} else {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(sessionPayload{ID: s.id, Values: s.values}); err != nil {
+			return nil, err
+		}
+		data = buf.Bytes()
+	}
+
+	v, err := m.encode(data)
+	if err != nil {
+		return nil, err
+	}
+	c.Value = v
+	c.MaxAge = int(m.opts.ttl / time.Second)
+	if len(c.String()) > maxCookieSize {
+		return nil, fmt.Errorf("session cookie exceeds %d bytes", maxCookieSize)
+	}
+	s.isNew = false
+	return &c, nil
+}
+
+// encode returns the cookie value holding data: the time it was issued,
+// data, encrypted if an encryption key is set, and the HMAC of the
+// cookie name and both.
+func (m *SessionManager) encode(data []byte) (string, error) {
+	if m.aead != nil {
+		nonce := make([]byte, m.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		data = m.aead.Seal(nonce, nonce, data, []byte(m.opts.cookie.Name))
+	}
+	b := binary.BigEndian.AppendUint64(nil, uint64(m.opts.now().Unix()))
+	b = append(b, data...)
+	b = append(b, m.mac(b)...)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decode verifies and returns the data of a cookie value made by encode.
+func (m *SessionManager) decode(v string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil || len(b) < 8+sha256.Size {
+		return nil, errInvalidSessionCookie
+	}
+	msg, mac := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	if !hmac.Equal(mac, m.mac(msg)) {
+		return nil, errInvalidSessionCookie
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(msg[:8])), 0)
+	if !issued.Add(m.opts.ttl).After(m.opts.now()) {
+		return nil, errExpiredSessionCookie
+	}
+	data := msg[8:]
+	if m.aead != nil {
+		n := m.aead.NonceSize()
+		if len(data) < n {
+			return nil, errInvalidSessionCookie
+		}
+		if data, err = m.aead.Open(nil, data[:n], data[n:], []byte(m.opts.cookie.Name)); err != nil {
+			return nil, errInvalidSessionCookie
+		}
+	}
+	return data, nil
+}
+
+func (m *SessionManager) mac(msg []byte) []byte {
+	h := hmac.New(sha256.New, m.hashKey)
+	h.Write([]byte(m.opts.cookie.Name + "|"))
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// newSessionID returns a random session ID of 256 bits.
+func newSessionID() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
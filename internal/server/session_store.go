@@ -0,0 +1,97 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// SessionStore keeps the values of server-side sessions by session ID.
+type SessionStore interface {
+	// Load returns the values of the session id, reports false if there
+	// is no such session or it has expired.
+	Load(id string) (map[string]any, bool)
+	// Save stores the values of the session id for ttl.
+	Save(id string, values map[string]any, ttl time.Duration) error
+	// Delete removes the session id.
+	Delete(id string) error
+}
+
+type memorySession struct {
+	values  map[string]any
+	expires time.Time
+}
+
+// MemorySessionStore is a [SessionStore] keeping the sessions in memory,
+// expired sessions are removed when they are loaded and by a sweep on
+// every save that follows the TTL of the store.
+type MemorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]memorySession
+	lastSweep time.Time
+	sweepTTL  time.Duration
+	now       func() time.Time
+}
+
+// NewMemorySessionStore creates an empty [MemorySessionStore].
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]memorySession),
+		sweepTTL: time.Minute,
+		now:      time.Now,
+	}
+}
+
+func (s *MemorySessionStore) Load(id string) (map[string]any, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if !sess.expires.After(s.now()) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return copyValues(sess.values), true
+}
+
+func (s *MemorySessionStore) Save(id string, values map[string]any, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sessions[id] = memorySession{values: copyValues(values), expires: now.Add(ttl)}
+	if now.Sub(s.lastSweep) >= s.sweepTTL {
+		s.lastSweep = now
+		for k, sess := range s.sessions {
+			if !sess.expires.After(now) {
+				delete(s.sessions, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemorySessionStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// Len returns the number of sessions held, including expired ones that
+// have not been removed yet.
+func (s *MemorySessionStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// copyValues returns a shallow copy of values so that the store is not
+// changed by a handler still holding the session.
+func copyValues(values map[string]any) map[string]any {
+	c := make(map[string]any, len(values))
+	for k, v := range values {
+		c[k] = v
+	}
+	return c
+}
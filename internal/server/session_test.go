@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var sessionKey = bytes.Repeat([]byte("k"), 32)
+
+// sessionRequest passes a request with the session cookie value to the
+// middleware of m around h, returns the response and the Set-Cookie
+// cookie of the session, nil if there is none.
+func sessionRequest(t *testing.T, m *SessionManager, value string, h func(s *Session)) (*internal.Response, *internal.Cookie) {
+	t.Helper()
+	r := internal.NewRequest("GET", "/")
+	if value != "" {
+		r.Headers.Set("Cookie", "session="+value)
+	}
+	handler := m.Middleware(func(w *internal.ResponseWriter, r *internal.Request) {
+		h(m.Session(r))
+		writeStatus(w, internal.StatusOK, internal.NewHeaders())
+	})
+	resp := proxyRequest(t, handler, r)
+	for _, c := range resp.SetCookies() {
+		if c.Name == "session" {
+			return resp, c
+		}
+	}
+	return resp, nil
+}
+
+func TestSessionCookie(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts []SessionOption
+	}{
+		{name: "signed"},
+		{name: "encrypted", opts: []SessionOption{WithEncryptionKey(bytes.Repeat([]byte("e"), 32))}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := NewSessionManager(sessionKey, tc.opts...)
+			assert.NoError(t, err)
+
+			resp, c := sessionRequest(t, m, "", func(s *Session) {})
+			assert.Nil(t, c, "an empty new session sets no cookie")
+
+			resp, c = sessionRequest(t, m, "", func(s *Session) { s.Set("user", "ana") })
+			assert.NotNil(t, c)
+			assert.True(t, c.HttpOnly)
+			assert.Equal(t, internal.SameSiteLax, c.SameSite)
+			assert.Equal(t, 86400, c.MaxAge)
+			assert.Contains(t, resp.Headers.Get("Cache-Control"), `no-cache="Set-Cookie"`)
+			assert.NotContains(t, c.Value, "ana")
+
+			var id string
+			_, next := sessionRequest(t, m, c.Value, func(s *Session) {
+				user, ok := SessionValue[string](s, "user")
+				assert.True(t, ok)
+				assert.Equal(t, "ana", user)
+				_, ok = SessionValue[int](s, "user")
+				assert.False(t, ok)
+				id = s.ID()
+			})
+			assert.Nil(t, next, "an unmodified session sets no cookie")
+			assert.NotEmpty(t, id)
+
+			tampered := []byte(c.Value)
+			tampered[len(tampered)/2] ^= 1
+			sessionRequest(t, m, string(tampered), func(s *Session) {
+				_, ok := s.Get("user")
+				assert.False(t, ok)
+				assert.NotEqual(t, id, s.ID())
+			})
+
+			_, c = sessionRequest(t, m, c.Value, func(s *Session) { s.Destroy() })
+			assert.NotNil(t, c)
+			assert.Equal(t, -1, c.MaxAge)
+		})
+	}
+}
+
+func TestSessionCookieExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	m, err := NewSessionManager(sessionKey, WithSessionTTL(time.Hour))
+	assert.NoError(t, err)
+	m.opts.now = func() time.Time { return now }
+
+	_, c := sessionRequest(t, m, "", func(s *Session) { s.Set("n", 1) })
+	assert.Equal(t, 3600, c.MaxAge)
+
+	now = now.Add(59 * time.Minute)
+	sessionRequest(t, m, c.Value, func(s *Session) {
+		_, ok := s.Get("n")
+		assert.True(t, ok)
+	})
+
+	now = now.Add(time.Minute)
+	sessionRequest(t, m, c.Value, func(s *Session) {
+		_, ok := s.Get("n")
+		assert.False(t, ok)
+	})
+
+	other, err := NewSessionManager(bytes.Repeat([]byte("o"), 32))
+	assert.NoError(t, err)
+	other.opts.now = m.opts.now
+	sessionRequest(t, other, c.Value, func(s *Session) {
+		_, ok := s.Get("n")
+		assert.False(t, ok, "a cookie signed with another key is rejected")
+	})
+}
+
+func TestSessionStore(t *testing.T) {
+	store := NewMemorySessionStore()
+	m, err := NewSessionManager(sessionKey, WithSessionStore(store))
+	assert.NoError(t, err)
+
+	var id string
+	_, c := sessionRequest(t, m, "", func(s *Session) {
+		s.Set("cart", []string{"a"})
+		id = s.ID()
+	})
+	assert.NotNil(t, c)
+	values, ok := store.Load(id)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a"}, values["cart"])
+
+	var renewed string
+	_, c2 := sessionRequest(t, m, c.Value, func(s *Session) {
+		s.RenewID()
+		renewed = s.ID()
+	})
+	assert.NotNil(t, c2)
+	assert.NotEqual(t, id, renewed)
+	_, ok = store.Load(id)
+	assert.False(t, ok, "the old ID is removed on rotation")
+	_, ok = store.Load(renewed)
+	assert.True(t, ok)
+	assert.Equal(t, 1, store.Len())
+
+	_, c = sessionRequest(t, m, c2.Value, func(s *Session) { s.Destroy() })
+	assert.Equal(t, -1, c.MaxAge)
+	assert.Equal(t, 0, store.Len())
+
+	sessionRequest(t, m, c2.Value, func(s *Session) {
+		_, ok := s.Get("cart")
+		assert.False(t, ok, "a destroyed session is not loaded again")
+	})
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := NewMemorySessionStore()
+	store.now = func() time.Time { return now }
+
+	values := map[string]any{"a": 1}
+	assert.NoError(t, store.Save("x", values, time.Minute))
+	assert.NoError(t, store.Save("y", values, time.Hour))
+	values["a"] = 2
+	got, ok := store.Load("x")
+	assert.True(t, ok)
+	assert.Equal(t, 1, got["a"])
+
+	now = now.Add(2 * time.Minute)
+	_, ok = store.Load("x")
+	assert.False(t, ok)
+	assert.Equal(t, 1, store.Len())
+
+	assert.NoError(t, store.Save("z", values, time.Minute))
+	now = now.Add(2 * time.Minute)
+	assert.NoError(t, store.Save("w", values, time.Minute))
+	assert.Equal(t, 2, store.Len(), "the sweep removes the expired sessions")
+
+	assert.NoError(t, store.Delete("y"))
+	_, ok = store.Load("y")
+	assert.False(t, ok)
+}
+
+func TestNewSessionManager(t *testing.T) {
+	_, err := NewSessionManager([]byte("short"))
+	assert.Error(t, err)
+	_, err = NewSessionManager(sessionKey, WithEncryptionKey([]byte("bad")))
+	assert.Error(t, err)
+	_, err = NewSessionManager(sessionKey, WithSessionCookie(internal.Cookie{Name: "s", SameSite: internal.SameSiteNone}))
+	assert.Error(t, err)
+}
+
+func TestSessionUpgrade(t *testing.T) {
+	m, err := NewSessionManager(sessionKey)
+	assert.NoError(t, err)
+	path := serveUnix(t, m.Middleware(func(w *internal.ResponseWriter, r *internal.Request) {
+		m.Session(r).Set("user", "gopher")
+		ws, err := Upgrade(w, r)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, ws.WriteMessage(TextMessage, []byte("hello")))
+		assert.NoError(t, ws.Close(CloseNormal, ""))
+	}))
+
+	conn, err := net.Dial("unix", path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(websocketRequest().String()))
+	assert.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := internal.ReadResponseHead(br)
+	assert.NoError(t, err)
+	assert.Equal(t, internal.StatusSwitchingProtocols, resp.ResponseLine.StatusCode)
+	// the session is saved with the head of the upgrade.
+	assert.Len(t, resp.SetCookies(), 1)
+	frame := make([]byte, 2+len("hello"))
+	_, err = io.ReadFull(br, frame)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(frame[2:]))
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"errors"
+	"httpfromtcp/internal"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrStreamClosed is returned when sending on a closed event stream or
+// one whose client went away.
+var ErrStreamClosed = errors.New("event stream closed")
+
+// SSEOptions configures [NewSSEWriter].
+type SSEOptions struct {
+	heartbeat time.Duration
+	retry     time.Duration
+}
+
+// DefaultSSEOptions returns the default options of [NewSSEWriter], a
+// heartbeat every 15 seconds and the reconnection time of the client.
+func DefaultSSEOptions() *SSEOptions {
+	return &SSEOptions{heartbeat: 15 * time.Second}
+}
+
+type SSEOption func(*SSEOptions)
+
+// WithHeartbeat sets the interval of the comments sent to keep the
+// stream open through proxies and to detect a client that went away,
+// zero disables them.
+func WithHeartbeat(d time.Duration) SSEOption {
+	return func(opts *SSEOptions) {
+		opts.heartbeat = d
+	}
+}
+
+// WithRetry sends the time the client waits before reconnecting when
+// the stream is closed.
+func WithRetry(d time.Duration) SSEOption {
+	return func(opts *SSEOptions) {
+		opts.retry = d
+	}
+}
+
+// Event is a server-sent event.
+type Event struct {
+	// ID sets the last event ID the client sends back in Last-Event-ID
+	// when it reconnects.
+	ID string
+	// Event is the type of the event, "message" when empty.
+	Event string
+	// Data is sent as one data field per line.
+	Data string
+	// Retry sets the reconnection time of the client when positive.
+	Retry time.Duration
+}
+
+// SSEWriter writes an event stream of the [Server-Sent Events] format.
+// It is safe for concurrent use.
+//
+// [Server-Sent Events]: https://html.spec.whatwg.org/multipage/server-sent-events.html
+type SSEWriter struct {
+	mu sync.Mutex
+	cw io.WriteCloser
+	// w is flushed after every event so that it is sent at once.
+	w           *internal.ResponseWriter
+	lastEventID string
+	done        chan struct{}
+	closeOnce   sync.Once
+	closed      bool
+}
+
+// NewSSEWriter answers r with a chunked text/event-stream response and
+// returns the writer of its events, which the caller must close.
+//
+// The events are written through w, and so through the middleware, which
+// is flushed after each of them. The client going away is noticed when
+// the server cancels the context of r, which closes the stream, or when
+// a write fails; [SSEWriter.Done] is closed in both cases.
+func NewSSEWriter(w *internal.ResponseWriter, r *internal.Request, opts ...SSEOption) (*SSEWriter, error) {
+	o := DefaultSSEOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+
+	h := internal.NewHeaders()
+	h.Set("Content-Type", "text/event-stream")
+	// no-transform keeps the compressor from buffering the events.
+	h.Set("Cache-Control", "no-cache, no-transform")
+	// disables the response buffering of nginx.
+	h.Set("X-Accel-Buffering", "no")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Connection", "close")
+	if err := w.WriteStatusLine(internal.StatusOK); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+
+	s := &SSEWriter{
+		cw:          internal.NewChunkedWriter(w),
+		w:           w,
+		lastEventID: r.GetHeader("Last-Event-ID"),
+		done:        make(chan struct{}),
+	}
+
+	if o.retry > 0 {
+		if err := s.write("retry: " + strconv.FormatInt(o.retry.Milliseconds(), 10) + "\n\n"); err != nil {
+			return nil, err
+		}
+	}
+	if o.heartbeat > 0 {
+		go s.heartbeat(o.heartbeat)
+	}
+	go func() {
+		select {
+		case <-r.Context().Done():
+			_ = s.Close()
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+// LastEventID returns the Last-Event-ID the client sent when
+// reconnecting, the events following it should be sent again.
+func (s *SSEWriter) LastEventID() string {
+	return s.lastEventID
+}
+
+// Done returns a channel closed when the stream is closed, when the
+// context of the request is done or when the client went away.
+func (s *SSEWriter) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes e, its fields being checked before anything is written.
+func (s *SSEWriter) Send(e Event) error {
+	if strings.ContainsAny(e.ID, "\r\n\x00") {
+		return errors.New("event id must not contain newlines or NUL")
+	}
+	if strings.ContainsAny(e.Event, "\r\n") {
+		return errors.New("event type must not contain newlines")
+	}
+
+	var b strings.Builder
+	if e.Event != "" {
+		b.WriteString("event: " + e.Event + "\n")
+	}
+	if e.Data != "" || e.Event != "" {
+		data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+		data = strings.ReplaceAll(data, "\r", "\n")
+		for _, line := range strings.Split(data, "\n") {
+			b.WriteString("data: " + line + "\n")
+		}
+	}
+	if e.ID != "" {
+		b.WriteString("id: " + e.ID + "\n")
+	}
+	if e.Retry > 0 {
+		b.WriteString("retry: " + strconv.FormatInt(e.Retry.Milliseconds(), 10) + "\n")
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Comment writes a comment line, which clients ignore.
+func (s *SSEWriter) Comment(text string) error {
+	var b strings.Builder
+	for _, line := range strings.Split(strings.ReplaceAll(text, "\r", ""), "\n") {
+		b.WriteString(": " + line + "\n")
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// write writes p as a single chunk so that every event is sent at once.
+func (s *SSEWriter) write(p string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStreamClosed
+	}
+	_, err := io.WriteString(s.cw, p)
+	if err == nil {
+		err = s.w.Flush()
+	}
+	if err != nil {
+		s.closed = true
+		s.finish()
+	}
+	return err
+}
+
+// Close ends the stream, the client reconnects unless told otherwise by
+// the application.
+func (s *SSEWriter) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	err := s.cw.Close()
+	if err == nil {
+		err = s.w.Flush()
+	}
+	s.finish()
+	return err
+}
+
+// finish closes done.
+func (s *SSEWriter) finish() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+func (s *SSEWriter) heartbeat(d time.Duration) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+			if err := s.Comment("heartbeat"); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"httpfromtcp/internal"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSSEWriter(t *testing.T) {
+	r := internal.NewRequest("GET", "/events")
+	r.Headers.Set("Last-Event-ID", "41")
+	var lastID string
+	// the stream goes through the middleware, which sees its bytes.
+	var logs bytes.Buffer
+	logger, err := NewAccessLogger(&logs, JSONLogFormat)
+	assert.NoError(t, err)
+	resp := proxyRequest(t, AccessLog(WithAccessLogger(logger))(func(w *internal.ResponseWriter, r *internal.Request) {
+		s, err := NewSSEWriter(w, r, WithHeartbeat(0), WithRetry(3*time.Second))
+		assert.NoError(t, err)
+		lastID = s.LastEventID()
+		assert.NoError(t, s.Send(Event{ID: "42", Event: "update", Data: "line 1\nline 2\r\n"}))
+		assert.NoError(t, s.Send(Event{Data: "plain"}))
+		assert.NoError(t, s.Comment("note"))
+		assert.Error(t, s.Send(Event{ID: "4\n3"}))
+		assert.NoError(t, s.Close())
+		assert.ErrorIs(t, s.Send(Event{Data: "late"}), ErrStreamClosed)
+		<-s.Done()
+	}), r)
+
+	assert.Equal(t, "41", lastID)
+	assert.Equal(t, internal.StatusOK, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Headers.Get("Content-Type"))
+	assert.Equal(t, "no-cache, no-transform", resp.Headers.Get("Cache-Control"))
+	assert.Equal(t, "retry: 3000\n\n"+
+		"event: update\ndata: line 1\ndata: line 2\ndata: \nid: 42\n\n"+
+		"data: plain\n\n"+
+		": note\n\n", string(resp.Body))
+
+	var record struct {
+		Status int `json:"status"`
+		Bytes  int `json:"bytes"`
+	}
+	assert.NoError(t, json.Unmarshal(logs.Bytes(), &record))
+	assert.Equal(t, 200, record.Status)
+	assert.Greater(t, record.Bytes, len(resp.Body))
+}
+
+func TestSSEWriterDisconnect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sse.sock")
+	srv := NewServer(WithUnix(path))
+	gone := make(chan error, 1)
+	err := srv.Serve(func(w *internal.ResponseWriter, r *internal.Request) {
+		s, err := NewSSEWriter(w, r, WithHeartbeat(10*time.Millisecond))
+		if err != nil {
+			gone <- err
+			return
+		}
+		select {
+		case <-s.Done():
+			gone <- s.Send(Event{Data: "late"})
+		case <-time.After(5 * time.Second):
+			gone <- s.Close()
+		}
+	})
+	assert.NoError(t, err)
+	defer srv.Close()
+
+	conn, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET /events HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	assert.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := internal.ReadResponseHead(br)
+	assert.NoError(t, err)
+	body, err := internal.ResponseBodyReader(br, resp, "GET")
+	assert.NoError(t, err)
+	buf := make([]byte, len(": heartbeat\n\n"))
+	_, err = io.ReadFull(body, buf)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf), ": heartbeat"))
+
+	assert.NoError(t, conn.Close())
+	assert.ErrorIs(t, <-gone, ErrStreamClosed)
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"context"
+	"httpfromtcp/internal"
+	"time"
+)
+
+// Timeout returns a [Middleware] setting a deadline of d on the context
+// of the requests, for the routes whose handlers must give up on slow
+// work such as an upstream that does not answer. The handlers are
+// expected to watch [internal.Request.Context], the response they write
+// is not cut short.
+func Timeout(d time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(w *internal.ResponseWriter, r *internal.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
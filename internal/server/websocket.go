@@ -0,0 +1,442 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"httpfromtcp/internal"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// websocketGUID is appended to the Sec-WebSocket-Key to compute the
+// Sec-WebSocket-Accept, see [RFC 6455 Section 4.2.2].
+//
+// [RFC 6455 Section 4.2.2]: https://datatracker.ietf.org/doc/html/rfc6455#section-4.2.2
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Status codes of a close frame, see [RFC 6455 Section 7.4.1].
+//
+// [RFC 6455 Section 7.4.1]: https://datatracker.ietf.org/doc/html/rfc6455#section-7.4.1
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	// CloseNoStatus is reported for a close frame without status code,
+	// it is never sent.
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// WebSocketMessageType is the type of a data message.
+type WebSocketMessageType int
+
+const (
+	TextMessage   WebSocketMessageType = WebSocketMessageType(opText)
+	BinaryMessage WebSocketMessageType = WebSocketMessageType(opBinary)
+)
+
+// ErrCloseSent is returned when writing to a WebSocket connection after
+// its close frame was sent.
+var ErrCloseSent = errors.New("websocket close frame already sent")
+
+// CloseError is the close frame a WebSocket connection was closed with,
+// either received from the client or sent after a protocol error.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// WebSocketOptions configures [Upgrade].
+type WebSocketOptions struct {
+	maxMessageSize int64
+	fragmentSize   int
+	subprotocols   []string
+	checkOrigin    func(r *internal.Request) bool
+}
+
+// DefaultWebSocketOptions returns the default options of [Upgrade],
+// messages of at most 1MiB written in a single frame and only same
+// origin requests.
+func DefaultWebSocketOptions() *WebSocketOptions {
+	return &WebSocketOptions{
+		maxMessageSize: 1 << 20,
+		checkOrigin:    sameOrigin,
+	}
+}
+
+type WebSocketOption func(*WebSocketOptions)
+
+// WithMaxMessageSize sets the maximum size of a message received,
+// fragments included. Larger messages close the connection with
+// [CloseMessageTooBig].
+func WithMaxMessageSize(n int64) WebSocketOption {
+	return func(opts *WebSocketOptions) {
+		opts.maxMessageSize = n
+	}
+}
+
+// WithFragmentSize splits the messages written into frames of at most
+// n bytes.
+func WithFragmentSize(n int) WebSocketOption {
+	return func(opts *WebSocketOptions) {
+		opts.fragmentSize = n
+	}
+}
+
+// WithSubprotocols sets the subprotocols the server speaks by
+// preference, the first one the client offers is selected.
+func WithSubprotocols(protocols ...string) WebSocketOption {
+	return func(opts *WebSocketOptions) {
+		opts.subprotocols = protocols
+	}
+}
+
+// WithOriginCheck replaces the check of the Origin header, which by
+// default must be missing or match the Host header.
+func WithOriginCheck(fn func(r *internal.Request) bool) WebSocketOption {
+	return func(opts *WebSocketOptions) {
+		opts.checkOrigin = fn
+	}
+}
+
+// sameOrigin reports whether r has no Origin or one whose host is the
+// Host of r. Browsers always send the Origin of the page opening a
+// WebSocket, which prevents cross-site WebSocket hijacking.
+func sameOrigin(r *internal.Request) bool {
+	origin := r.GetHeader("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.GetHeader("Host"))
+}
+
+// IsWebSocketUpgrade reports whether r asks to upgrade the connection
+// to the WebSocket protocol.
+func IsWebSocketUpgrade(r *internal.Request) bool {
+	return hasToken(r.GetHeader("Connection"), "upgrade") && hasToken(r.GetHeader("Upgrade"), "websocket")
+}
+
+// hasToken reports whether the comma separated list v contains token,
+// compared case-insensitively.
+func hasToken(v, token string) bool {
+	for _, part := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept of key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Upgrade answers the opening handshake of [RFC 6455 Section 4.2] with
+// 101 Switching Protocols and returns the WebSocket connection, which
+// the caller must close.
+//
+// When r is not a valid handshake, Upgrade answers it with the
+// appropriate status and returns a [HandlerError]. The connection is
+// taken over with [internal.ResponseWriter.Hijack], so the upgrade fails
+// behind a middleware replacing the writer of w.
+//
+// [RFC 6455 Section 4.2]: https://datatracker.ietf.org/doc/html/rfc6455#section-4.2
+func Upgrade(w *internal.ResponseWriter, r *internal.Request, opts ...WebSocketOption) (*WebSocketConn, error) {
+	o := DefaultWebSocketOptions()
+	for _, fn := range opts {
+		fn(o)
+	}
+
+	fail := func(code internal.HTTPStatusCode, h internal.HTTPHeaders, msg string) error {
+		writeStatus(w, code, h)
+		return HandlerError{StatusCode: code, Message: msg}
+	}
+	h := internal.NewHeaders()
+	if r.RequestLine.Method != "GET" {
+		h.Set("Allow", "GET")
+		return nil, fail(internal.StatusMethodNotAllowed, h, "websocket handshake must be a GET request")
+	}
+	if !IsWebSocketUpgrade(r) {
+		return nil, fail(internal.StatusBadRequest, h, "missing websocket upgrade")
+	}
+	if r.GetHeader("Sec-WebSocket-Version") != "13" {
+		h.Set("Sec-WebSocket-Version", "13")
+		return nil, fail(internal.StatusUpgradeRequired, h, "unsupported websocket version")
+	}
+	key := r.GetHeader("Sec-WebSocket-Key")
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return nil, fail(internal.StatusBadRequest, h, "invalid Sec-WebSocket-Key")
+	}
+	if o.checkOrigin != nil && !o.checkOrigin(r) {
+		return nil, fail(internal.StatusForbidden, h, "origin not allowed")
+	}
+	if !w.Hijackable() {
+		return nil, fail(internal.StatusInternalServerError, h, "connection does not support upgrades")
+	}
+
+	h.Set("Upgrade", "websocket")
+	h.Set("Connection", "Upgrade")
+	h.Set("Sec-WebSocket-Accept", websocketAccept(key))
+	subprotocol := selectSubprotocol(r.GetHeader("Sec-WebSocket-Protocol"), o.subprotocols)
+	if subprotocol != "" {
+		h.Set("Sec-WebSocket-Protocol", subprotocol)
+	}
+	if err := w.WriteStatusLine(internal.StatusSwitchingProtocols); err != nil {
+		return nil, err
+	}
+	if err := w.WriteHeaders(h); err != nil {
+		return nil, err
+	}
+	nc, br, err := w.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	return &WebSocketConn{
+		nc:             nc,
+		br:             br,
+		subprotocol:    subprotocol,
+		maxMessageSize: o.maxMessageSize,
+		fragmentSize:   o.fragmentSize,
+	}, nil
+}
+
+// selectSubprotocol returns the first of the supported subprotocols the
+// client offers, or "" if there is none.
+func selectSubprotocol(offered string, supported []string) string {
+	for _, p := range supported {
+		if hasToken(offered, p) {
+			return p
+		}
+	}
+	return ""
+}
+
+// WebSocketConn is a WebSocket connection of the server. A goroutine may
+// read messages while others write them.
+type WebSocketConn struct {
+	nc             net.Conn
+	br             *bufio.Reader
+	subprotocol    string
+	maxMessageSize int64
+	fragmentSize   int
+	pongHandler    func(data []byte)
+	readErr        error
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// Subprotocol returns the subprotocol selected during the handshake.
+func (c *WebSocketConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// SetPongHandler sets the function called with the payload of the pong
+// frames received, it must be set before reading.
+func (c *WebSocketConn) SetPongHandler(fn func(data []byte)) {
+	c.pongHandler = fn
+}
+
+// ReadMessage returns the next data message, reassembled from its
+// fragments. Pings are answered while reading.
+//
+// A close frame from the client is answered and returned as a
+// [*CloseError]. A frame breaking the protocol, such as an unmasked
+// one, or a message larger than the maximum size closes the connection
+// with the matching status code, also returned as a [*CloseError].
+// Once it failed ReadMessage keeps returning the same error.
+func (c *WebSocketConn) ReadMessage() (WebSocketMessageType, []byte, error) {
+	if c.readErr != nil {
+		return 0, nil, c.readErr
+	}
+	typ, msg, err := c.readMessage()
+	if err != nil {
+		var ce *CloseError
+		if errors.As(err, &ce) {
+			_ = c.writeClose(ce.Code, ce.Reason)
+		}
+		c.readErr = err
+		return 0, nil, err
+	}
+	return typ, msg, nil
+}
+
+func (c *WebSocketConn) readMessage() (WebSocketMessageType, []byte, error) {
+	var typ byte
+	var msg []byte
+	for {
+		f, err := readFrame(c.br, c.maxMessageSize-int64(len(msg)))
+		if err != nil {
+			return 0, nil, err
+		}
+		if f.rsv != 0 {
+			return 0, nil, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+		}
+		if !f.masked {
+			return 0, nil, &CloseError{Code: CloseProtocolError, Reason: "client frames must be masked"}
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeControl(opPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			if c.pongHandler != nil {
+				c.pongHandler(f.payload)
+			}
+			continue
+		case opClose:
+			return 0, nil, parseClose(f.payload)
+		case opText, opBinary:
+			if typ != 0 {
+				return 0, nil, &CloseError{Code: CloseProtocolError, Reason: "expected a continuation frame"}
+			}
+			typ = f.opcode
+		case opContinuation:
+			if typ == 0 {
+				return 0, nil, &CloseError{Code: CloseProtocolError, Reason: "unexpected continuation frame"}
+			}
+		default:
+			return 0, nil, &CloseError{Code: CloseProtocolError, Reason: "unknown opcode"}
+		}
+
+		msg = append(msg, f.payload...)
+		if f.fin {
+			if typ == opText && !utf8.Valid(msg) {
+				return 0, nil, &CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8"}
+			}
+			return WebSocketMessageType(typ), msg, nil
+		}
+	}
+}
+
+// parseClose returns the [*CloseError] of a close frame payload, whose
+// code must be one an endpoint may send and reason valid UTF-8.
+func parseClose(payload []byte) error {
+	switch {
+	case len(payload) == 0:
+		return &CloseError{Code: CloseNoStatus}
+	case len(payload) == 1:
+		return &CloseError{Code: CloseProtocolError, Reason: "invalid close frame"}
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	reason := payload[2:]
+	if !validCloseCode(code) {
+		return &CloseError{Code: CloseProtocolError, Reason: "invalid close code"}
+	}
+	if !utf8.Valid(reason) {
+		return &CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8"}
+	}
+	return &CloseError{Code: code, Reason: string(reason)}
+}
+
+// validCloseCode reports whether code may be sent in a close frame, the
+// codes reserved by RFC 6455 and 1004 to 1006 excluded.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// WriteMessage writes a data message, split into fragments when a
+// fragment size is set.
+func (c *WebSocketConn) WriteMessage(typ WebSocketMessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return fmt.Errorf("invalid websocket message type %d", typ)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+
+	opcode := byte(typ)
+	for {
+		chunk := data
+		if c.fragmentSize > 0 && len(chunk) > c.fragmentSize {
+			chunk = data[:c.fragmentSize]
+		}
+		data = data[len(chunk):]
+		if err := writeFrame(c.nc, len(data) == 0, opcode, nil, chunk); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		opcode = opContinuation
+	}
+}
+
+// Ping sends a ping frame whose payload is at most 125 bytes.
+func (c *WebSocketConn) Ping(data []byte) error {
+	return c.writeControl(opPing, data)
+}
+
+func (c *WebSocketConn) writeControl(opcode byte, data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket control frame payload exceeds 125 bytes")
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrCloseSent
+	}
+	return writeFrame(c.nc, true, opcode, nil, data)
+}
+
+// writeClose sends the close frame unless it was already sent.
+func (c *WebSocketConn) writeClose(code int, reason string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return nil
+	}
+	c.closeSent = true
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+		if len(payload) > maxControlPayload {
+			payload = payload[:maxControlPayload]
+		}
+	}
+	return writeFrame(c.nc, true, opClose, nil, payload)
+}
+
+// Close sends a close frame with code and reason, unless one was sent
+// already, and closes the connection.
+func (c *WebSocketConn) Close(code int, reason string) error {
+	err := c.writeClose(code, reason)
+	if cerr := c.nc.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
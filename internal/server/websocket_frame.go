@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Opcodes of [RFC 6455 Section 5.2], the ones of control frames have
+// their most significant bit set.
+//
+// [RFC 6455 Section 5.2]: https://datatracker.ietf.org/doc/html/rfc6455#section-5.2
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xa
+)
+
+// maxControlPayload is the maximum payload length of a control frame.
+const maxControlPayload = 125
+
+// wsFrame is a WebSocket frame whose payload has been unmasked.
+//
+//	 0                   1                   2                   3
+//	 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+//	+-+-+-+-+-------+-+-------------+-------------------------------+
+//	|F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+//	|I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+//	|N|V|V|V|       |S|             |   (if payload len==126/127)   |
+//	| |1|2|3|       |K|             |                               |
+//	+-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+//	|     Extended payload length continued, if payload len == 127  |
+//	+ - - - - - - - - - - - - - - - +-------------------------------+
+//	|                               |Masking-key, if MASK set to 1  |
+//	+-------------------------------+-------------------------------+
+//	| Masking-key (continued)       |          Payload Data         |
+//	+-------------------------------- - - - - - - - - - - - - - - - +
+type wsFrame struct {
+	fin     bool
+	rsv     byte
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+func isControl(opcode byte) bool {
+	return opcode&0x8 != 0
+}
+
+// readFrame reads a frame from br. A data frame whose payload is longer
+// than max and a control frame that is fragmented or longer than 125
+// bytes are not read, a [*CloseError] with the code to close the
+// connection with is returned instead.
+func readFrame(br *bufio.Reader, max int64) (*wsFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(br, head[:]); err != nil {
+		return nil, err
+	}
+	f := &wsFrame{
+		fin:    head[0]&0x80 != 0,
+		rsv:    head[0] & 0x70,
+		opcode: head[0] & 0x0f,
+		masked: head[1]&0x80 != 0,
+	}
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+		if n>>63 != 0 {
+			return nil, &CloseError{Code: CloseProtocolError, Reason: "invalid payload length"}
+		}
+	}
+
+	if isControl(f.opcode) {
+		if !f.fin || n > maxControlPayload {
+			return nil, &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+		}
+	} else if max < 0 || n > uint64(max) {
+		return nil, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	var key [4]byte
+	if f.masked {
+		if _, err := io.ReadFull(br, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(br, f.payload); err != nil {
+		return nil, err
+	}
+	if f.masked {
+		maskBytes(key[:], f.payload)
+	}
+	return f, nil
+}
+
+// writeFrame writes a frame of payload to w, masked with key unless it
+// is nil. Servers never mask their frames, see [RFC 6455 Section 5.1].
+//
+// [RFC 6455 Section 5.1]: https://datatracker.ietf.org/doc/html/rfc6455#section-5.1
+func writeFrame(w io.Writer, fin bool, opcode byte, key []byte, payload []byte) error {
+	b := make([]byte, 0, 14+len(payload))
+	b0 := opcode
+	if fin {
+		b0 |= 0x80
+	}
+	b = append(b, b0)
+
+	var mask byte
+	if key != nil {
+		mask = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, mask|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b = append(b, mask|126)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	default:
+		b = append(b, mask|127)
+		b = binary.BigEndian.AppendUint64(b, uint64(len(payload)))
+	}
+
+	if key != nil {
+		b = append(b, key...)
+	}
+	start := len(b)
+	b = append(b, payload...)
+	if key != nil {
+		maskBytes(key, b[start:])
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// maskBytes masks or unmasks b in place with the 4 bytes of key.
+func maskBytes(key []byte, b []byte) {
+	for i := range b {
+		b[i] ^= key[i%4]
+	}
+}
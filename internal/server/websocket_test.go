@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"httpfromtcp/internal"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// the example of RFC 6455 Section 1.3.
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func websocketRequest() *internal.Request {
+	r := internal.NewRequest("GET", "/ws")
+	r.Headers.Set("Host", "example.com")
+	r.Headers.Set("Connection", "keep-alive, Upgrade")
+	r.Headers.Set("Upgrade", "websocket")
+	r.Headers.Set("Sec-WebSocket-Version", "13")
+	r.Headers.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	return r
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	testCases := []struct {
+		name   string
+		modify func(r *internal.Request)
+		status internal.HTTPStatusCode
+		header string
+	}{
+		{
+			name:   "not GET",
+			modify: func(r *internal.Request) { r.RequestLine.Method = "POST" },
+			status: internal.StatusMethodNotAllowed,
+		},
+		{
+			name:   "no upgrade",
+			modify: func(r *internal.Request) { r.Headers.Delete("Upgrade") },
+			status: internal.StatusBadRequest,
+		},
+		{
+			name:   "version",
+			modify: func(r *internal.Request) { r.Headers.Set("Sec-WebSocket-Version", "8") },
+			status: internal.StatusUpgradeRequired,
+			header: "13",
+		},
+		{
+			name:   "short key",
+			modify: func(r *internal.Request) { r.Headers.Set("Sec-WebSocket-Key", "c2hvcnQ=") },
+			status: internal.StatusBadRequest,
+		},
+		{
+			name:   "cross origin",
+			modify: func(r *internal.Request) { r.Headers.Set("Origin", "https://evil.example") },
+			status: internal.StatusForbidden,
+		},
+		{
+			name:   "not a server connection",
+			modify: func(r *internal.Request) { r.Headers.Set("Origin", "https://example.com") },
+			status: internal.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := websocketRequest()
+			tc.modify(r)
+			var err error
+			resp := proxyRequest(t, func(w *internal.ResponseWriter, r *internal.Request) {
+				_, err = Upgrade(w, r)
+			}, r)
+			assert.ErrorAs(t, err, &HandlerError{})
+			assert.Equal(t, tc.status, resp.ResponseLine.StatusCode)
+			assert.Equal(t, tc.header, resp.Headers.Get("Sec-WebSocket-Version"))
+		})
+	}
+}
+
+// dialWebSocket starts a server echoing the messages of the WebSocket
+// connections and returns a connection that completed the handshake.
+func dialWebSocket(t *testing.T, opts ...WebSocketOption) (net.Conn, *bufio.Reader, *internal.Response) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ws.sock")
+	srv := NewServer(WithUnix(path))
+	err := srv.Serve(func(w *internal.ResponseWriter, r *internal.Request) {
+		ws, err := Upgrade(w, r, opts...)
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ws.Close(CloseNormal, "")
+			for {
+				typ, msg, err := ws.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := ws.WriteMessage(typ, msg); err != nil {
+					return
+				}
+			}
+		}()
+	})
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = srv.Close() })
+
+	conn, err := net.Dial("unix", path)
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(websocketRequest().String()))
+	assert.NoError(t, err)
+
+	br := bufio.NewReader(conn)
+	resp, err := internal.ReadResponseHead(br)
+	assert.NoError(t, err)
+	return conn, br, resp
+}
+
+var testMask = []byte{0x12, 0x34, 0x56, 0x78}
+
+func TestWebSocketEcho(t *testing.T) {
+	conn, br, resp := dialWebSocket(t, WithSubprotocols("v2", "chat"), WithFragmentSize(4))
+	assert.Equal(t, internal.StatusSwitchingProtocols, resp.ResponseLine.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Headers.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "", resp.Headers.Get("Sec-WebSocket-Protocol"))
+
+	// a text message in two fragments with a ping between them.
+	assert.NoError(t, writeFrame(conn, false, opText, testMask, []byte("hel")))
+	assert.NoError(t, writeFrame(conn, true, opPing, testMask, []byte("p")))
+	assert.NoError(t, writeFrame(conn, true, opContinuation, testMask, []byte("lo!")))
+
+	f, err := readFrame(br, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, opPong, f.opcode)
+	assert.Equal(t, []byte("p"), f.payload)
+
+	// the echo is written in fragments of 4 bytes.
+	var got []byte
+	for i, expected := range []struct {
+		opcode byte
+		fin    bool
+	}{{opText, false}, {opContinuation, true}} {
+		f, err := readFrame(br, 1<<20)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.False(t, f.masked)
+		assert.Equal(t, expected.opcode, f.opcode, "frame %d", i)
+		assert.Equal(t, expected.fin, f.fin, "frame %d", i)
+		got = append(got, f.payload...)
+	}
+	assert.Equal(t, "hello!", string(got))
+
+	assert.NoError(t, writeFrame(conn, true, opClose, testMask, binary.BigEndian.AppendUint16(nil, CloseGoingAway)))
+	f, err = readFrame(br, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, opClose, f.opcode)
+	assert.Equal(t, uint16(CloseGoingAway), binary.BigEndian.Uint16(f.payload))
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		write  func(conn net.Conn)
+		status int
+	}{
+		{
+			name: "unmasked frame",
+			write: func(conn net.Conn) {
+				_ = writeFrame(conn, true, opText, nil, []byte("hi"))
+			},
+			status: CloseProtocolError,
+		},
+		{
+			name: "message too big",
+			write: func(conn net.Conn) {
+				_ = writeFrame(conn, false, opBinary, testMask, make([]byte, 10))
+				_ = writeFrame(conn, true, opContinuation, testMask, make([]byte, 10))
+			},
+			status: CloseMessageTooBig,
+		},
+		{
+			name: "fragmented ping",
+			write: func(conn net.Conn) {
+				_ = writeFrame(conn, false, opPing, testMask, nil)
+			},
+			status: CloseProtocolError,
+		},
+		{
+			name: "continuation without message",
+			write: func(conn net.Conn) {
+				_ = writeFrame(conn, true, opContinuation, testMask, []byte("x"))
+			},
+			status: CloseProtocolError,
+		},
+		{
+			name: "invalid UTF-8",
+			write: func(conn net.Conn) {
+				_ = writeFrame(conn, true, opText, testMask, []byte{0xff, 0xfe})
+			},
+			status: CloseInvalidPayload,
+		},
+		{
+			name: "reserved close code",
+			write: func(conn net.Conn) {
+				_ = writeFrame(conn, true, opClose, testMask, binary.BigEndian.AppendUint16(nil, 1006))
+			},
+			status: CloseProtocolError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conn, br, _ := dialWebSocket(t, WithMaxMessageSize(16))
+			tc.write(conn)
+			f, err := readFrame(br, 1<<20)
+			assert.NoError(t, err)
+			assert.Equal(t, opClose, f.opcode)
+			assert.Equal(t, uint16(tc.status), binary.BigEndian.Uint16(f.payload))
+		})
+	}
+}
+
+func TestSelectSubprotocol(t *testing.T) {
+	assert.Equal(t, "chat", selectSubprotocol("v1, chat", []string{"chat", "v1"}))
+	assert.Equal(t, "", selectSubprotocol("v1", []string{"chat"}))
+}